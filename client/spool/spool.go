@@ -0,0 +1,543 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package spool provides a disk backed queue buffering events while the
+// lumberjack server is unreachable.
+//
+// Events published to a Spool are appended to segment files and forwarded to
+// the server in the background, retrying until the events have been ACKed.
+// Events not yet ACKed survive restarts of the process, such that clients
+// do not drop events on long outages. Events ACKed by the server but not yet
+// recorded as ACKed before a crash are sent again.
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/log"
+)
+
+// Sender publishes batches of JSON encoded events, e.g. v2.SyncClient or
+// v2.MultiClient. SendJSON returns the number of events ACKed.
+type Sender interface {
+	SendJSON(data [][]byte) (int, error)
+}
+
+// Config configures a Spool.
+type Config struct {
+	// Dir is the directory segment files are stored in. Dir must be used by
+	// a single Spool only.
+	Dir string
+
+	// SegmentSize is the size in bytes after which a new segment file is
+	// started. The default is 16MiB.
+	SegmentSize int64
+
+	// MaxSize limits the total size of all segment files in bytes. Publish
+	// returns ErrFull if the limit would be exceeded. The default of 0
+	// disables the limit.
+	MaxSize int64
+
+	// MaxAge drops segment files whose last event has been published more
+	// than MaxAge ago, without sending the events. The default of 0 disables
+	// the limit.
+	MaxAge time.Duration
+
+	// BatchSize is the maximum number of events sent per batch. The default
+	// is 1024.
+	BatchSize int
+
+	// RetryInterval is the time to wait before retrying to send a batch after
+	// sending failed. The default is 1s.
+	RetryInterval time.Duration
+
+	// Sync flushes segment files to disk on every Publish.
+	Sync bool
+}
+
+// ErrFull is returned by Publish if the spool exceeds Config.MaxSize.
+var ErrFull = errors.New("spool is full")
+
+// ErrClosed is returned by Publish if the spool has been closed.
+var ErrClosed = errors.New("spool is closed")
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	recordHdr  = 4
+)
+
+// Spool is a disk backed queue of events forwarded to a Sender.
+type Spool struct {
+	sender Sender
+	cfg    Config
+
+	mu       sync.Mutex
+	segments []*segment // ordered by ID, last segment is active
+	active   *os.File
+	dirty    bool // active segment holds data of a failed write beyond its size
+	closed   bool
+
+	// read position, updated by the drain loop only
+	readID  uint64
+	readOff int64
+
+	notify chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+type segment struct {
+	id      uint64
+	size    int64 // bytes committed
+	modTime time.Time
+}
+
+// Open opens the spool in cfg.Dir, creating the directory if missing, and
+// starts forwarding events spooled to sender. Events spooled by previous
+// processes are forwarded first.
+func Open(sender Sender, cfg Config) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("spool directory missing")
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 16 << 20
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 1024
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = time.Second
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		sender: sender,
+		cfg:    cfg,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if err := s.roll(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.drain()
+	return s, nil
+}
+
+// load reads the segments and cursor left by previous processes.
+func (s *Spool) load() error {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		}
+		s.segments = append(s.segments, &segment{id: id, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	if b, err := os.ReadFile(filepath.Join(s.cfg.Dir, cursorFile)); err == nil && len(b) == 16 {
+		s.readID = binary.BigEndian.Uint64(b)
+		s.readOff = int64(binary.BigEndian.Uint64(b[8:]))
+	}
+	if len(s.segments) > 0 && s.readID < s.segments[0].id {
+		s.readID, s.readOff = s.segments[0].id, 0
+	}
+	return nil
+}
+
+// roll starts a new active segment. Must be called with s.mu held or before
+// the spool is shared.
+func (s *Spool) roll() error {
+	id := uint64(1)
+	if n := len(s.segments); n > 0 {
+		id = s.segments[n-1].id + 1
+	}
+
+	f, err := os.OpenFile(s.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	if s.active != nil {
+		_ = s.active.Close() // ignore error
+	}
+	s.active = f
+	s.segments = append(s.segments, &segment{id: id, modTime: time.Now()})
+	if len(s.segments) == 1 {
+		s.readID, s.readOff = id, 0
+	}
+	return nil
+}
+
+// repair drops data left in the active segment by a failed write, such that
+// records written later are not misaligned. Rolls to a new segment if the
+// active segment can not be truncated. Must be called with s.mu held.
+func (s *Spool) repair() error {
+	size := s.segments[len(s.segments)-1].size
+	if err := s.active.Truncate(size); err == nil {
+		if _, err := s.active.Seek(size, io.SeekStart); err == nil {
+			s.dirty = false
+			return nil
+		}
+	}
+
+	if err := s.roll(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// Publish appends JSON encoded events to the spool. Events are forwarded in
+// the background. Returns ErrFull if the spool exceeds Config.MaxSize.
+func (s *Spool) Publish(events [][]byte) error {
+	var buf []byte
+	for _, e := range events {
+		var hdr [recordHdr]byte
+		binary.BigEndian.PutUint32(hdr[:], uint32(len(e)))
+		buf = append(buf, hdr[:]...)
+		buf = append(buf, e...)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if s.cfg.MaxSize > 0 && s.size()+int64(len(buf)) > s.cfg.MaxSize {
+		return ErrFull
+	}
+
+	if s.dirty {
+		if err := s.repair(); err != nil {
+			return err
+		}
+	}
+
+	active := s.segments[len(s.segments)-1]
+	if active.size > 0 && active.size+int64(len(buf)) > s.cfg.SegmentSize {
+		if err := s.roll(); err != nil {
+			return err
+		}
+		active = s.segments[len(s.segments)-1]
+	}
+	if _, err := s.active.Write(buf); err != nil {
+		s.dirty = true
+		_ = s.repair() // retried by the next Publish
+		return err
+	}
+	if s.cfg.Sync {
+		if err := s.active.Sync(); err != nil {
+			s.dirty = true
+			_ = s.repair() // retried by the next Publish
+			return err
+		}
+	}
+	active.size += int64(len(buf))
+	active.modTime = time.Now()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Size returns the total size of all segment files in bytes, including
+// events already forwarded from segments still being read.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size()
+}
+
+func (s *Spool) size() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// Close stops forwarding events and closes the spool, waiting for the batch
+// currently being sent. Events not yet ACKed are kept on disk and forwarded
+// once the spool is opened again.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.done)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active.Close()
+}
+
+// drain forwards spooled events to the sender until the spool is closed.
+func (s *Spool) drain() {
+	defer s.wg.Done()
+
+	for {
+		events, sizes, err := s.read()
+		if err != nil {
+			log.Errorf("Failed to read spool segment %v: %v", s.readID, err)
+			s.skipSegment()
+			if !s.wait(s.cfg.RetryInterval) {
+				return
+			}
+			continue
+		}
+		if len(events) == 0 {
+			if !s.advance() && !s.wait(0) {
+				return
+			}
+			continue
+		}
+
+		for len(events) > 0 {
+			n, err := s.sender.SendJSON(events)
+			if err == nil && n == 0 {
+				err = errors.New("no events ACKed")
+			}
+			if n > 0 {
+				s.commit(sizes[:n])
+				events, sizes = events[n:], sizes[n:]
+			}
+			if err != nil && len(events) > 0 {
+				log.Warnf("Failed to send %v spooled events, retrying: %v", len(events), err)
+				if !s.wait(s.cfg.RetryInterval) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// read reads up to BatchSize events from the current read position.
+func (s *Spool) read() ([][]byte, []int64, error) {
+	s.mu.Lock()
+	s.expire()
+	seg := s.segment(s.readID)
+	s.mu.Unlock()
+	if seg == nil {
+		return nil, nil, nil
+	}
+
+	s.mu.Lock()
+	committed := seg.size
+	s.mu.Unlock()
+	if s.readOff >= committed {
+		return nil, nil, nil
+	}
+
+	f, err := os.Open(s.segmentPath(seg.id))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(s.readOff, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+
+	var events [][]byte
+	var sizes []int64
+	remaining := committed - s.readOff
+	r := bufio.NewReader(io.LimitReader(f, remaining))
+	for len(events) < s.cfg.BatchSize {
+		var hdr [recordHdr]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break // end of committed data or truncated record
+		}
+		remaining -= recordHdr
+
+		// a length exceeding the committed data stems from a truncated or
+		// corrupt record, don't trust it for allocating the event
+		size := int64(binary.BigEndian.Uint32(hdr[:]))
+		if size > remaining {
+			break
+		}
+		event := make([]byte, size)
+		if _, err := io.ReadFull(r, event); err != nil {
+			break
+		}
+		remaining -= size
+		events = append(events, event)
+		sizes = append(sizes, recordHdr+size)
+	}
+	return events, sizes, nil
+}
+
+// advance moves the read position to the next segment once no more events
+// can be read from the current segment, deleting the segment. A truncated
+// record at the end of a segment left by a crash is dropped. Returns false
+// if the active segment is being read.
+func (s *Spool) advance() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segments[len(s.segments)-1].id == s.readID {
+		return false
+	}
+	s.removeSegments(s.readID)
+	return true
+}
+
+// skipSegment drops the current read segment after read errors.
+func (s *Spool) skipSegment() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) > 0 && s.segments[len(s.segments)-1].id == s.readID {
+		return // do not drop the active segment
+	}
+	s.removeSegments(s.readID)
+}
+
+// removeSegments removes all segments up to and including id and moves the
+// read position to the next segment. Must be called with s.mu held.
+func (s *Spool) removeSegments(id uint64) {
+	for len(s.segments) > 1 && s.segments[0].id <= id {
+		_ = os.Remove(s.segmentPath(s.segments[0].id)) // ignore error
+		s.segments = s.segments[1:]
+	}
+	s.readID, s.readOff = s.segments[0].id, 0
+	s.saveCursor()
+}
+
+// expire drops segments exceeding MaxAge. Must be called with s.mu held.
+func (s *Spool) expire() {
+	if s.cfg.MaxAge <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(-s.cfg.MaxAge)
+	var last uint64
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		if seg.modTime.After(deadline) {
+			break
+		}
+		last = seg.id
+	}
+	if last != 0 && last >= s.readID {
+		log.Warnf("Dropping spooled events older than %v", s.cfg.MaxAge)
+		s.removeSegments(last)
+	}
+}
+
+// segment returns the segment with the given ID. Must be called with s.mu
+// held.
+func (s *Spool) segment(id uint64) *segment {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+// commit advances the read position past the ACKed events.
+func (s *Spool) commit(sizes []int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sz := range sizes {
+		s.readOff += sz
+	}
+	s.saveCursor()
+}
+
+// saveCursor persists the read position. Must be called with s.mu held.
+func (s *Spool) saveCursor() {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:], s.readID)
+	binary.BigEndian.PutUint64(b[8:], uint64(s.readOff))
+
+	path := filepath.Join(s.cfg.Dir, cursorFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b[:], 0o600); err != nil {
+		log.Errorf("Failed to write spool cursor: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		log.Errorf("Failed to write spool cursor: %v", err)
+	}
+}
+
+// wait waits for new events or timeout, if timeout > 0. Returns false if the
+// spool has been closed.
+func (s *Spool) wait(timeout time.Duration) bool {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+
+	select {
+	case <-s.done:
+		return false
+	case <-timer:
+		return true
+	case <-s.notify:
+		if timeout > 0 {
+			// keep waiting for the retry interval
+			select {
+			case <-s.done:
+				return false
+			case <-timer:
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,253 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v1
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/scippio/go-lumber/codec"
+	"github.com/scippio/go-lumber/lj"
+	protocol "github.com/scippio/go-lumber/protocol/v1"
+)
+
+// Client implements the low-level lumberjack wire protocol. SyncClient should
+// be used for publishing events to lumberjack endpoint.
+type Client struct {
+	conn net.Conn
+	wb   *bytes.Buffer
+	fb   []byte // frame buffer reused for encoding events
+
+	opts options
+}
+
+// ErrProtocolError is returned if a protocol error was detected in the
+// conversation with lumberjack server.
+var ErrProtocolError = lj.ErrProtocol
+
+var (
+	codeCompressed = []byte{protocol.CodeVersion, protocol.CodeCompressed}
+
+	empty4 = []byte{0, 0, 0, 0}
+)
+
+// NewWithConn create a new lumberjack client with an existing and active
+// connection.
+func NewWithConn(c net.Conn, opts ...Option) (*Client, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn: c,
+		wb:   bytes.NewBuffer(nil),
+		opts: o,
+	}, nil
+}
+
+// Dial connects to the lumberjack server and returns new Client.
+// Returns an error if connection attempt fails.
+func Dial(address string, opts ...Option) (*Client, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := net.Dialer{Timeout: o.timeout}
+	return DialWith(dialer.Dial, address, opts...)
+}
+
+// DialWith uses provided dialer to connect to lumberjack server returning a
+// new Client. Returns error if connection attempt fails.
+func DialWith(
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	opts ...Option,
+) (*Client, error) {
+	c, err := dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewWithConn(c, opts...)
+	if err != nil {
+		_ = c.Close() // ignore error
+		return nil, err
+	}
+	return client, nil
+}
+
+// Close closes underlying network connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Send attempts to encode and send all events as key/value data frames
+// without waiting for ACK. Returns error if sending fails.
+func (c *Client) Send(data []map[string]string) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	// 1. create window message
+	c.wb.Reset()
+	if err := protocol.Encode(c.wb, &protocol.Frame{Type: protocol.CodeWindowSize, Count: uint32(len(data))}); err != nil {
+		return err
+	}
+
+	// 2. serialize data (payload)
+	if c.opts.compressLvl != 0 {
+		// Compressed Data Frame:
+		// version: uint8 = '1'
+		// code: uint8 = 'C'
+		// payloadSz: uint32
+		// payload: compressed payload
+
+		if err := c.writeCompressed(data); err != nil {
+			return err
+		}
+	} else if err := c.serialize(c.wb, data); err != nil {
+		return err
+	}
+
+	// 3. send buffer
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	payload := c.wb.Bytes()
+	for len(payload) > 0 {
+		n, err := c.conn.Write(payload)
+		if err != nil {
+			return lj.WrapNetError(err)
+		}
+
+		payload = payload[n:]
+	}
+	return nil
+}
+
+// ReceiveACK awaits and reads next ACK response or error. Note: Server might
+// send partial ACK, in which case client must continue reading ACKs until last send
+// window size is matched. Use AwaitACK when waiting for a known sequence number.
+func (c *Client) ReceiveACK() (uint32, error) {
+	if err := c.setReadDeadline(); err != nil {
+		return 0, err
+	}
+
+	var msg [6]byte
+	if _, err := io.ReadFull(c.conn, msg[:]); err != nil {
+		return 0, lj.WrapNetError(err)
+	}
+
+	// validate response
+	isACK := msg[0] == protocol.CodeVersion && msg[1] == protocol.CodeACK
+	if !isACK {
+		return 0, ErrProtocolError
+	}
+
+	seq := binary.BigEndian.Uint32(msg[2:])
+	return seq, nil
+}
+
+// AwaitACK waits for count elements being ACKed. Returns last known ACK on error.
+func (c *Client) AwaitACK(count uint32) (uint32, error) {
+	var ackSeq uint32
+
+	// read until all ACKs, keeping the highest partial ACK received
+	for ackSeq < count {
+		seq, err := c.ReceiveACK()
+		if err != nil {
+			return ackSeq, err
+		}
+		if seq > ackSeq {
+			ackSeq = seq
+		}
+	}
+
+	if ackSeq > count {
+		return count, lj.NewError(lj.ErrProtocol, fmt.Sprintf(
+			"invalid sequence number received (seq=%v, expected=%v)", ackSeq, count))
+	}
+	return ackSeq, nil
+}
+
+func (c *Client) writeCompressed(data []map[string]string) error {
+	_, _ = c.wb.Write(codeCompressed) // write compressed header
+
+	offSz := c.wb.Len()
+	_, _ = c.wb.Write(empty4)
+	offPayload := c.wb.Len()
+
+	// compress payload
+	zlib, _ := codec.ByName("zlib")
+	w, err := zlib.NewWriter(c.wb, c.opts.compressLvl)
+	if err != nil {
+		return err
+	}
+
+	if err := c.serialize(w, data); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// write compress header
+	payloadSz := c.wb.Len() - offPayload
+	binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(payloadSz))
+	return nil
+}
+
+func (c *Client) serialize(out io.Writer, data []map[string]string) error {
+	for i, fields := range data {
+		// Write Data Frame:
+		// version: uint8 = '1'
+		// code: uint8 = 'D'
+		// seq: uint32
+		// pairs: uint32
+		// (keyLen: uint32, key, valueLen: uint32, value)*
+
+		var err error
+		c.fb, err = protocol.AppendFrame(c.fb[:0], &protocol.Frame{
+			Type:   protocol.CodeDataFrame,
+			Seq:    uint32(i) + 1,
+			Fields: fields,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(c.fb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) setWriteDeadline() error {
+	return c.conn.SetWriteDeadline(time.Now().Add(c.opts.timeout))
+}
+
+func (c *Client) setReadDeadline() error {
+	return c.conn.SetReadDeadline(time.Now().Add(c.opts.timeout))
+}
@@ -0,0 +1,68 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v1
+
+import (
+	"errors"
+	"time"
+)
+
+// Option type to be passed to New/Dial functions.
+type Option func(*options) error
+
+type options struct {
+	timeout     time.Duration
+	compressLvl int
+}
+
+// Timeout client option configuring read/write timeout.
+func Timeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("timeouts must not be negative")
+		}
+		opt.timeout = to
+		return nil
+	}
+}
+
+// CompressionLevel client option setting the zlib compression level (1 to 9,
+// or -1 for zlib's default level). Level 0, the default, disables
+// compression, sending plain data frames.
+func CompressionLevel(l int) Option {
+	return func(opt *options) error {
+		if !(-1 <= l && l <= 9) {
+			return errors.New("compression level must be within -1 and 9")
+		}
+		opt.compressLvl = l
+		return nil
+	}
+}
+
+func applyOptions(opts []Option) (options, error) {
+	o := options{
+		timeout: 30 * time.Second,
+	}
+
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
@@ -21,6 +21,9 @@ import (
 	"io"
 	"net"
 	"sync"
+	"time"
+
+	protocol "github.com/scippio/go-lumber/protocol/v2"
 )
 
 // AsyncClient asynchronously publishes events to lumberjack endpoint. On ACK a
@@ -37,20 +40,33 @@ type AsyncClient struct {
 }
 
 type ackMessage struct {
-	cb  AsyncSendCallback
-	seq uint32
-	err error
+	cb   AsyncSendCallback
+	seq  uint32
+	err  error
+	sent time.Time
 }
 
 // AsyncSendCallback callback function. Upon completion seq contains the last
 // ACKed event's index. The count starts with 1. The err argument contains the latest
 // error encountered by lumberjack client.
 //
+// On error, seq is the number of events partially ACKed by the server, such
+// that only the events following seq need to be republished.
+//
 // Note: The callback MUST not block. In case callback is trying to republish
 // not ACKed events, care must be taken not to deadlock the AsyncClient when calling
 // Send.
 type AsyncSendCallback func(seq uint32, err error)
 
+// Future is the handle of a batch published by AsyncClient.SendFuture. The
+// future resolves once the batch has been ACKed by the lumberjack server or
+// publishing the batch failed.
+type Future struct {
+	done chan struct{}
+	seq  uint32
+	err  error
+}
+
 // NewAsyncClientWith creates a new AsyncClient from low-level lumberjack v2 Client.
 // The inflight argument sets number of active publish requests.
 func NewAsyncClientWith(cl *Client, inflight int) (*AsyncClient, error) {
@@ -112,11 +128,48 @@ func (c *AsyncClient) Close() error {
 	return err
 }
 
+// Capabilities returns the capabilities advertised by the server in response
+// to the hello frame. Returns nil if capabilities have not been negotiated.
+func (c *AsyncClient) Capabilities() *protocol.Hello {
+	return c.cl.Capabilities()
+}
+
 // Send publishes a new batch of events by JSON-encoding given batch.
 // Send blocks if maximum number of allowed asynchronous calls is still active.
 // Upon completion cb will be called with last ACKed index into active batch.
+// Batches exceeding MaxWindowSize or the SlowStart window are sent in
+// multiple windows, cb being called once all windows have been ACKed or on
+// the first error.
 // Returns error if communication or serialization to JSON failed.
 func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
+	window, rest := c.cl.nextWindow(data)
+	if len(rest) == 0 {
+		return c.sendWindow(cb, data)
+	}
+
+	// report the progress of the complete batch once, when the last window
+	// has been ACKed or a window failed
+	done, offset := false, 0
+	for ; len(window) > 0; window, rest = c.cl.nextWindow(rest) {
+		last, windowOffset := len(rest) == 0, offset
+		offset += len(window)
+
+		err := c.sendWindow(func(seq uint32, err error) {
+			if done || (err == nil && !last) {
+				return
+			}
+			done = true // callbacks are run by the ACK loop only
+			cb(uint32(windowOffset)+seq, err)
+		}, window)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *AsyncClient) sendWindow(cb AsyncSendCallback, data []interface{}) error {
+	sent := time.Now()
 	if err := c.cl.Send(data); err != nil {
 		c.ch <- ackMessage{
 			seq: 0,
@@ -127,13 +180,47 @@ func (c *AsyncClient) Send(cb AsyncSendCallback, data []interface{}) error {
 	}
 
 	c.ch <- ackMessage{
-		seq: uint32(len(data)),
-		cb:  cb,
-		err: nil,
+		seq:  uint32(len(data)),
+		cb:   cb,
+		err:  nil,
+		sent: sent,
 	}
 	return nil
 }
 
+// SendJSON publishes a new batch of JSON encoded events, like Send. Events are
+// sent as is without being encoded.
+func (c *AsyncClient) SendJSON(cb AsyncSendCallback, data [][]byte) error {
+	return c.Send(cb, rawEvents(data))
+}
+
+// SendFuture publishes a new batch of events by JSON-encoding given batch, like
+// Send. Instead of calling a callback, SendFuture returns a Future resolving
+// once the batch has been ACKed. If publishing fails, the error is returned
+// and the returned Future resolves with the error as well.
+func (c *AsyncClient) SendFuture(data []interface{}) (*Future, error) {
+	f := &Future{done: make(chan struct{})}
+	err := c.Send(f.resolve, data)
+	return f, err
+}
+
+func (f *Future) resolve(seq uint32, err error) {
+	f.seq, f.err = seq, err
+	close(f.done)
+}
+
+// Done returns a channel being closed once the future has been resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the future has been resolved. It returns the number of
+// events ACKed by the lumberjack server and the error encountered, if any.
+func (f *Future) Wait() (int, error) {
+	<-f.done
+	return int(f.seq), f.err
+}
+
 func (c *AsyncClient) startACK() {
 	c.ch = make(chan ackMessage, c.inflight)
 	c.wg.Add(1)
@@ -171,6 +258,14 @@ func (c *AsyncClient) ackLoop() {
 		}
 
 		seq, err = c.cl.AwaitACK(msg.seq)
+		if err != nil {
+			c.cl.windowFailed(err)
+		} else {
+			c.cl.windowACKed(int(msg.seq))
+			if o := c.cl.opts.observer; o != nil && msg.seq > 0 {
+				o.BatchACKed(int(msg.seq), time.Since(msg.sent))
+			}
+		}
 		msg.cb(seq, err)
 		if err != nil {
 			c.cl.Close()
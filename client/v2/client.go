@@ -20,14 +20,17 @@ package v2
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
+	"sync/atomic"
 	"time"
 
-	"github.com/klauspost/compress/zlib"
-
+	"github.com/scippio/go-lumber/codec"
+	"github.com/scippio/go-lumber/lj"
 	protocol "github.com/scippio/go-lumber/protocol/v2"
 )
 
@@ -36,21 +39,52 @@ import (
 type Client struct {
 	conn net.Conn
 	wb   *bytes.Buffer
+	fb   []byte // frame buffer reused for encoding events
+
+	// codec negotiated via hello frame, nil if not negotiated
+	codec      *codec.Codec
+	compressor io.WriteCloser // reused if the codec writer supports Reset
+
+	// event codec negotiated via hello frame, nil if events are sent as JSON
+	eventCodec *codec.EventCodec
+	protobuf   bool // protobuf extension accepted by the server
+
+	// server hello response, nil if capabilities have not been negotiated
+	capabilities *protocol.Hello
+
+	// dial and address used for reconnecting, dial is nil if the client has
+	// not been created via Dial or DialWith
+	dial    func(network, address string) (net.Conn, error)
+	address string
+	closed  uint32 // no reconnects once closed, updated atomically
+
+	// deadline of the batch being sent, zero if no batch timeout is configured
+	batchDeadline time.Time
+
+	// slow start window size, 0 if slow start is disabled, updated atomically
+	window int32
+
+	// connection age and number of batches ACKed on the connection, used for
+	// recycling connections
+	connected time.Time
+	batches   int
 
 	opts options
 }
 
 var (
-	codeWindowSize    = []byte{protocol.CodeVersion, protocol.CodeWindowSize}
-	codeCompressed    = []byte{protocol.CodeVersion, protocol.CodeCompressed}
-	codeJSONDataFrame = []byte{protocol.CodeVersion, protocol.CodeJSONDataFrame}
+	codeCompressed = []byte{protocol.CodeVersion, protocol.CodeCompressed}
 
 	empty4 = []byte{0, 0, 0, 0}
 )
 
 // ErrProtocolError is returned if a protocol error was detected in the
 // conversation with lumberjack server.
-var ErrProtocolError = errors.New("lumberjack protocol error")
+var ErrProtocolError = lj.ErrProtocol
+
+// ErrBatchTimeout is returned if a batch has not been ACKed within the
+// timeout configured via BatchTimeout. It is of kind lj.ErrTimeout.
+var ErrBatchTimeout = lj.NewError(lj.ErrTimeout, "batch not ACKed within batch timeout")
 
 // NewWithConn create a new lumberjack client with an existing and active
 // connection.
@@ -59,11 +93,113 @@ func NewWithConn(c net.Conn, opts ...Option) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		conn: c,
-		wb:   bytes.NewBuffer(nil),
-		opts: o,
-	}, nil
+
+	cl := &Client{
+		conn:      c,
+		wb:        bytes.NewBuffer(nil),
+		opts:      o,
+		window:    int32(o.slowStart),
+		connected: time.Now(),
+	}
+	if err := cl.init(); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// init negotiates the protocol capabilities on a new connection if required.
+func (c *Client) init() error {
+	o := c.opts
+	if o.codec != "" || o.eventCodec != "" || o.protobuf != nil || o.negotiate {
+		return c.negotiate()
+	}
+	return nil
+}
+
+// negotiate sends the hello frame, enabling the configured codec and event
+// codec if accepted by the server.
+func (c *Client) negotiate() error {
+	hello := protocol.Hello{
+		Codecs:          []string{protocol.CodecZlib},
+		KeepaliveMillis: c.opts.timeout.Milliseconds(),
+	}
+	if c.opts.codec != "" && c.opts.codec != protocol.CodecZlib {
+		hello.Codecs = append([]string{c.opts.codec}, hello.Codecs...)
+	}
+	if c.opts.eventCodec != "" {
+		hello.EventCodecs = []string{c.opts.eventCodec}
+	}
+	if c.opts.protobuf != nil {
+		hello.Extensions = []string{protocol.ExtensionProtobuf}
+	}
+	payload, err := json.Marshal(hello)
+	if err != nil {
+		return err
+	}
+
+	c.wb.Reset()
+	if err := protocol.Encode(c.wb, &protocol.Frame{Type: protocol.CodeHello, Payload: payload}); err != nil {
+		return err
+	}
+
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(c.wb.Bytes()); err != nil {
+		return err
+	}
+
+	// read hello response
+	if err := c.setReadDeadline(); err != nil {
+		return err
+	}
+	resp, err := protocol.Decode(c.conn, 0)
+	if err != nil {
+		return err
+	}
+	if resp.Type != protocol.CodeHello {
+		return ErrProtocolError
+	}
+
+	var accepted protocol.Hello
+	if err := json.Unmarshal(resp.Payload, &accepted); err != nil {
+		return ErrProtocolError
+	}
+	c.capabilities = &accepted
+	for _, name := range accepted.Codecs {
+		if name != c.opts.codec {
+			continue
+		}
+
+		negotiated, ok := codec.ByName(name)
+		if !ok {
+			return ErrProtocolError
+		}
+		c.codec = &negotiated
+	}
+	for _, name := range accepted.EventCodecs {
+		if name != c.opts.eventCodec {
+			continue
+		}
+
+		negotiated, ok := codec.EventByName(name)
+		if !ok {
+			return ErrProtocolError
+		}
+		c.eventCodec = &negotiated
+	}
+	for _, ext := range accepted.Extensions {
+		if ext == protocol.ExtensionProtobuf && c.opts.protobuf != nil {
+			c.protobuf = true
+		}
+	}
+	return nil
+}
+
+// Capabilities returns the capabilities advertised by the server in response
+// to the hello frame. Returns nil if capabilities have not been negotiated.
+func (c *Client) Capabilities() *protocol.Hello {
+	return c.capabilities
 }
 
 // Dial connects to the lumberjack server and returns new Client.
@@ -74,18 +210,25 @@ func Dial(address string, opts ...Option) (*Client, error) {
 		return nil, err
 	}
 
-	dialer := net.Dialer{Timeout: o.timeout}
-	return DialWith(dialer.Dial, address, opts...)
+	return DialWith(o.dialer(), address, opts...)
 }
 
 // DialWith uses provided dialer to connect to lumberjack server returning a
-// new Client. Returns error if connection attempt fails.
+// new Client. If a proxy is configured, the connection is established via the
+// proxy. If TLS is enabled via options, the TLS handshake is run on the
+// dialed connection. Returns error if connection attempt fails.
 func DialWith(
 	dial func(network, address string) (net.Conn, error),
 	address string,
 	opts ...Option,
 ) (*Client, error) {
-	c, err := dial("tcp", address)
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	dial = o.observeDial(o.tlsDial(o.proxyDial(o.resolveDial(dial))))
+	c, err := dial(o.network, address)
 	if err != nil {
 		return nil, err
 	}
@@ -95,15 +238,133 @@ func DialWith(
 		_ = c.Close() // ignore error
 		return nil, err
 	}
+	client.dial, client.address = dial, address
 	return client, nil
 }
 
+// nextWindow splits the next window of at most MaxWindowSize events, or the
+// current slow start window size, off data.
+func (c *Client) nextWindow(data []interface{}) (window, rest []interface{}) {
+	max := c.opts.maxWindow
+	if w := int(atomic.LoadInt32(&c.window)); w > 0 && (max <= 0 || w < max) {
+		max = w
+	}
+	if max <= 0 || len(data) <= max {
+		return data, nil
+	}
+	return data[:max], data[max:]
+}
+
+// windowACKed grows the slow start window after a window of n events has
+// been ACKed, up to MaxWindowSize.
+func (c *Client) windowACKed(n int) {
+	w := atomic.LoadInt32(&c.window)
+	if w <= 0 || n < int(w) {
+		return // slow start disabled or window not used completely
+	}
+	grown := w * 2
+	if max := int32(c.opts.maxWindow); max > 0 && grown > max {
+		grown = max
+	}
+	if grown > 0 { // no overflow
+		atomic.CompareAndSwapInt32(&c.window, w, grown)
+	}
+}
+
+// windowFailed shrinks the slow start window after a window has not been
+// ACKed in time.
+func (c *Client) windowFailed(err error) {
+	if w := atomic.LoadInt32(&c.window); w > 1 && errors.Is(err, lj.ErrTimeout) {
+		atomic.CompareAndSwapInt32(&c.window, w, w/2)
+	}
+}
+
+// reconnect closes the current connection and re-dials the lumberjack
+// server, renegotiating the protocol capabilities.
+func (c *Client) reconnect() error {
+	_ = c.conn.Close() // ignore error
+
+	conn, err := c.dial(c.opts.network, c.address)
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	c.connected, c.batches = time.Now(), 0
+	atomic.StoreInt32(&c.window, int32(c.opts.slowStart))
+	c.codec, c.compressor, c.eventCodec = nil, nil, nil
+	c.protobuf, c.capabilities = false, nil
+	if err := c.init(); err != nil {
+		_ = conn.Close() // ignore error
+		return err
+	}
+	return nil
+}
+
+// canReconnect reports whether the client shall reconnect after attempt
+// failed attempts due to err.
+func (c *Client) canReconnect(attempt int, err error) bool {
+	b := c.opts.reconnect
+	if b == nil || c.dial == nil || atomic.LoadUint32(&c.closed) == 1 {
+		return false
+	}
+	if b.MaxRetries > 0 && attempt >= b.MaxRetries {
+		return false
+	}
+	return isNetError(err)
+}
+
+// expired reports whether the connection is due for being recycled as
+// configured via RecycleAfter.
+func (c *Client) expired() bool {
+	if c.dial == nil || atomic.LoadUint32(&c.closed) == 1 {
+		return false
+	}
+	return c.recycleDue()
+}
+
+// recycleDue reports whether the connection exceeds the age or number of
+// batches configured via RecycleAfter.
+func (c *Client) recycleDue() bool {
+	o := &c.opts
+	return (o.recycleAge > 0 && time.Since(c.connected) >= o.recycleAge) ||
+		(o.recycleBatches > 0 && c.batches >= o.recycleBatches)
+}
+
+// isNetError reports whether err has been caused by the network connection
+// failing.
+func isNetError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, lj.ErrClosed) || errors.Is(err, lj.ErrTimeout) ||
+		errors.As(err, &netErr)
+}
+
+// backoff waits before reconnect attempt n (starting at 0).
+func (c *Client) backoff(n int) {
+	time.Sleep(c.opts.reconnect.wait(n))
+}
+
+// wait returns the time to wait before reconnect attempt n (starting at 0).
+func (b *Backoff) wait(n int) time.Duration {
+	wait := b.Init
+	for i := 0; i < n && wait < b.Max; i++ {
+		wait *= 2
+	}
+	if wait > b.Max {
+		wait = b.Max
+	}
+	return wait - time.Duration(b.Jitter*rand.Float64()*float64(wait))
+}
+
 // Close closes underlying network connection
 func (c *Client) Close() error {
+	atomic.StoreUint32(&c.closed, 1)
 	return c.conn.Close()
 }
 
-// Send attempts to JSON-encode and send all events without waiting for ACK.
+// Send attempts to encode and send all events without waiting for ACK. Events
+// are JSON-encoded unless an event codec has been negotiated.
 // Returns error if sending or serialization fails.
 func (c *Client) Send(data []interface{}) error {
 	if len(data) == 0 {
@@ -112,47 +373,89 @@ func (c *Client) Send(data []interface{}) error {
 
 	// 1. create window message
 	c.wb.Reset()
-	_, _ = c.wb.Write(codeWindowSize)
-	writeUint32(c.wb, uint32(len(data)))
+	if err := protocol.Encode(c.wb, &protocol.Frame{Type: protocol.CodeWindowSize, Count: uint32(len(data))}); err != nil {
+		return err
+	}
 
 	// 2. serialize data (payload)
-	if c.opts.compressLvl > 0 {
-		// Compressed Data Frame:
+	switch {
+	case c.codec != nil:
+		// Compressed Data Frame using the codec negotiated via hello frame:
 		// version: uint8 = '2'
-		// code: uint8 = 'C'
+		// code: uint8 = codec frame type
 		// payloadSz: uint32
 		// payload: compressed payload
 
-		_, _ = c.wb.Write(codeCompressed) // write compressed header
-
-		offSz := c.wb.Len()
-		_, _ = c.wb.Write(empty4)
-		offPayload := c.wb.Len()
-
-		// compress payload
-		w, err := zlib.NewWriterLevel(c.wb, c.opts.compressLvl)
-		if err != nil {
-			return err
-		}
-
-		if err := c.serialize(w, data); err != nil {
+		code := []byte{protocol.CodeVersion, c.codec.Code}
+		if err := c.writeCompressed(code, data, c.newCompressor); err != nil {
 			return err
 		}
+	case c.opts.compressLvl != 0:
+		// Compressed Data Frame:
+		// version: uint8 = '2'
+		// code: uint8 = 'C'
+		// payloadSz: uint32
+		// payload: compressed payload
 
-		if err := w.Close(); err != nil {
+		zlib, _ := codec.ByName(protocol.CodecZlib)
+		err := c.writeCompressed(codeCompressed, data, func(w io.Writer) (io.WriteCloser, error) {
+			return zlib.NewWriter(w, c.opts.compressLvl)
+		})
+		if err != nil {
 			return err
 		}
-
-		// write compress header
-		payloadSz := c.wb.Len() - offPayload
-		binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(payloadSz))
-	} else {
+	default:
 		if err := c.serialize(c.wb, data); err != nil {
 			return err
 		}
 	}
 
 	// 3. send buffer
+	return c.flush(len(data))
+}
+
+// SendJSON attempts to send all JSON encoded events without waiting for ACK.
+// Events are sent in JSON data frames as is, without being encoded, even if
+// an event codec has been negotiated.
+func (c *Client) SendJSON(data [][]byte) error {
+	return c.Send(rawEvents(data))
+}
+
+// rawEvents converts JSON encoded events to events sent as is.
+func rawEvents(data [][]byte) []interface{} {
+	events := make([]interface{}, len(data))
+	for i, b := range data {
+		events[i] = json.RawMessage(b)
+	}
+	return events
+}
+
+// SendCompressed sends a batch of count events encoded in compressed frames,
+// e.g. as retained by a server on lj.Batch.Compressed, without waiting for ACK.
+// Frames are sent as is. The codecs used to compress the frames must be
+// enabled by the server.
+func (c *Client) SendCompressed(count int, frames []lj.CompressedFrame) error {
+	if count == 0 {
+		return nil
+	}
+
+	c.wb.Reset()
+	if err := protocol.Encode(c.wb, &protocol.Frame{Type: protocol.CodeWindowSize, Count: uint32(count)}); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		var hdr [6]byte
+		hdr[0], hdr[1] = protocol.CodeVersion, f.Type
+		binary.BigEndian.PutUint32(hdr[2:], uint32(len(f.Payload)))
+		_, _ = c.wb.Write(hdr[:])
+		_, _ = c.wb.Write(f.Payload)
+	}
+	return c.flush(count)
+}
+
+// flush writes the buffered frames of a window of count events to the
+// connection.
+func (c *Client) flush(count int) error {
 	if err := c.setWriteDeadline(); err != nil {
 		return err
 	}
@@ -160,12 +463,15 @@ func (c *Client) Send(data []interface{}) error {
 	for len(payload) > 0 {
 		n, err := c.conn.Write(payload)
 		if err != nil {
-			return err
+			return lj.WrapNetError(err)
 		}
 
 		payload = payload[n:]
 	}
 
+	if c.opts.observer != nil {
+		c.opts.observer.BatchSent(count, c.wb.Len())
+	}
 	return nil
 }
 
@@ -182,7 +488,7 @@ func (c *Client) ReceiveACK() (uint32, error) {
 	for ackBytes < 6 {
 		n, err := c.conn.Read(msg[ackBytes:])
 		if err != nil {
-			return 0, err
+			return 0, lj.WrapNetError(err)
 		}
 		ackBytes += n
 	}
@@ -197,56 +503,133 @@ func (c *Client) ReceiveACK() (uint32, error) {
 	return seq, nil
 }
 
-// AwaitACK waits for count elements being ACKed. Returns last known ACK on error.
+// AwaitACK waits for count elements being ACKed. Keepalive ACKs and partial
+// ACKs are consumed, each resetting the read timeout, and reported to the
+// OnProgress callback. Returns last known ACK on error.
 func (c *Client) AwaitACK(count uint32) (uint32, error) {
 	var ackSeq uint32
-	var err error
 
-	// read until all ACKs
+	// read until all ACKs, keeping the highest partial ACK received
 	for ackSeq < count {
-		ackSeq, err = c.ReceiveACK()
+		seq, err := c.ReceiveACK()
 		if err != nil {
 			return ackSeq, err
 		}
+		if seq > ackSeq {
+			ackSeq = seq
+		}
+		if c.opts.onProgress != nil && ackSeq <= count {
+			c.opts.onProgress(int(ackSeq), int(count))
+		}
 	}
 
 	if ackSeq > count {
-		return count, fmt.Errorf(
-			"invalid sequence number received (seq=%v, expected=%v)", ackSeq, count)
+		return count, lj.NewError(lj.ErrProtocol, fmt.Sprintf(
+			"invalid sequence number received (seq=%v, expected=%v)", ackSeq, count))
 	}
 	return ackSeq, nil
 }
 
+func (c *Client) writeCompressed(
+	code []byte,
+	data []interface{},
+	compressor func(io.Writer) (io.WriteCloser, error),
+) error {
+	_, _ = c.wb.Write(code) // write compressed header
+
+	offSz := c.wb.Len()
+	_, _ = c.wb.Write(empty4)
+	offPayload := c.wb.Len()
+
+	// compress payload
+	w, err := compressor(c.wb)
+	if err != nil {
+		return err
+	}
+
+	if err := c.serialize(w, data); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// write compress header
+	payloadSz := c.wb.Len() - offPayload
+	binary.BigEndian.PutUint32(c.wb.Bytes()[offSz:], uint32(payloadSz))
+	return nil
+}
+
+// newCompressor returns a writer for the negotiated codec. Writers supporting
+// Reset are reused for subsequent batches.
+func (c *Client) newCompressor(w io.Writer) (io.WriteCloser, error) {
+	if r, ok := c.compressor.(interface{ Reset(io.Writer) }); ok {
+		r.Reset(w)
+		return c.compressor, nil
+	}
+
+	compressor, err := c.codec.NewWriter(w, c.opts.codecLvl)
+	if err != nil {
+		return nil, err
+	}
+	c.compressor = compressor
+	return compressor, nil
+}
+
 func (c *Client) serialize(out io.Writer, data []interface{}) error {
+	code, encode := protocol.CodeJSONDataFrame, c.opts.encoder
+	switch {
+	case c.protobuf:
+		code, encode = protocol.CodeProtobufDataFrame, c.opts.protobuf
+	case c.eventCodec != nil:
+		code, encode = protocol.CodeEncodedDataFrame, c.eventCodec.Marshal
+	}
+
 	for i, d := range data {
-		b, err := c.opts.encoder(d)
-		if err != nil {
+		frameCode := code
+		var b []byte
+		var err error
+		if raw, ok := d.(json.RawMessage); ok {
+			frameCode, b = protocol.CodeJSONDataFrame, raw // pre-rendered JSON
+		} else if b, err = encode(d); err != nil {
 			return err
 		}
 
-		// Write JSON Data Frame:
+		// Write JSON, Encoded or Protobuf Data Frame:
 		// version: uint8 = '2'
-		// code: uint8 = 'J'
+		// code: uint8 = 'J', 'E' or 'P'
 		// seq: uint32
 		// payloadLen (bytes): uint32
-		// payload: JSON document
+		// payload: JSON document or encoded event
 
-		_, _ = out.Write(codeJSONDataFrame)
-		writeUint32(out, uint32(i)+1)
-		writeUint32(out, uint32(len(b)))
-		_, _ = out.Write(b)
+		c.fb, err = protocol.AppendFrame(c.fb[:0], &protocol.Frame{
+			Type:    frameCode,
+			Seq:     uint32(i) + 1,
+			Payload: b,
+		})
+		if err != nil {
+			return err
+		}
+		_, _ = out.Write(c.fb)
 	}
 	return nil
 }
 
 func (c *Client) setWriteDeadline() error {
-	return c.conn.SetWriteDeadline(time.Now().Add(c.opts.timeout))
+	return c.conn.SetWriteDeadline(c.deadline())
 }
 
 func (c *Client) setReadDeadline() error {
-	return c.conn.SetReadDeadline(time.Now().Add(c.opts.timeout))
+	return c.conn.SetReadDeadline(c.deadline())
 }
 
-func writeUint32(out io.Writer, v uint32) {
-	_ = binary.Write(out, binary.BigEndian, v)
+// deadline returns the deadline of the next I/O operation, limited by the
+// batch deadline if set.
+func (c *Client) deadline() time.Time {
+	deadline := time.Now().Add(c.opts.timeout)
+	if !c.batchDeadline.IsZero() && c.batchDeadline.Before(deadline) {
+		return c.batchDeadline
+	}
+	return deadline
 }
@@ -0,0 +1,332 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Strategy selects the host a MultiClient publishes a batch to.
+type Strategy int
+
+const (
+	// RoundRobin distributes batches to the healthy hosts in turn.
+	RoundRobin Strategy = iota
+
+	// LeastPending publishes batches to the healthy host with the least
+	// batches waiting for being ACKed.
+	LeastPending
+)
+
+// ErrNoHostAvailable is returned by MultiClient if no host is available for
+// publishing a batch.
+var ErrNoHostAvailable = errors.New("no lumberjack host available")
+
+// defaultProbeBackoff configures the wait time before failed hosts are probed
+// again if no Reconnect option has been given.
+var defaultProbeBackoff = Backoff{Init: time.Second, Max: 60 * time.Second, Jitter: 0.1}
+
+// MultiClient publishes batches to multiple lumberjack endpoints, distributing
+// batches across the healthy hosts as configured by its Strategy. If
+// publishing a batch to a host fails due to network errors, the host is
+// marked as failed and the events not yet ACKed are published to another
+// host. Failed hosts are probed for recovery by reconnecting after a backoff,
+// configured via the Reconnect option.
+//
+// MultiClient is safe for concurrent use. Concurrent batches are published
+// to different hosts, each host handling one batch at a time.
+type MultiClient struct {
+	dial     func(network, address string) (net.Conn, error)
+	opts     []Option
+	strategy Strategy
+	backoff  Backoff
+	observer Observer
+
+	mu    sync.Mutex
+	hosts []*host
+	next  int // next host for round robin
+}
+
+type host struct {
+	address string
+	pending int32 // batches waiting for ACK, updated atomically
+
+	// serializes batches published to the host
+	sendMu sync.Mutex
+	cl     *SyncClient // nil if not connected
+
+	// health, guarded by MultiClient.mu
+	failures int
+	retryAt  time.Time
+}
+
+// MultiDial connects to the lumberjack servers at addresses and returns a new
+// MultiClient. Hosts failing to connect are probed again later. On error, if
+// no host could be connected, no MultiClient is being created.
+func MultiDial(addresses []string, strategy Strategy, opts ...Option) (*MultiClient, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return MultiDialWith(o.dialer(), addresses, strategy, opts...)
+}
+
+// MultiDialWith uses provided dialer to connect to the lumberjack servers at
+// addresses. On error, if no host could be connected, no MultiClient is
+// being returned.
+func MultiDialWith(
+	dial func(network, address string) (net.Conn, error),
+	addresses []string,
+	strategy Strategy,
+	opts ...Option,
+) (*MultiClient, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no lumberjack host configured")
+	}
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &MultiClient{
+		dial:     dial,
+		opts:     opts,
+		strategy: strategy,
+		backoff:  defaultProbeBackoff,
+		observer: o.observer,
+	}
+	if o.reconnect != nil {
+		c.backoff = *o.reconnect
+	}
+
+	var lastErr error
+	connected := false
+	for _, address := range addresses {
+		h := &host{address: address}
+		c.hosts = append(c.hosts, h)
+		if lastErr = c.connect(h); lastErr != nil {
+			c.failed(h)
+			continue
+		}
+		connected = true
+	}
+	if !connected {
+		return nil, lastErr
+	}
+	return c, nil
+}
+
+// PoolDial opens n connections to the lumberjack server at address and
+// returns a new MultiClient dispatching batches across the connections to
+// the connection with the least pending batches. As the protocol ACKs batches
+// serially per connection, concurrent Sends on a pool increase throughput
+// beyond the window of a single connection.
+func PoolDial(address string, n int, opts ...Option) (*MultiClient, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return PoolDialWith(o.dialer(), address, n, opts...)
+}
+
+// PoolDialWith uses provided dialer to open n connections to the lumberjack
+// server at address, like PoolDial.
+func PoolDialWith(
+	dial func(network, address string) (net.Conn, error),
+	address string,
+	n int,
+	opts ...Option,
+) (*MultiClient, error) {
+	if n <= 0 {
+		return nil, errors.New("pool size must be positive")
+	}
+
+	addresses := make([]string, n)
+	for i := range addresses {
+		addresses[i] = address
+	}
+	return MultiDialWith(dial, addresses, LeastPending, opts...)
+}
+
+// Close closes the connections to all hosts. Returns the first error
+// encountered.
+func (c *MultiClient) Close() error {
+	var err error
+	for _, h := range c.hosts {
+		h.sendMu.Lock()
+		if h.cl != nil {
+			if closeErr := h.cl.Close(); err == nil {
+				err = closeErr
+			}
+			h.cl = nil
+		}
+		h.sendMu.Unlock()
+	}
+	return err
+}
+
+// Send publishes a new batch of events by JSON-encoding given batch to one of
+// the healthy hosts. Send blocks until the complete batch has been ACKed. If
+// publishing fails due to network errors, the events not yet ACKed are
+// published to the next host. Returns the number of events ACKed and
+// ErrNoHostAvailable or the last error encountered if no host was able to
+// ACK the batch.
+func (c *MultiClient) Send(data []interface{}) (int, error) {
+	var tried []*host
+	var lastErr error
+	acked, sent := 0, false
+	for {
+		h := c.pick(tried)
+		if h == nil {
+			if lastErr == nil {
+				lastErr = ErrNoHostAvailable
+			}
+			return acked, lastErr
+		}
+		if sent && c.observer != nil {
+			c.observer.Retransmitted(len(data) - acked)
+		}
+		tried = append(tried, h)
+
+		n, connected, err := c.send(h, data[acked:])
+		acked += n
+		sent = sent || connected
+		if err == nil {
+			return acked, nil
+		}
+		if !isNetError(err) {
+			return acked, err
+		}
+		lastErr = err
+	}
+}
+
+// SendJSON publishes a new batch of JSON encoded events, like Send. Events are
+// sent as is without being encoded.
+func (c *MultiClient) SendJSON(data [][]byte) (int, error) {
+	return c.Send(rawEvents(data))
+}
+
+// send publishes data to h. connected reports whether the host has been
+// connected, such that data might have been sent.
+func (c *MultiClient) send(h *host, data []interface{}) (n int, connected bool, err error) {
+	defer atomic.AddInt32(&h.pending, -1)
+
+	h.sendMu.Lock()
+	defer h.sendMu.Unlock()
+
+	if h.cl != nil && h.cl.cl.recycleDue() {
+		// re-establish the connection as configured via RecycleAfter, such
+		// that connections get rebalanced behind load balancers
+		_ = h.cl.Close() // ignore error
+		h.cl = nil
+	}
+	if h.cl == nil {
+		// probe failed host
+		if err := c.connect(h); err != nil {
+			c.failed(h)
+			return 0, false, err
+		}
+	}
+
+	n, err = h.cl.Send(data)
+	if err != nil && isNetError(err) {
+		_ = h.cl.Close() // ignore error
+		h.cl = nil
+		c.failed(h)
+		return n, true, err
+	}
+
+	c.recovered(h)
+	return n, true, err
+}
+
+// connect dials the host. Must be called with h.sendMu held or before the
+// client is shared.
+func (c *MultiClient) connect(h *host) error {
+	cl, err := SyncDialWith(c.dial, h.address, c.opts...)
+	if err != nil {
+		return err
+	}
+	cl.cl.dial = nil // failover instead of reconnecting to the same host
+	h.cl = cl
+	return nil
+}
+
+// pick selects the next host not in tried as configured by the strategy and
+// increments its pending counter. Returns nil if no host is available.
+func (c *MultiClient) pick(tried []*host) *host {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var selected *host
+	var selectedIdx int
+	for i := range c.hosts {
+		idx := (c.next + i) % len(c.hosts)
+		h := c.hosts[idx]
+		if containsHost(tried, h) || now.Before(h.retryAt) {
+			continue
+		}
+
+		if selected == nil || atomic.LoadInt32(&h.pending) < atomic.LoadInt32(&selected.pending) {
+			selected, selectedIdx = h, idx
+		}
+		if c.strategy == RoundRobin {
+			break
+		}
+	}
+	if selected == nil {
+		return nil
+	}
+
+	c.next = (selectedIdx + 1) % len(c.hosts)
+	atomic.AddInt32(&selected.pending, 1)
+	return selected
+}
+
+// failed marks h as failed, such that it is probed again after the backoff.
+func (c *MultiClient) failed(h *host) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.retryAt = time.Now().Add(c.backoff.wait(h.failures))
+	h.failures++
+}
+
+// recovered marks h as healthy.
+func (c *MultiClient) recovered(h *host) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.failures = 0
+	h.retryAt = time.Time{}
+}
+
+func containsHost(hosts []*host, h *host) bool {
+	for _, other := range hosts {
+		if other == h {
+			return true
+		}
+	}
+	return false
+}
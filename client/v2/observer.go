@@ -0,0 +1,140 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Observer is notified about the activity of clients, e.g. for exposing
+// client metrics. Observers shared by multiple clients must be safe for
+// concurrent use. Methods must not block.
+type Observer interface {
+	// Connected is called for every connection attempt, err being nil if
+	// the connection has been established.
+	Connected(address string, err error)
+
+	// BatchSent is called for every window written to the connection, bytes
+	// being the number of bytes written after compression.
+	BatchSent(events, bytes int)
+
+	// BatchACKed is called once a window has been ACKed, latency being the
+	// time from sending the window until the ACK has been received.
+	BatchACKed(events int, latency time.Duration)
+
+	// Retransmitted is called if events not ACKed are re-sent after
+	// reconnecting or failing over to another host.
+	Retransmitted(events int)
+}
+
+// Observe client option registering an observer notified about the activity
+// of the client.
+func Observe(o Observer) Option {
+	return func(opt *options) error {
+		opt.observer = o
+		return nil
+	}
+}
+
+// Stats provides a snapshot of client metrics collected by Counters.
+type Stats struct {
+	ConnectAttempts uint64 `json:"connect_attempts"`
+	ConnectFailures uint64 `json:"connect_failures"`
+	BatchesSent     uint64 `json:"batches_sent"`
+	EventsSent      uint64 `json:"events_sent"`
+	BytesSent       uint64 `json:"bytes_sent"`
+	BatchesACKed    uint64 `json:"batches_acked"`
+	Retransmits     uint64 `json:"retransmits"` // events re-sent
+
+	// ACKLatency is the total ACK latency of all batches ACKed. Divide by
+	// BatchesACKed for the average latency.
+	ACKLatency time.Duration `json:"ack_latency"`
+}
+
+// Counters is an Observer collecting client metrics. Counters can be shared
+// by multiple clients.
+type Counters struct {
+	connectAttempts uint64
+	connectFailures uint64
+	batchesSent     uint64
+	eventsSent      uint64
+	bytesSent       uint64
+	batchesACKed    uint64
+	retransmits     uint64
+	ackLatency      uint64 // in ns
+}
+
+var _ Observer = (*Counters)(nil)
+
+// Connected counts a connection attempt.
+func (c *Counters) Connected(_ string, err error) {
+	atomic.AddUint64(&c.connectAttempts, 1)
+	if err != nil {
+		atomic.AddUint64(&c.connectFailures, 1)
+	}
+}
+
+// BatchSent counts a window written to the connection.
+func (c *Counters) BatchSent(events, bytes int) {
+	atomic.AddUint64(&c.batchesSent, 1)
+	atomic.AddUint64(&c.eventsSent, uint64(events))
+	atomic.AddUint64(&c.bytesSent, uint64(bytes))
+}
+
+// BatchACKed records the ACK latency of a window.
+func (c *Counters) BatchACKed(_ int, latency time.Duration) {
+	atomic.AddUint64(&c.batchesACKed, 1)
+	atomic.AddUint64(&c.ackLatency, uint64(latency))
+}
+
+// Retransmitted counts events re-sent.
+func (c *Counters) Retransmitted(events int) {
+	atomic.AddUint64(&c.retransmits, uint64(events))
+}
+
+// Stats returns a snapshot of the metrics collected.
+func (c *Counters) Stats() Stats {
+	return Stats{
+		ConnectAttempts: atomic.LoadUint64(&c.connectAttempts),
+		ConnectFailures: atomic.LoadUint64(&c.connectFailures),
+		BatchesSent:     atomic.LoadUint64(&c.batchesSent),
+		EventsSent:      atomic.LoadUint64(&c.eventsSent),
+		BytesSent:       atomic.LoadUint64(&c.bytesSent),
+		BatchesACKed:    atomic.LoadUint64(&c.batchesACKed),
+		Retransmits:     atomic.LoadUint64(&c.retransmits),
+		ACKLatency:      time.Duration(atomic.LoadUint64(&c.ackLatency)),
+	}
+}
+
+// observeDial wraps dial, notifying the observer about connection attempts.
+func (o *options) observeDial(
+	dial func(network, address string) (net.Conn, error),
+) func(network, address string) (net.Conn, error) {
+	observer := o.observer
+	if observer == nil {
+		return dial
+	}
+
+	return func(network, address string) (net.Conn, error) {
+		c, err := dial(network, address)
+		observer.Connected(address, err)
+		return c, err
+	}
+}
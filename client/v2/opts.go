@@ -18,9 +18,18 @@
 package v2
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
 	"time"
+
+	"github.com/scippio/go-lumber/codec"
+	protocol "github.com/scippio/go-lumber/protocol/v2"
 )
 
 // Option type to be passed to New/Dial functions.
@@ -30,12 +39,51 @@ type options struct {
 	timeout     time.Duration
 	encoder     jsonEncoder
 	compressLvl int
+	codec       string
+	codecLvl    int
+	negotiate   bool
+	eventCodec  string
+	protobuf    func(interface{}) ([]byte, error)
+	reconnect   *Backoff
+	onProgress  func(acked, count int)
+	tls         *tls.Config
+	pins        [][]byte
+	verify      func(tls.ConnectionState) error
+	proxy       *url.URL
+	resolver    *resolver
+	batchTO     time.Duration
+	maxWindow   int
+	observer    Observer
+	slowStart   int
+
+	recycleAge     time.Duration
+	recycleBatches int
+
+	dialContext func(ctx context.Context, network, address string) (net.Conn, error)
+	network     string
+}
+
+// Backoff configures the reconnect attempts of a client. The wait time
+// before reconnecting starts at Init and doubles per failed attempt, up to
+// Max. Jitter (0 to 1) is the fraction of the wait time being randomized, such
+// that multiple clients do not reconnect at the same time.
+type Backoff struct {
+	Init   time.Duration
+	Max    time.Duration
+	Jitter float64
+
+	// MaxRetries limits the reconnect attempts per batch. 0 retries
+	// indefinitely.
+	MaxRetries int
 }
 
 type jsonEncoder func(interface{}) ([]byte, error)
 
 // JSONEncoder client option configuring the encoder used to convert events
-// to json. The default is `json.Marshal`.
+// to json, e.g. easyjson or go-json. The default is `json.Marshal`. Events of
+// type json.RawMessage, e.g. as delivered by servers configured with
+// RawEvents, are pre-rendered and sent as is in JSON data frames without
+// calling the encoder. See also SendJSON.
 func JSONEncoder(encoder func(interface{}) ([]byte, error)) Option {
 	return func(opt *options) error {
 		opt.encoder = encoder
@@ -54,21 +102,251 @@ func Timeout(to time.Duration) Option {
 	}
 }
 
-// CompressionLevel client option setting the gzip compression level (0 to 9).
+// Network client option setting the network to connect to the lumberjack
+// server with, one of "tcp" (default), "tcp4", "tcp6" or "unix". For "unix",
+// the address passed to the Dial functions is the path of the unix domain
+// socket. Proxies and DNS resolution are not supported for unix domain
+// sockets.
+func Network(network string) Option {
+	return func(opt *options) error {
+		switch network {
+		case "tcp", "tcp4", "tcp6", "unix":
+		default:
+			return fmt.Errorf("unsupported network %q", network)
+		}
+		opt.network = network
+		return nil
+	}
+}
+
+// CompressionLevel client option setting the zlib compression level (1 to 9,
+// or -1 for zlib's default level). Level 0, the default, disables zlib
+// compression, sending plain JSON data frames.
 func CompressionLevel(l int) Option {
 	return func(opt *options) error {
-		if !(0 <= l && l <= 9) {
-			return errors.New("compression level must be within 0 and 9")
+		if !(-1 <= l && l <= 9) {
+			return errors.New("compression level must be within -1 and 9")
 		}
 		opt.compressLvl = l
 		return nil
 	}
 }
 
+// NoCompression client option disabling compression entirely, including
+// codecs configured via Zstd or Codec. Events are sent in plain data frames,
+// saving CPU on senders connected via fast networks.
+func NoCompression() Option {
+	return func(opt *options) error {
+		opt.compressLvl = 0
+		opt.codec, opt.codecLvl = "", 0
+		return nil
+	}
+}
+
+// Zstd client option negotiating zstd compression with the server using the
+// given zstd compression level (1 to 22). If the server does not accept zstd,
+// zlib compression as configured by CompressionLevel is used. 0 disables zstd.
+// Servers not supporting the hello frame close the connection.
+func Zstd(l int) Option {
+	return func(opt *options) error {
+		if !(0 <= l && l <= 22) {
+			return errors.New("zstd compression level must be within 0 and 22")
+		}
+		if l == 0 {
+			opt.codec, opt.codecLvl = "", 0
+			return nil
+		}
+		opt.codec, opt.codecLvl = protocol.CodecZstd, l
+		return nil
+	}
+}
+
+// Codec client option negotiating compression using the named codec and
+// codec specific compression level with the server. The codec must be
+// registered with the codec package. If the server does not accept the codec,
+// zlib compression as configured by CompressionLevel is used. Servers not
+// supporting the hello frame close the connection.
+func Codec(name string, level int) Option {
+	return func(opt *options) error {
+		if _, ok := codec.ByName(name); !ok {
+			return fmt.Errorf("unknown codec: %v", name)
+		}
+		opt.codec, opt.codecLvl = name, level
+		return nil
+	}
+}
+
+// Negotiate client option sending the hello frame on connect, negotiating
+// protocol capabilities with the server even if no codec is configured. The
+// negotiated capabilities are available via Client.Capabilities. Servers not
+// supporting the hello frame close the connection.
+func Negotiate(b bool) Option {
+	return func(opt *options) error {
+		opt.negotiate = b
+		return nil
+	}
+}
+
+// EventCodec client option negotiating the named event codec, e.g. CBOR or
+// MessagePack, with the server. Events are encoded with the event codec
+// instead of the JSON encoder if accepted by the server, and sent as JSON
+// otherwise. The event codec must be registered with the codec package.
+// Servers not supporting the hello frame close the connection.
+func EventCodec(name string) Option {
+	return func(opt *options) error {
+		if _, ok := codec.EventByName(name); !ok {
+			return fmt.Errorf("unknown event codec: %v", name)
+		}
+		opt.eventCodec = name
+		return nil
+	}
+}
+
+// Protobuf client option negotiating the protobuf extension with the server.
+// Events are encoded using encode, e.g. by calling proto.Marshal on the
+// event, and sent in protobuf data frames if the extension is accepted by the
+// server. Otherwise events are sent as configured by EventCodec or
+// JSONEncoder. Servers not supporting the hello frame close the connection.
+func Protobuf(encode func(event interface{}) ([]byte, error)) Option {
+	return func(opt *options) error {
+		opt.protobuf = encode
+		return nil
+	}
+}
+
+// Reconnect client option enabling automatic reconnects configured by b. If
+// sending a batch fails due to network errors, the client re-dials the
+// lumberjack server, waiting as configured by b, and re-sends the events not
+// yet ACKed. If the server did partially ACK the batch before the connection
+// failed, only the events following the last ACKed event are re-sent.
+// Reconnects are only supported by clients created via Dial or DialWith.
+func Reconnect(b Backoff) Option {
+	return func(opt *options) error {
+		if b.Init <= 0 || b.Max < b.Init {
+			return errors.New("backoff durations must be positive and Max must not be less than Init")
+		}
+		if !(0 <= b.Jitter && b.Jitter <= 1) {
+			return errors.New("backoff jitter must be within 0 and 1")
+		}
+		if b.MaxRetries < 0 {
+			return errors.New("max retries must not be negative")
+		}
+		opt.reconnect = &b
+		return nil
+	}
+}
+
+// DialContext client option replacing the dialer used by Dial, SyncDial,
+// AsyncDial, MultiDial and PoolDial for establishing connections, e.g. a
+// customized net.Dialer's DialContext method or a function returning
+// in-memory pipes for testing. The context passed to dial is cancelled after
+// the timeout configured via Timeout. Proxies, DNS resolution and TLS
+// configured via options are applied on top of dial.
+func DialContext(dial func(ctx context.Context, network, address string) (net.Conn, error)) Option {
+	return func(opt *options) error {
+		opt.dialContext = dial
+		return nil
+	}
+}
+
+// dialer returns the dial function used by Dial, defaulting to net.Dialer.
+func (o *options) dialer() func(network, address string) (net.Conn, error) {
+	if o.dialContext == nil {
+		dialer := net.Dialer{Timeout: o.timeout}
+		return dialer.Dial
+	}
+
+	dial, timeout := o.dialContext, o.timeout
+	return func(network, address string) (net.Conn, error) {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// RecycleAfter client option closing and re-establishing the connection
+// once it is older than age or batches batches have been ACKed on it, such
+// that long-lived connections get rebalanced across servers behind a load
+// balancer. Connections are only recycled by SyncClient and MultiClient in
+// between batches. A value of 0 disables the respective limit. Recycling is
+// not supported by clients created via NewWithConn.
+func RecycleAfter(age time.Duration, batches int) Option {
+	return func(opt *options) error {
+		if age < 0 || batches < 0 {
+			return errors.New("recycle limits must not be negative")
+		}
+		opt.recycleAge, opt.recycleBatches = age, batches
+		return nil
+	}
+}
+
+// BatchTimeout client option limiting the time for sending a batch and
+// waiting for its ACK by SyncClient, in addition to the read/write timeout
+// configured via Timeout. If the batch has not been ACKed in time, the
+// connection is recycled and ErrBatchTimeout is returned, unless reconnects
+// are enabled via the Reconnect option, in which case the events not yet
+// ACKed are re-sent after reconnecting. The default 0 disables the timeout.
+func BatchTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("batch timeout must not be negative")
+		}
+		opt.batchTO = to
+		return nil
+	}
+}
+
+// MaxWindowSize client option limiting the number of events sent per window.
+// Batches passed to Send exceeding the limit are split into multiple
+// windows, Send reporting success only once all windows have been ACKed.
+// The default 0 does not limit the window size.
+func MaxWindowSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max window size must not be negative")
+		}
+		opt.maxWindow = n
+		return nil
+	}
+}
+
+// SlowStart client option starting with windows of initial events after
+// connecting or reconnecting. The window size doubles whenever a full window
+// has been ACKed, up to MaxWindowSize, and halves whenever a window has not
+// been ACKed in time. Batches passed to Send exceeding the current window
+// size are sent in multiple windows. This avoids overwhelming servers
+// recovering from an outage. The default of 0 disables slow start.
+func SlowStart(initial int) Option {
+	return func(opt *options) error {
+		if initial < 0 || initial > math.MaxInt32 {
+			return errors.New("initial window size must be within 0 and 2^31-1")
+		}
+		opt.slowStart = initial
+		return nil
+	}
+}
+
+// OnProgress client option registering a callback reporting the progress of
+// batches waiting for ACK. The callback is called for every ACK frame received,
+// including the keepalive ACKs sent by the server while the batch is being
+// processed, with the number of events ACKed so far and the batch size.
+// Every ACK received resets the read timeout. The callback must not block.
+func OnProgress(f func(acked, count int)) Option {
+	return func(opt *options) error {
+		opt.onProgress = f
+		return nil
+	}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
 		encoder: json.Marshal,
 		timeout: 30 * time.Second,
+		network: "tcp",
 	}
 
 	for _, opt := range opts {
@@ -0,0 +1,152 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// resolver resolves host names, caching the addresses for ttl. Consecutive
+// lookups rotate the returned addresses, spreading connections across all
+// addresses of a host.
+type resolver struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+	next    int
+}
+
+// ResolveDNS client option resolving the server host name on every connect,
+// including reconnects, caching the resolved addresses for ttl. Connections
+// are spread across all A and AAAA records of the host, trying the next
+// address if connecting fails. If connecting to all addresses fails, the
+// cached addresses are discarded, such that DNS based failover applies to
+// the next connection attempt.
+//
+// Clients and pools created with the same option share the cache. If a proxy
+// is configured, the proxy host name is resolved.
+func ResolveDNS(ttl time.Duration) Option {
+	r := &resolver{ttl: ttl, lookup: net.DefaultResolver.LookupHost}
+	return func(opt *options) error {
+		if ttl < 0 {
+			return errors.New("DNS TTL must not be negative")
+		}
+		opt.resolver = r
+		return nil
+	}
+}
+
+// resolveDial wraps dial, connecting to the resolved addresses of the host
+// in turn if ResolveDNS is configured.
+func (o *options) resolveDial(
+	dial func(network, address string) (net.Conn, error),
+) func(network, address string) (net.Conn, error) {
+	r := o.resolver
+	if r == nil {
+		return dial
+	}
+
+	timeout := o.timeout
+	return func(network, address string) (net.Conn, error) {
+		if network == "unix" {
+			return dial(network, address)
+		}
+
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dial(network, address)
+		}
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		addrs, err := r.resolve(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			var c net.Conn
+			if c, err = dial(network, net.JoinHostPort(addr, port)); err == nil {
+				return c, nil
+			}
+		}
+		r.forget(host)
+		return nil, err
+	}
+}
+
+// resolve returns the addresses of host, rotated by one per call.
+func (r *resolver) resolve(ctx context.Context, host string) ([]string, error) {
+	r.mu.Lock()
+	e := r.entries[host]
+	if e == nil || !time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		addrs, err := r.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		r.mu.Lock()
+		if r.entries == nil {
+			r.entries = map[string]*dnsEntry{}
+		}
+		next := 0
+		if e != nil {
+			next = e.next
+		}
+		e = &dnsEntry{addrs: addrs, expires: time.Now().Add(r.ttl), next: next}
+		r.entries[host] = e
+	}
+	defer r.mu.Unlock()
+
+	n := len(e.addrs)
+	start := e.next % n
+	e.next++
+
+	rotated := make([]string, 0, n)
+	rotated = append(rotated, e.addrs[start:]...)
+	return append(rotated, e.addrs[:start]...), nil
+}
+
+// forget discards the cached addresses of host.
+func (r *resolver) forget(host string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, host)
+}
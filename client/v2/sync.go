@@ -17,7 +17,14 @@
 
 package v2
 
-import "net"
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+	protocol "github.com/scippio/go-lumber/protocol/v2"
+)
 
 // SyncClient synchronously publishes events to lumberjack endpoint waiting for
 // ACK before allowing another send request. The client is not thread-safe.
@@ -70,14 +77,126 @@ func (c *SyncClient) Close() error {
 	return c.cl.Close()
 }
 
+// Capabilities returns the capabilities advertised by the server in response
+// to the hello frame. Returns nil if capabilities have not been negotiated.
+func (c *SyncClient) Capabilities() *protocol.Hello {
+	return c.cl.Capabilities()
+}
+
 // Send publishes a new batch of events by JSON-encoding given batch.
 // Send blocks until the complete batch has been ACKed by lumberjack server or
-// some error happened.
+// some error happened. If reconnects are enabled via the Reconnect option,
+// events not ACKed are re-sent after reconnecting on network errors. Batches
+// exceeding MaxWindowSize or the SlowStart window are sent in multiple
+// windows. The connection is re-established in between windows as configured
+// via RecycleAfter.
 func (c *SyncClient) Send(data []interface{}) (int, error) {
+	acked := 0
+	for window, rest := c.cl.nextWindow(data); len(window) > 0; window, rest = c.cl.nextWindow(rest) {
+		n, err := c.sendWindow(window)
+		acked += n
+		if err != nil {
+			return acked, err
+		}
+	}
+	return acked, nil
+}
+
+func (c *SyncClient) sendWindow(data []interface{}) (int, error) {
+	acked := 0
+	for attempt := 0; ; attempt++ {
+		seq, err := 0, c.recycle()
+		if err == nil {
+			seq, err = c.send(data[acked:])
+		}
+		acked += seq
+		if err == nil {
+			return acked, nil
+		}
+		if !c.cl.canReconnect(attempt, err) {
+			if errors.Is(err, ErrBatchTimeout) && c.cl.dial != nil {
+				// recycle connection, such that late ACKs of the timed out
+				// batch are not mistaken for ACKs of the next batch
+				_ = c.cl.reconnect() // errors are reported by the next Send
+			}
+			return acked, err
+		}
+
+		c.cl.backoff(attempt)
+		for err = c.cl.reconnect(); err != nil; err = c.cl.reconnect() {
+			attempt++
+			if !c.cl.canReconnect(attempt, err) {
+				return acked, err
+			}
+			c.cl.backoff(attempt)
+		}
+		if o := c.cl.opts.observer; o != nil {
+			o.Retransmitted(len(data) - acked)
+		}
+	}
+}
+
+// recycle re-establishes the connection if it has expired.
+func (c *SyncClient) recycle() error {
+	if !c.cl.expired() {
+		return nil
+	}
+	return c.cl.reconnect()
+}
+
+func (c *SyncClient) send(data []interface{}) (int, error) {
+	if to := c.cl.opts.batchTO; to > 0 {
+		c.cl.batchDeadline = time.Now().Add(to)
+		defer func() { c.cl.batchDeadline = time.Time{} }()
+	}
+
+	seq, err := c.sendAndAwait(data)
+	if err != nil && errors.Is(err, lj.ErrTimeout) &&
+		!c.cl.batchDeadline.IsZero() && !time.Now().Before(c.cl.batchDeadline) {
+		err = ErrBatchTimeout
+	}
+	return seq, err
+}
+
+func (c *SyncClient) sendAndAwait(data []interface{}) (int, error) {
+	start := time.Now()
 	if err := c.cl.Send(data); err != nil {
 		return 0, err
 	}
 
 	seq, err := c.cl.AwaitACK(uint32(len(data)))
+	if err != nil {
+		c.cl.windowFailed(err)
+		return int(seq), err
+	}
+
+	c.cl.batches++
+	c.cl.windowACKed(len(data))
+	if o := c.cl.opts.observer; o != nil && len(data) > 0 {
+		o.BatchACKed(len(data), time.Since(start))
+	}
+	return int(seq), nil
+}
+
+// SendJSON publishes a new batch of JSON encoded events, like Send. Events are
+// sent as is without being encoded.
+func (c *SyncClient) SendJSON(data [][]byte) (int, error) {
+	return c.Send(rawEvents(data))
+}
+
+// SendCompressed forwards a batch of count events encoded in compressed
+// frames, e.g. as retained by a server on lj.Batch.Compressed.
+// SendCompressed blocks until the complete batch has been ACKed by lumberjack
+// server or some error happened.
+func (c *SyncClient) SendCompressed(count int, frames []lj.CompressedFrame) (int, error) {
+	start := time.Now()
+	if err := c.cl.SendCompressed(count, frames); err != nil {
+		return 0, err
+	}
+
+	seq, err := c.cl.AwaitACK(uint32(count))
+	if o := c.cl.opts.observer; o != nil && err == nil && count > 0 {
+		o.BatchACKed(count, time.Since(start))
+	}
 	return int(seq), err
 }
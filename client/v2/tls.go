@@ -0,0 +1,240 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/internal/tlsutil"
+)
+
+// ErrPinMismatch is returned if no certificate presented by the server
+// matches the fingerprints configured via PinSHA256.
+var ErrPinMismatch = errors.New("server certificate does not match pinned fingerprints")
+
+// filePools maps configurations created by TLSFromFiles to their CA
+// reloaders. The configurations skip the standard chain verification, such
+// that tlsConfig installs the current CA pool per connection for the verified
+// chains to be available to pins and VerifyServer.
+var filePools sync.Map // *tls.Config -> *tlsutil.Reloader
+
+// TLS client option enabling TLS using config. If config.ServerName is empty,
+// the host name of the dialed address is used.
+func TLS(config *tls.Config) Option {
+	return func(opt *options) error {
+		opt.tls = config
+		return nil
+	}
+}
+
+// TLSFromFiles creates a TLS configuration for mutual TLS, loading the client
+// certificate and key from certFile and keyFile. If caFile is not empty, the
+// server certificate is verified against the CAs in caFile instead of the
+// system CAs. certFile and keyFile are optional.
+//
+// The files are checked for changes periodically and reloaded, such that
+// certificates can be rotated without restarting the client. New
+// certificates apply to new connections only. Use the configuration with the
+// TLS option. The configuration must not be cloned before passing it to TLS,
+// for the verified chain to be available to PinSHA256 and VerifyServer.
+func TLSFromFiles(certFile, keyFile, caFile string) (*tls.Config, error) {
+	r, err := tlsutil.NewReloader(certFile, keyFile, caFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return r.Certificate(), nil
+		}
+	}
+	if caFile != "" {
+		// RootCAs can not be updated per handshake, verify the chain against
+		// the current CA pool instead
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyChain(state, r.CertPool())
+		}
+		filePools.Store(config, r)
+	}
+	return config, nil
+}
+
+// PinSHA256 client option pinning the server certificate. Fingerprints are
+// hex encoded SHA-256 hashes (colons are ignored) of either a DER encoded
+// certificate or the public key (SubjectPublicKeyInfo) of a certificate in the
+// verified chain. If the chain is not verified, fingerprints must match the
+// server's leaf certificate. The connection is rejected if no certificate
+// matches any fingerprint.
+//
+// PinSHA256 enables TLS. If no CAs are configured via TLS (RootCAs), the
+// certificate chain is not verified against the system CAs, such that
+// servers using self-signed certificates can be connected to safely without
+// a PKI.
+func PinSHA256(fingerprints ...string) Option {
+	return func(opt *options) error {
+		for _, fp := range fingerprints {
+			pin, err := hex.DecodeString(strings.ReplaceAll(fp, ":", ""))
+			if err != nil || len(pin) != sha256.Size {
+				return fmt.Errorf("invalid SHA-256 fingerprint: %v", fp)
+			}
+			opt.pins = append(opt.pins, pin)
+		}
+		return nil
+	}
+}
+
+// VerifyServer client option registering a custom verification callback
+// called during the TLS handshake, after the certificate chain has been
+// verified and pins have been checked. The handshake fails if f returns an
+// error. To replace the certificate chain verification, set
+// InsecureSkipVerify in the config given to TLS. VerifyServer enables TLS.
+func VerifyServer(f func(tls.ConnectionState) error) Option {
+	return func(opt *options) error {
+		opt.verify = f
+		return nil
+	}
+}
+
+// tlsConfig returns the TLS configuration for connecting to address. Returns
+// nil if TLS is not enabled.
+func (o *options) tlsConfig(address string) *tls.Config {
+	if o.tls == nil && o.pins == nil && o.verify == nil {
+		return nil
+	}
+
+	var config *tls.Config
+	if o.tls != nil {
+		config = o.tls.Clone()
+		if r, ok := filePools.Load(o.tls); ok {
+			config.RootCAs = r.(*tlsutil.Reloader).CertPool()
+			config.InsecureSkipVerify = false
+		}
+	} else {
+		config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+
+	pins, verify := o.pins, o.verify
+	if pins != nil && config.RootCAs == nil {
+		config.InsecureSkipVerify = true
+	}
+	next := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if pins != nil && !matchPins(state, pins) {
+			return ErrPinMismatch
+		}
+		if next != nil {
+			if err := next(state); err != nil {
+				return err
+			}
+		}
+		if verify != nil {
+			return verify(state)
+		}
+		return nil
+	}
+	return config
+}
+
+// tlsDial wraps dial, establishing TLS connections using o if TLS is enabled.
+func (o *options) tlsDial(
+	dial func(network, address string) (net.Conn, error),
+) func(network, address string) (net.Conn, error) {
+	if o.tls == nil && o.pins == nil && o.verify == nil {
+		return dial
+	}
+
+	timeout := o.timeout
+	return func(network, address string) (net.Conn, error) {
+		c, err := dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		tc := tls.Client(c, o.tlsConfig(address))
+		if timeout > 0 {
+			_ = tc.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := tc.Handshake(); err != nil {
+			_ = c.Close() // ignore error
+			return nil, err
+		}
+		_ = tc.SetDeadline(time.Time{})
+		return tc, nil
+	}
+}
+
+func verifyChain(state tls.ConnectionState, roots *x509.CertPool) error {
+	certs := state.PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       state.ServerName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// matchPins reports whether a pin matches a certificate of the verified
+// chains. If the chain has not been verified, only the leaf certificate is
+// matched, as the server can present arbitrary certificates in addition to the
+// leaf, whose key alone the handshake proves possession of.
+func matchPins(state tls.ConnectionState, pins [][]byte) bool {
+	var certs []*x509.Certificate
+	if len(state.VerifiedChains) > 0 {
+		for _, chain := range state.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	} else if len(state.PeerCertificates) > 0 {
+		certs = state.PeerCertificates[:1]
+	}
+
+	for _, cert := range certs {
+		certSum := sha256.Sum256(cert.Raw)
+		keySum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, certSum[:]) || bytes.Equal(pin, keySum[:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -36,6 +36,7 @@ import (
 
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/server"
+	"github.com/scippio/go-lumber/server/admin"
 )
 
 type rateLimiter struct {
@@ -50,6 +51,7 @@ func main() {
 	limit := flag.Int("rate", 0, "max batch ack rate")
 	detailed := flag.Bool("d", false, "detailed: print log message per event")
 	logging := flag.Bool("l", false, "disable logging")
+	adminAddr := flag.String("admin", "", "[host]:port to serve admin HTTP endpoint on")
 	flag.Parse()
 
 	s, err := server.NewServer(server.V1(*v1), server.V2(*v2), server.Logging(!*logging))
@@ -78,6 +80,13 @@ func main() {
 
 	log.Println("tcp server up")
 
+	if *adminAddr != "" {
+		if _, err := admin.ListenAndServe(*adminAddr, s); err != nil {
+			log.Fatal(err)
+		}
+		log.Println("admin server up")
+	}
+
 	var rl *rateLimiter
 	if *limit > 0 {
 		rl = newRateLimiter(*limit, (*limit)*2, time.Second)
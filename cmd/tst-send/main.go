@@ -37,7 +37,7 @@ import (
 
 func main() {
 	connect := flag.String("c", "localhost:5044", "Remote address")
-	compress := flag.Int("compress", 3, "Compression level (0-9)")
+	compress := flag.Int("compress", 3, "Compression level (-1 to 9, 0 disables compression)")
 	timeout := flag.Duration("timeout", 30*time.Second, "Connection timeouts")
 	batchSize := flag.Int64("batch", 2048, "Batch size")
 	pipelined := flag.Int("pipeline", 0, "enabled pipeline mode with number of batches kept in pipeline")
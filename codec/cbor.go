@@ -0,0 +1,412 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+)
+
+// CBOR (RFC 8949) major types.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+
+	cborIndefinite = 31
+	cborBreak      = 0xff
+)
+
+var errInvalidCBOR = errors.New("invalid cbor event")
+
+// marshalCBOR encodes v as CBOR. Types other than the types produced by
+// decoding JSON are encoded via their JSON representation.
+func marshalCBOR(v interface{}) ([]byte, error) {
+	return appendCBOR(nil, v)
+}
+
+func appendCBOR(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xf6), nil
+	case bool:
+		if v {
+			return append(buf, 0xf5), nil
+		}
+		return append(buf, 0xf4), nil
+	case int:
+		return appendCBORInt(buf, int64(v)), nil
+	case int8:
+		return appendCBORInt(buf, int64(v)), nil
+	case int16:
+		return appendCBORInt(buf, int64(v)), nil
+	case int32:
+		return appendCBORInt(buf, int64(v)), nil
+	case int64:
+		return appendCBORInt(buf, v), nil
+	case uint:
+		return appendCBORHead(buf, cborUint, uint64(v)), nil
+	case uint8:
+		return appendCBORHead(buf, cborUint, uint64(v)), nil
+	case uint16:
+		return appendCBORHead(buf, cborUint, uint64(v)), nil
+	case uint32:
+		return appendCBORHead(buf, cborUint, uint64(v)), nil
+	case uint64:
+		return appendCBORHead(buf, cborUint, v), nil
+	case float32:
+		buf = append(buf, cborSimple<<5|26)
+		return appendUint32(buf, math.Float32bits(v)), nil
+	case float64:
+		buf = append(buf, cborSimple<<5|27)
+		return appendUint64(buf, math.Float64bits(v)), nil
+	case json.Number:
+		n, err := numberValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendCBOR(buf, n)
+	case string:
+		buf = appendCBORHead(buf, cborText, uint64(len(v)))
+		return append(buf, v...), nil
+	case []byte:
+		buf = appendCBORHead(buf, cborBytes, uint64(len(v)))
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = appendCBORHead(buf, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			var err error
+			if buf, err = appendCBOR(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []string:
+		buf = appendCBORHead(buf, cborArray, uint64(len(v)))
+		for _, elem := range v {
+			buf = appendCBORHead(buf, cborText, uint64(len(elem)))
+			buf = append(buf, elem...)
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = appendCBORHead(buf, cborMap, uint64(len(v)))
+		for k, elem := range v {
+			buf = appendCBORHead(buf, cborText, uint64(len(k)))
+			buf = append(buf, k...)
+			var err error
+			if buf, err = appendCBOR(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]string:
+		buf = appendCBORHead(buf, cborMap, uint64(len(v)))
+		for k, elem := range v {
+			buf = appendCBORHead(buf, cborText, uint64(len(k)))
+			buf = append(buf, k...)
+			buf = appendCBORHead(buf, cborText, uint64(len(elem)))
+			buf = append(buf, elem...)
+		}
+		return buf, nil
+	default:
+		generic, err := toGeneric(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendCBOR(buf, generic)
+	}
+}
+
+func appendCBORInt(buf []byte, v int64) []byte {
+	if v < 0 {
+		return appendCBORHead(buf, cborNegInt, uint64(-1-v))
+	}
+	return appendCBORHead(buf, cborUint, uint64(v))
+}
+
+func appendCBORHead(buf []byte, major byte, n uint64) []byte {
+	major <<= 5
+	switch {
+	case n < 24:
+		return append(buf, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return appendUint32(append(buf, major|26), uint32(n))
+	default:
+		return appendUint64(append(buf, major|27), n)
+	}
+}
+
+// unmarshalCBOR decodes a CBOR encoded event. Integers are decoded as int64,
+// or uint64 if exceeding the int64 range, byte strings as []byte, and maps as
+// map[string]interface{}. Tags are ignored.
+func unmarshalCBOR(data []byte, v interface{}) error {
+	d := cborDecoder{data: data}
+	decoded, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return errInvalidCBOR
+	}
+	return assignDecoded(decoded, v)
+}
+
+type cborDecoder struct {
+	data []byte
+	off  int
+}
+
+func (d *cborDecoder) value(depth int) (interface{}, error) {
+	if depth > maxEventDepth {
+		return nil, errInvalidCBOR
+	}
+
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return nil, errInvalidCBOR
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		b, err := d.str(major, info, n)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(b), nil
+		}
+		return b, nil
+	case cborArray:
+		if info == cborIndefinite {
+			arr := []interface{}{}
+			for {
+				brk, err := d.atBreak()
+				if err != nil {
+					return nil, err
+				}
+				if brk {
+					break
+				}
+				elem, err := d.value(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				arr = append(arr, elem)
+			}
+			return arr, nil
+		}
+		if n > uint64(len(d.data)-d.off) {
+			return nil, errInvalidCBOR
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = d.value(depth + 1); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	case cborMap:
+		if info != cborIndefinite && n > uint64(len(d.data)-d.off)/2 {
+			return nil, errInvalidCBOR
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); info == cborIndefinite || i < n; i++ {
+			if info == cborIndefinite {
+				brk, err := d.atBreak()
+				if err != nil {
+					return nil, err
+				}
+				if brk {
+					break
+				}
+			}
+			k, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			elem, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[mapKey(k)] = elem
+		}
+		return m, nil
+	case cborTag:
+		return d.value(depth + 1)
+	default:
+		return d.simple(info, n)
+	}
+}
+
+// head reads the initial byte and argument of the next data item.
+func (d *cborDecoder) head() (major, info byte, n uint64, err error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, errInvalidCBOR
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info = b>>5, b&0x1f
+
+	var size int
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	case info == cborIndefinite && major >= cborBytes && major <= cborMap:
+		return major, info, 0, nil
+	case info == cborIndefinite && major == cborSimple:
+		return 0, 0, 0, errInvalidCBOR // unexpected break
+	default:
+		return 0, 0, 0, errInvalidCBOR
+	}
+
+	if len(d.data)-d.off < size {
+		return 0, 0, 0, errInvalidCBOR
+	}
+	for _, b := range d.data[d.off : d.off+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.off += size
+	return major, info, n, nil
+}
+
+// str reads the content of a byte or text string. Indefinite length strings
+// are concatenated from their chunks.
+func (d *cborDecoder) str(major, info byte, n uint64) ([]byte, error) {
+	if info != cborIndefinite {
+		if n > uint64(len(d.data)-d.off) {
+			return nil, errInvalidCBOR
+		}
+		b := append([]byte(nil), d.data[d.off:d.off+int(n)]...)
+		d.off += int(n)
+		return b, nil
+	}
+
+	b := []byte{}
+	for {
+		brk, err := d.atBreak()
+		if err != nil {
+			return nil, err
+		}
+		if brk {
+			return b, nil
+		}
+		chunkMajor, chunkInfo, chunkN, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkInfo == cborIndefinite {
+			return nil, errInvalidCBOR
+		}
+		chunk, err := d.str(chunkMajor, chunkInfo, chunkN)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+func (d *cborDecoder) simple(info byte, n uint64) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 25:
+		return float64(halfToFloat32(uint16(n))), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	default:
+		return nil, errInvalidCBOR
+	}
+}
+
+// atBreak consumes the break code ending an indefinite length item.
+func (d *cborDecoder) atBreak() (bool, error) {
+	if d.off >= len(d.data) {
+		return false, errInvalidCBOR
+	}
+	if d.data[d.off] == cborBreak {
+		d.off++
+		return true, nil
+	}
+	return false, nil
+}
+
+// halfToFloat32 converts an IEEE 754 half precision float.
+func halfToFloat32(h uint16) float32 {
+	sign := uint32(h>>15) << 31
+	exp := uint32(h>>10) & 0x1f
+	frac := uint32(h) & 0x3ff
+
+	switch exp {
+	case 0:
+		f := float32(frac) / (1 << 24) // subnormal
+		if sign != 0 {
+			f = -f
+		}
+		return f
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | frac<<13)
+	default:
+		return math.Float32frombits(sign | (exp+112)<<23 | frac<<13)
+	}
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v>>8), byte(v))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v>>32)), uint32(v))
+}
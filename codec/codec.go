@@ -0,0 +1,197 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package codec provides the registry of compression codecs available for
+// compressed frames of the lumberjack v2 protocol, and the registry of event
+// codecs available for encoded data frames.
+//
+// zlib and zstd are registered by default. Applications can register
+// additional codecs, e.g. lz4 or snappy, on startup:
+//
+//	func init() {
+//		codec.MustRegister(codec.Codec{
+//			Name: "lz4",
+//			Code: 'L',
+//			NewReader: func(r io.Reader) (io.ReadCloser, error) {
+//				return io.NopCloser(lz4.NewReader(r)), nil
+//			},
+//			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+//				return lz4.NewWriter(w), nil
+//			},
+//		})
+//	}
+//
+// Codecs other than zlib must be enabled in the server and are negotiated per
+// connection via the hello frame.
+//
+// Event codecs encode events in formats other than JSON. CBOR and MessagePack
+// are registered by default. Event codecs must be enabled in the server and
+// are negotiated per connection via the hello frame as well.
+package codec
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zlib"
+	"github.com/klauspost/compress/zstd"
+
+	protocol "github.com/scippio/go-lumber/protocol/v2"
+)
+
+// Decompressor creates a reader decompressing the frame payload read from r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// Compressor creates a writer compressing the frame payload into w. level is
+// the codec specific compression level.
+type Compressor func(w io.Writer, level int) (io.WriteCloser, error)
+
+// Codec describes a compression codec.
+type Codec struct {
+	// Name identifies the codec in the hello frame.
+	Name string
+
+	// Code is the frame type of frames compressed with the codec.
+	Code byte
+
+	NewReader Decompressor
+	NewWriter Compressor
+}
+
+// ErrInvalidCodec indicates a codec not being registered due to missing
+// fields or a name or frame type already being in use.
+var ErrInvalidCodec = errors.New("invalid codec")
+
+// maxZstdWindow limits the memory required for decoding zstd frames.
+const maxZstdWindow = 8 << 20
+
+var (
+	mu      sync.RWMutex
+	byCode  = map[byte]Codec{}
+	byName  = map[string]Codec{}
+	usedBy  = map[byte]string{} // frame types reserved by the protocol
+	builtin = []Codec{
+		{
+			Name:      protocol.CodecZlib,
+			Code:      protocol.CodeCompressed,
+			NewReader: newZlibReader,
+			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+				return zlib.NewWriterLevel(w, level)
+			},
+		},
+		{
+			Name: protocol.CodecZstd,
+			Code: protocol.CodeZstdCompressed,
+			NewReader: func(r io.Reader) (io.ReadCloser, error) {
+				d, err := zstd.NewReader(r,
+					zstd.WithDecoderConcurrency(1),
+					zstd.WithDecoderLowmem(true),
+					zstd.WithDecoderMaxWindow(maxZstdWindow))
+				if err != nil {
+					return nil, err
+				}
+				return d.IOReadCloser(), nil
+			},
+			NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) {
+				return zstd.NewWriter(w,
+					zstd.WithEncoderConcurrency(1),
+					zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			},
+		},
+	}
+)
+
+func init() {
+	for _, code := range []byte{
+		protocol.CodeVersion,
+		protocol.CodeWindowSize,
+		protocol.CodeDataFrame,
+		protocol.CodeJSONDataFrame,
+		protocol.CodeEncodedDataFrame,
+		protocol.CodeProtobufDataFrame,
+		protocol.CodeACK,
+		protocol.CodeHello,
+	} {
+		usedBy[code] = "protocol"
+	}
+	for _, c := range builtin {
+		MustRegister(c)
+	}
+}
+
+// Register adds c to the registry. Register fails if the name or frame type
+// is already in use.
+func Register(c Codec) error {
+	if c.Name == "" || c.NewReader == nil || c.NewWriter == nil {
+		return fmt.Errorf("%w: name, reader and writer required", ErrInvalidCodec)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if other, exists := usedBy[c.Code]; exists {
+		return fmt.Errorf("%w: frame type %q already used by %v", ErrInvalidCodec, c.Code, other)
+	}
+	if _, exists := byName[c.Name]; exists {
+		return fmt.Errorf("%w: codec %v already registered", ErrInvalidCodec, c.Name)
+	}
+
+	usedBy[c.Code] = c.Name
+	byCode[c.Code] = c
+	byName[c.Name] = c
+	return nil
+}
+
+// MustRegister adds c to the registry. MustRegister panics if c can not be
+// registered.
+func MustRegister(c Codec) {
+	if err := Register(c); err != nil {
+		panic(err)
+	}
+}
+
+// ByCode returns the codec for the given frame type.
+func ByCode(code byte) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := byCode[code]
+	return c, ok
+}
+
+// ByName returns the codec registered with the given name.
+func ByName(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := byName[name]
+	return c, ok
+}
+
+// Names returns the names of all registered codecs in sorted order.
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
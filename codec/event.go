@@ -0,0 +1,157 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	protocol "github.com/scippio/go-lumber/protocol/v2"
+)
+
+// EventCodec describes an encoding of events carried by encoded data frames.
+type EventCodec struct {
+	// Name identifies the event codec in the hello frame.
+	Name string
+
+	// Marshal encodes an event.
+	Marshal func(v interface{}) ([]byte, error)
+
+	// Unmarshal decodes an event into the value pointed to by v.
+	Unmarshal func(data []byte, v interface{}) error
+}
+
+// maxEventDepth limits the nesting of arrays and maps in decoded events.
+const maxEventDepth = 1000
+
+var (
+	eventsByName = map[string]EventCodec{}
+	builtinEvent = []EventCodec{
+		{Name: protocol.EventCodecCBOR, Marshal: marshalCBOR, Unmarshal: unmarshalCBOR},
+		{Name: protocol.EventCodecMsgpack, Marshal: marshalMsgpack, Unmarshal: unmarshalMsgpack},
+	}
+)
+
+func init() {
+	for _, c := range builtinEvent {
+		MustRegisterEvent(c)
+	}
+}
+
+// RegisterEvent adds the event codec c to the registry. RegisterEvent fails if
+// the name is already in use.
+func RegisterEvent(c EventCodec) error {
+	if c.Name == "" || c.Marshal == nil || c.Unmarshal == nil {
+		return fmt.Errorf("%w: name, marshal and unmarshal required", ErrInvalidCodec)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, exists := eventsByName[c.Name]; exists {
+		return fmt.Errorf("%w: event codec %v already registered", ErrInvalidCodec, c.Name)
+	}
+	eventsByName[c.Name] = c
+	return nil
+}
+
+// MustRegisterEvent adds the event codec c to the registry. MustRegisterEvent
+// panics if c can not be registered.
+func MustRegisterEvent(c EventCodec) {
+	if err := RegisterEvent(c); err != nil {
+		panic(err)
+	}
+}
+
+// EventByName returns the event codec registered with the given name.
+func EventByName(name string) (EventCodec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := eventsByName[name]
+	return c, ok
+}
+
+// EventNames returns the names of all registered event codecs in sorted
+// order.
+func EventNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, 0, len(eventsByName))
+	for name := range eventsByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// toGeneric converts v into the values produced by decoding JSON, for
+// encoding types without native support by the event codecs. Numbers are
+// returned as json.Number.
+func toGeneric(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var out interface{}
+	err = dec.Decode(&out)
+	return out, err
+}
+
+// assignDecoded stores the decoded value in the value pointed to by v. Values
+// other than *interface{} are filled in via their JSON representation.
+func assignDecoded(decoded, v interface{}) error {
+	if p, ok := v.(*interface{}); ok {
+		*p = decoded
+		return nil
+	}
+
+	b, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// numberValue converts n into an int64, uint64 or float64.
+func numberValue(n json.Number) (interface{}, error) {
+	if i, err := n.Int64(); err == nil {
+		return i, nil
+	}
+	if !strings.ContainsAny(n.String(), ".eE-") {
+		if u, err := strconv.ParseUint(n.String(), 10, 64); err == nil {
+			return u, nil
+		}
+	}
+	return n.Float64()
+}
+
+// mapKey converts keys of decoded maps into strings.
+func mapKey(k interface{}) string {
+	if s, ok := k.(string); ok {
+		return s
+	}
+	return fmt.Sprint(k)
+}
@@ -0,0 +1,402 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package codec
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"time"
+)
+
+var errInvalidMsgpack = errors.New("invalid msgpack event")
+
+// msgpackTimestamp is the extension type of timestamps.
+const msgpackTimestamp = -1
+
+// marshalMsgpack encodes v as MessagePack. Types other than the types produced
+// by decoding JSON are encoded via their JSON representation.
+func marshalMsgpack(v interface{}) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+func appendMsgpack(buf []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, 0xc0), nil
+	case bool:
+		if v {
+			return append(buf, 0xc3), nil
+		}
+		return append(buf, 0xc2), nil
+	case int:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int8:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int16:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int32:
+		return appendMsgpackInt(buf, int64(v)), nil
+	case int64:
+		return appendMsgpackInt(buf, v), nil
+	case uint:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint8:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint16:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint32:
+		return appendMsgpackUint(buf, uint64(v)), nil
+	case uint64:
+		return appendMsgpackUint(buf, v), nil
+	case float32:
+		return appendUint32(append(buf, 0xca), math.Float32bits(v)), nil
+	case float64:
+		return appendUint64(append(buf, 0xcb), math.Float64bits(v)), nil
+	case json.Number:
+		n, err := numberValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpack(buf, n)
+	case string:
+		return appendMsgpackString(buf, v), nil
+	case []byte:
+		buf = appendMsgpackHead(buf, len(v), 0, 0xc4, 0xc5, 0xc6)
+		return append(buf, v...), nil
+	case []interface{}:
+		buf = appendMsgpackHead(buf, len(v), 0x90, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			var err error
+			if buf, err = appendMsgpack(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case []string:
+		buf = appendMsgpackHead(buf, len(v), 0x90, 0, 0xdc, 0xdd)
+		for _, elem := range v {
+			buf = appendMsgpackString(buf, elem)
+		}
+		return buf, nil
+	case map[string]interface{}:
+		buf = appendMsgpackHead(buf, len(v), 0x80, 0, 0xde, 0xdf)
+		for k, elem := range v {
+			buf = appendMsgpackString(buf, k)
+			var err error
+			if buf, err = appendMsgpack(buf, elem); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case map[string]string:
+		buf = appendMsgpackHead(buf, len(v), 0x80, 0, 0xde, 0xdf)
+		for k, elem := range v {
+			buf = appendMsgpackString(buf, k)
+			buf = appendMsgpackString(buf, elem)
+		}
+		return buf, nil
+	default:
+		generic, err := toGeneric(v)
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpack(buf, generic)
+	}
+}
+
+func appendMsgpackInt(buf []byte, v int64) []byte {
+	switch {
+	case v >= 0:
+		return appendMsgpackUint(buf, uint64(v))
+	case v >= -32:
+		return append(buf, byte(v)) // negative fixint
+	case v >= math.MinInt8:
+		return append(buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		return appendUint16(append(buf, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		return appendUint32(append(buf, 0xd2), uint32(v))
+	default:
+		return appendUint64(append(buf, 0xd3), uint64(v))
+	}
+}
+
+func appendMsgpackUint(buf []byte, v uint64) []byte {
+	switch {
+	case v <= 0x7f:
+		return append(buf, byte(v)) // positive fixint
+	case v <= math.MaxUint8:
+		return append(buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		return appendUint16(append(buf, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		return appendUint32(append(buf, 0xce), uint32(v))
+	default:
+		return appendUint64(append(buf, 0xcf), v)
+	}
+}
+
+func appendMsgpackString(buf []byte, s string) []byte {
+	buf = appendMsgpackHead(buf, len(s), 0xa0, 0xd9, 0xda, 0xdb)
+	return append(buf, s...)
+}
+
+// appendMsgpackHead appends the type and length of a string, binary, array or
+// map. fix is the code of the fix sized type, 0 if not available. len8 is the
+// code of the type with 8 bit length, 0 if not available.
+func appendMsgpackHead(buf []byte, n int, fix, len8, len16, len32 byte) []byte {
+	maxFix := 15
+	if fix == 0xa0 {
+		maxFix = 31 // fixstr
+	}
+
+	switch {
+	case fix != 0 && n <= maxFix:
+		return append(buf, fix|byte(n))
+	case len8 != 0 && n <= math.MaxUint8:
+		return append(buf, len8, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint16(append(buf, len16), uint16(n))
+	default:
+		return appendUint32(append(buf, len32), uint32(n))
+	}
+}
+
+// unmarshalMsgpack decodes a MessagePack encoded event. Integers are decoded
+// as int64, or uint64 if exceeding the int64 range, binary values as []byte,
+// timestamps as time.Time and maps as map[string]interface{}. Other extension
+// types are rejected.
+func unmarshalMsgpack(data []byte, v interface{}) error {
+	d := msgpackDecoder{data: data}
+	decoded, err := d.value(0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(d.data) {
+		return errInvalidMsgpack
+	}
+	return assignDecoded(decoded, v)
+}
+
+type msgpackDecoder struct {
+	data []byte
+	off  int
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxEventDepth {
+		return nil, errInvalidMsgpack
+	}
+
+	code, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code >= 0xa0 && code <= 0xbf:
+		return d.str(int(code & 0x1f))
+	case code >= 0x90 && code <= 0x9f:
+		return d.array(int(code&0x0f), depth)
+	case code >= 0x80 && code <= 0x8f:
+		return d.mapping(int(code&0x0f), depth)
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil // sign extend
+	case 0xca:
+		n, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.bytes(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapping(int(n), depth)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (code - 0xd4))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(n))
+	default:
+		return nil, errInvalidMsgpack
+	}
+}
+
+func (d *msgpackDecoder) byte() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, errInvalidMsgpack
+	}
+	b := d.data[d.off]
+	d.off++
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of size bytes.
+func (d *msgpackDecoder) uint(size int) (uint64, error) {
+	if len(d.data)-d.off < size {
+		return 0, errInvalidMsgpack
+	}
+	var n uint64
+	for _, b := range d.data[d.off : d.off+size] {
+		n = n<<8 | uint64(b)
+	}
+	d.off += size
+	return n, nil
+}
+
+func (d *msgpackDecoder) bytes(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return nil, errInvalidMsgpack
+	}
+	b := append([]byte(nil), d.data[d.off:d.off+n]...)
+	d.off += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) str(n int) (interface{}, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return nil, errInvalidMsgpack
+	}
+	s := string(d.data[d.off : d.off+n])
+	d.off += n
+	return s, nil
+}
+
+func (d *msgpackDecoder) array(n, depth int) (interface{}, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return nil, errInvalidMsgpack
+	}
+	arr := make([]interface{}, n)
+	for i := range arr {
+		var err error
+		if arr[i], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return arr, nil
+}
+
+func (d *msgpackDecoder) mapping(n, depth int) (interface{}, error) {
+	if n < 0 || n > (len(d.data)-d.off)/2 {
+		return nil, errInvalidMsgpack
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		elem, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[mapKey(k)] = elem
+	}
+	return m, nil
+}
+
+// ext reads an extension value of n bytes. Only timestamps are supported.
+func (d *msgpackDecoder) ext(n int) (interface{}, error) {
+	typ, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	if int8(typ) != msgpackTimestamp {
+		return nil, errInvalidMsgpack
+	}
+
+	switch len(data) {
+	case 4:
+		sec := uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+		return time.Unix(int64(sec), 0).UTC(), nil
+	case 8:
+		var v uint64
+		for _, b := range data {
+			v = v<<8 | uint64(b)
+		}
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)).UTC(), nil
+	case 12:
+		var nsec uint32
+		var sec uint64
+		for _, b := range data[:4] {
+			nsec = nsec<<8 | uint32(b)
+		}
+		for _, b := range data[4:] {
+			sec = sec<<8 | uint64(b)
+		}
+		return time.Unix(int64(sec), int64(nsec)).UTC(), nil
+	default:
+		return nil, errInvalidMsgpack
+	}
+}
@@ -0,0 +1,62 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package codec
+
+import (
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+// zlibReaders pools zlib readers across frames. Readers are reset for each
+// frame, reusing the decompressor state.
+var zlibReaders sync.Pool
+
+// pooledReader returns the wrapped reader to its pool once closed.
+type pooledReader struct {
+	io.ReadCloser
+	pool *sync.Pool
+}
+
+func newZlibReader(r io.Reader) (io.ReadCloser, error) {
+	z, ok := zlibReaders.Get().(io.ReadCloser)
+	if !ok {
+		var err error
+		if z, err = zlib.NewReader(r); err != nil {
+			return nil, err
+		}
+	} else if err := z.(zlib.Resetter).Reset(r, nil); err != nil {
+		zlibReaders.Put(z)
+		return nil, err
+	}
+	return &pooledReader{ReadCloser: z, pool: &zlibReaders}, nil
+}
+
+// Close closes the wrapped reader and returns it to the pool. The reader must
+// not be used after Close.
+func (r *pooledReader) Close() error {
+	if r.ReadCloser == nil {
+		return nil
+	}
+
+	err := r.ReadCloser.Close()
+	r.pool.Put(r.ReadCloser)
+	r.ReadCloser = nil
+	return err
+}
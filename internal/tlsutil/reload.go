@@ -0,0 +1,154 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package tlsutil provides TLS helpers shared by client and server
+// implementations.
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/log"
+)
+
+// DefaultReloadInterval is the default interval files are checked for
+// changes by the Reloader.
+const DefaultReloadInterval = 10 * time.Second
+
+// Reloader loads a certificate and an optional CA bundle from files. Files are
+// checked for changes at most once per interval, when the certificate or CA
+// pool are accessed. If reloading fails, the previously loaded certificate
+// and CA pool are kept.
+type Reloader struct {
+	certFile, keyFile, caFile string
+	interval                  time.Duration
+
+	mu       sync.Mutex
+	checked  time.Time
+	modTimes [3]time.Time
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+}
+
+// ErrNoCertificates indicates the CA file not containing any PEM encoded
+// certificates.
+var ErrNoCertificates = errors.New("no certificates found in CA file")
+
+// NewReloader creates a new Reloader and loads the files initially. The CA
+// file is optional and can be empty. Files are checked for changes every
+// interval, or DefaultReloadInterval if interval is 0.
+func NewReloader(certFile, keyFile, caFile string, interval time.Duration) (*Reloader, error) {
+	if interval <= 0 {
+		interval = DefaultReloadInterval
+	}
+
+	r := &Reloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		interval: interval,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Certificate returns the current certificate. Nil if no certificate file has
+// been configured.
+func (r *Reloader) Certificate() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloadIfDue()
+	return r.cert
+}
+
+// CertPool returns the current CA pool. Nil if no CA file has been
+// configured.
+func (r *Reloader) CertPool() *x509.CertPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reloadIfDue()
+	return r.pool
+}
+
+func (r *Reloader) reloadIfDue() {
+	now := time.Now()
+	if now.Sub(r.checked) < r.interval {
+		return
+	}
+	r.checked = now
+
+	modTimes := r.readModTimes()
+	if modTimes == r.modTimes {
+		return
+	}
+
+	if err := r.load(); err != nil {
+		log.Errorf("Failed to reload TLS certificates, keep using previous certificates: %v", err)
+		return
+	}
+	log.Infof("Reloaded TLS certificates")
+}
+
+func (r *Reloader) load() error {
+	modTimes := r.readModTimes()
+
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return err
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return ErrNoCertificates
+		}
+	}
+
+	r.cert, r.pool = cert, pool
+	r.modTimes = modTimes
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *Reloader) readModTimes() [3]time.Time {
+	var times [3]time.Time
+	for i, file := range []string{r.certFile, r.keyFile, r.caFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			times[i] = info.ModTime()
+		}
+	}
+	return times
+}
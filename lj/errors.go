@@ -0,0 +1,138 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Error kinds classifying the errors returned by lumberjack clients and
+// servers. Use errors.Is to check the kind of an error.
+var (
+	// ErrProtocol indicates the peer violating the lumberjack protocol.
+	ErrProtocol = errors.New("lumberjack protocol error")
+
+	// ErrFrameTooLarge indicates a frame or batch exceeding a size limit.
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// ErrTimeout indicates an operation not completing in time.
+	ErrTimeout = errors.New("timeout")
+
+	// ErrAuth indicates a client failing authentication or authorization.
+	ErrAuth = errors.New("not authorized")
+
+	// ErrClosed indicates an operation failing due to the connection or
+	// server being closed.
+	ErrClosed = errors.New("closed")
+
+	// ErrDecode indicates an event failing to decode.
+	ErrDecode = errors.New("failed to decode event")
+)
+
+// Error is an error of one of the error kinds. errors.Is reports an Error to
+// match its kind and the wrapped error.
+type Error struct {
+	Kind error  // ErrProtocol, ErrFrameTooLarge, ErrTimeout, ErrAuth, ErrClosed or ErrDecode
+	Msg  string // Optional description replacing the kind in the error message.
+	Err  error  // Optional underlying error.
+}
+
+// NewError creates an error of the given kind.
+func NewError(kind error, msg string) *Error {
+	return &Error{Kind: kind, Msg: msg}
+}
+
+// WrapError wraps err into an error of the given kind. err is returned as is
+// if it is nil or of the given kind already.
+func WrapError(kind error, err error) error {
+	if err == nil || errors.Is(err, kind) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// WrapNetError classifies errors returned by network connections. Timeouts
+// are wrapped as ErrTimeout, errors due to the connection being closed are
+// wrapped as ErrClosed. Other errors are returned as is.
+func WrapNetError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return WrapError(ErrTimeout, err)
+	case errors.Is(err, net.ErrClosed):
+		return WrapError(ErrClosed, err)
+	default:
+		return err
+	}
+}
+
+func (e *Error) Error() string {
+	msg := e.Msg
+	if msg == "" {
+		msg = e.Kind.Error()
+	}
+	if e.Err != nil {
+		return msg + ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is returns true if target is the kind of e.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// ProtocolError describes a protocol violation of a peer. errors.Is reports a
+// ProtocolError to match ErrProtocol.
+type ProtocolError struct {
+	Msg        string // Description of the violation.
+	RemoteAddr string // Address of the peer.
+
+	// Offset is the number of bytes read from the connection before the
+	// offending frame. If Compressed is set, Offset is the offset of the
+	// compressed frame the offending frame has been read from.
+	Offset     int64
+	Compressed bool
+
+	Frame  byte   // Frame type of the offending frame. 0 if unknown.
+	Header []byte // Header bytes of the offending frame.
+}
+
+func (e *ProtocolError) Error() string {
+	where := "offset"
+	if e.Compressed {
+		where = "compressed frame at offset"
+	}
+	details := fmt.Sprintf("%v %v, frame %q, header % x", where, e.Offset, e.Frame, e.Header)
+	if e.RemoteAddr != "" {
+		details = "remote " + e.RemoteAddr + ", " + details
+	}
+	return fmt.Sprintf("%v: %v (%v)", ErrProtocol, e.Msg, details)
+}
+
+// Is returns true if target is ErrProtocol.
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
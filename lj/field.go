@@ -0,0 +1,66 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package lj
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Field returns the value of the field at path in event. Nested fields are
+// separated by dots, e.g. "log.level", unless the event has a field named path.
+// Returns false if event is not a map or lacks the field.
+func Field(event interface{}, path string) (interface{}, bool) {
+	switch e := event.(type) {
+	case map[string]interface{}:
+		if v, ok := e[path]; ok {
+			return v, true
+		}
+		if i := strings.IndexByte(path, '.'); i >= 0 {
+			if v, ok := e[path[:i]]; ok {
+				return Field(v, path[i+1:])
+			}
+		}
+	case map[string]string:
+		v, ok := e[path]
+		return v, ok
+	}
+	return nil, false
+}
+
+// MatchFields returns a predicate matching events with all fields set to the
+// given values. Fields are looked up using Field. Values not being strings are
+// formatted using fmt.Sprint before being compared.
+func MatchFields(fields map[string]string) func(event interface{}) bool {
+	return func(event interface{}) bool {
+		for path, want := range fields {
+			v, ok := Field(event, path)
+			if !ok {
+				return false
+			}
+			s, isString := v.(string)
+			if !isString {
+				s = fmt.Sprint(v)
+			}
+			if s != want {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -19,17 +19,139 @@
 package lj
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrBatchCanceled is returned by AwaitContext if the batch has been canceled
+// via Cancel.
+var ErrBatchCanceled = NewError(ErrClosed, "batch canceled")
+
 // Batch is an ACK-able batch of events that has been received by lumberjack
 // server implementations. Batches must be ACKed for the server
 // implementations returning an ACK to its clients.
 type Batch struct {
+	acked      uint64 // number of events ACKed via ACKUpTo, updated atomically
+	retained   int64  // number of Done calls pending, updated atomically
+	canceled   uint32 // set atomically by Cancel
+	completed  uint32 // set atomically by ACK
 	ack        chan struct{}
+	progress   chan struct{}
+	cancel     chan struct{}
+	parent     *Batch       // batch split into this batch, nil if not split off
+	offset     int          // index of the first event in the parent batch
+	mu         sync.Mutex   // protects done and doneUpTo
+	done       []bool       // events ACKed via ACKEvent or split off batches, allocated on first use
+	doneUpTo   int          // number of leading events in done
+	metaMu     sync.RWMutex // protects meta
+	meta       map[string]interface{}
+	release    func()               // returns pooled memory, nil if not pooled
+	released   uint32               // set atomically by Release
 	TLS        *tls.ConnectionState // TLS connection metadata. Nil for non-TLS connections.
 	RemoteAddr string               // Source address of the connection.
-	Events     []interface{}
+	ConnID     uint64               // ID of the connection the batch was received on. 0 if unknown.
+	Identity   *Identity            // Verified TLS client identity. Nil if no client certificate has been verified.
+	Version    int                  // Lumberjack protocol version the batch has been received with. 0 if unknown.
+	LastSeq    uint32               // Sequence number of the last event in the batch. 0 if unknown.
+	ReceivedAt time.Time            // Time the batch has been fully read from the connection. Zero if unknown.
+	ReadStart  time.Time            // Time reading the batch from the connection has started. Zero if unknown.
+
+	// Capabilities negotiated by the client at connection start. Nil if the
+	// client did not negotiate capabilities.
+	Capabilities *Capabilities
+
+	// Compressed holds the compressed frames of the batch as received from the
+	// client, such that relays can forward the batch without re-encoding. Nil
+	// unless the server is configured to retain compressed frames and all
+	// events have been received in compressed frames.
+	Compressed []CompressedFrame
+
+	// Sizes collected while reading the batch, e.g. for size based quotas.
+	WireBytes         int64 // Bytes read from the connection, including frame headers. 0 if unknown.
+	UncompressedBytes int64 // Size of the event frames once decompressed. 0 if unknown.
+	EventSizes        []int // Payload size of each event in bytes. Nil if unknown.
+
+	Events []interface{}
+}
+
+// Identity describes the identity of a TLS client as presented by its
+// verified client certificate.
+type Identity struct {
+	CommonName         string
+	Organization       []string
+	OrganizationalUnit []string
+	DNSNames           []string
+	EmailAddresses     []string
+	IPAddresses        []net.IP
+	URIs               []string
+
+	// Fingerprint is the hex encoded SHA-256 digest of the DER encoded
+	// certificate.
+	Fingerprint string
+}
+
+// Capabilities describes the protocol capabilities negotiated for a
+// connection.
+type Capabilities struct {
+	// Codecs lists the compression codecs the client may use.
+	Codecs []string
+
+	// MaxBatchSize is the maximum number of events per batch agreed on by
+	// client and server. 0 if unlimited.
+	MaxBatchSize int
+
+	// Keepalive is the interval the server sends keepalive ACKs in. 0 if
+	// keepalive is disabled.
+	Keepalive time.Duration
+
+	// ClientKeepalive is the maximum keepalive interval tolerated by the
+	// client. 0 if not advertised.
+	ClientKeepalive time.Duration
+
+	// EventCodec is the event codec used by the client to encode events.
+	// Empty if events are JSON encoded.
+	EventCodec string
+
+	// Extensions lists the protocol extensions accepted for the connection,
+	// e.g. "protobuf".
+	Extensions []string
+}
+
+// CompressedFrame is a compressed frame as received from the client.
+type CompressedFrame struct {
+	Type    byte   // Frame type, e.g. 'C' for zlib compressed frames.
+	Payload []byte // Compressed payload.
+}
+
+// InvalidEvent is delivered in place of an event that could not be decoded,
+// if the server is configured to continue on decode errors, or in place of an
+// event failing validation, if the server is configured to dead-letter invalid
+// events.
+type InvalidEvent struct {
+	Raw   []byte      // Undecoded event as received from the client. Nil if the event failed validation.
+	Event interface{} // Decoded event failing validation. Nil if the event could not be decoded.
+	Err   error       // Error returned by the decoder or validator.
+}
+
+// EventFactory creates the values events are decoded into, such that events
+// are decoded directly into application types. NewEvent must return a pointer,
+// e.g. new(MyEvent). The value returned is stored in Batch.Events.
+type EventFactory interface {
+	NewEvent() interface{}
+}
+
+// EventFactoryFunc adapts a function to the EventFactory interface.
+type EventFactoryFunc func() interface{}
+
+// NewEvent calls f().
+func (f EventFactoryFunc) NewEvent() interface{} {
+	return f()
 }
 
 // NewBatch creates a new ACK-able batch.
@@ -44,18 +166,332 @@ func NewBatch(events []interface{}) *Batch {
 func NewBatchWithSourceMetadata(events []interface{}, remoteAddr string, tlsState *tls.ConnectionState) *Batch {
 	return &Batch{
 		ack:        make(chan struct{}),
+		progress:   make(chan struct{}, 1),
+		cancel:     make(chan struct{}),
 		TLS:        tlsState,
 		RemoteAddr: remoteAddr,
+		Identity:   IdentityFromTLS(tlsState),
 		Events:     events,
 	}
 }
 
-// ACK acknowledges a batch initiating propagation of ACK to clients.
+// IdentityFromTLS extracts the client identity from the leaf certificate of
+// the first verified certificate chain. Returns nil if tlsState is nil or no
+// client certificate has been verified.
+func IdentityFromTLS(tlsState *tls.ConnectionState) *Identity {
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 || len(tlsState.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	cert := tlsState.VerifiedChains[0][0]
+	fingerprint := sha256.Sum256(cert.Raw)
+	id := &Identity{
+		CommonName:         cert.Subject.CommonName,
+		Organization:       cert.Subject.Organization,
+		OrganizationalUnit: cert.Subject.OrganizationalUnit,
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		IPAddresses:        cert.IPAddresses,
+		Fingerprint:        hex.EncodeToString(fingerprint[:]),
+	}
+	for _, uri := range cert.URIs {
+		id.URIs = append(id.URIs, uri.String())
+	}
+	return id
+}
+
+// ACK acknowledges a batch initiating propagation of ACK to clients. Calls
+// after the first call are ignored.
 func (b *Batch) ACK() {
+	if !atomic.CompareAndSwapUint32(&b.completed, 0, 1) {
+		return
+	}
 	close(b.ack)
+	if b.parent != nil {
+		b.parent.ackRange(b.offset, b.offset+len(b.Events))
+	}
+}
+
+// ACKUpTo acknowledges the first n events of the batch, reporting progress to
+// clients while the remaining events are still being processed. Keepalives
+// sent to clients carry the number of ACKed events as well. Calls not
+// increasing the number of ACKed events are ignored. ACKUpTo with n >=
+// len(Events) is equivalent to ACK.
+func (b *Batch) ACKUpTo(n int) {
+	if n >= len(b.Events) {
+		b.ACK()
+		return
+	}
+
+	for {
+		old := atomic.LoadUint64(&b.acked)
+		if n <= int(old) {
+			return
+		}
+		if atomic.CompareAndSwapUint64(&b.acked, old, uint64(n)) {
+			break
+		}
+	}
+	if b.parent != nil {
+		b.parent.ackRange(b.offset, b.offset+n)
+	}
+
+	select {
+	case b.progress <- struct{}{}:
+	default: // progress notification already pending
+	}
+}
+
+// ACKEvent acknowledges the event at index i of Events, for consumers
+// processing events independently of each other. Once all events preceding an
+// event have been acknowledged as well, progress is reported to clients via
+// ACKUpTo. The batch is ACKed when all events have been acknowledged. Repeated
+// calls for the same event and indexes out of range are ignored. ACKEvent must
+// not be mixed with ACK for the same batch.
+func (b *Batch) ACKEvent(i int) {
+	if i < 0 || i >= len(b.Events) {
+		return
+	}
+	b.ackRange(i, i+1)
+}
+
+// ackRange marks the events lo to hi as acknowledged, ACKing the leading
+// events acknowledged so far.
+func (b *Batch) ackRange(lo, hi int) {
+	b.mu.Lock()
+	if b.done == nil {
+		b.done = make([]bool, len(b.Events))
+	}
+	for i := lo; i < hi; i++ {
+		b.done[i] = true
+	}
+
+	n := b.doneUpTo
+	if acked := b.ACKed(); acked > n {
+		n = acked
+	}
+	for n < len(b.done) && b.done[n] {
+		n++
+	}
+	if n > b.doneUpTo {
+		b.doneUpTo = n
+		b.ACKUpTo(n)
+	}
+	b.mu.Unlock()
+}
+
+// Split splits the batch into batches of the given sizes, e.g. for sharding a
+// large batch across workers. Events left over form an additional last batch.
+// Split off batches share the events and source metadata of the batch.
+// Acknowledging events of split off batches acknowledges the corresponding
+// events of the batch, such that the batch is ACKed once all split off
+// batches have been ACKed. Split returns nil for batches without events.
+func (b *Batch) Split(sizes ...int) []*Batch {
+	if len(b.Events) == 0 {
+		return nil
+	}
+
+	var batches []*Batch
+	offset := 0
+	for i := 0; offset < len(b.Events); i++ {
+		end := len(b.Events)
+		if i < len(sizes) {
+			if sizes[i] <= 0 {
+				continue
+			}
+			if offset+sizes[i] < end {
+				end = offset + sizes[i]
+			}
+		}
+
+		child := NewBatchWithSourceMetadata(b.Events[offset:end:end], b.RemoteAddr, b.TLS)
+		child.parent, child.offset = b, offset
+		child.ConnID = b.ConnID
+		child.Identity = b.Identity
+		child.Version = b.Version
+		child.ReceivedAt = b.ReceivedAt
+		child.Capabilities = b.Capabilities
+		if len(b.EventSizes) == len(b.Events) {
+			child.EventSizes = b.EventSizes[offset:end:end]
+		}
+		batches = append(batches, child)
+		offset = end
+	}
+	return batches
+}
+
+// Len returns the number of events in the batch.
+func (b *Batch) Len() int {
+	return len(b.Events)
+}
+
+// PayloadBytes returns the total size of the event payloads in bytes, once
+// decompressed. 0 if unknown.
+func (b *Batch) PayloadBytes() int64 {
+	if len(b.EventSizes) == 0 {
+		return 0
+	}
+
+	var n int64
+	for _, sz := range b.EventSizes {
+		n += int64(sz)
+	}
+	return n
+}
+
+// DecodeDuration returns the time it took to read and decode the batch after
+// the first frame of the batch had been received. 0 if unknown.
+func (b *Batch) DecodeDuration() time.Duration {
+	if b.ReadStart.IsZero() || b.ReceivedAt.IsZero() {
+		return 0
+	}
+	return b.ReceivedAt.Sub(b.ReadStart)
+}
+
+// QueueTime returns the time passed since the batch has been read from the
+// connection, e.g. the time the batch has been waiting in the receive channel
+// if called on receipt. 0 if unknown.
+func (b *Batch) QueueTime() time.Duration {
+	if b.ReceivedAt.IsZero() {
+		return 0
+	}
+	return time.Since(b.ReceivedAt)
+}
+
+// SetMeta attaches the metadata value to the batch under key, replacing any
+// value set before. Metadata is not sent to clients, but lets middleware and
+// consumers attach e.g. routing decisions, tenant or trace IDs while the batch
+// is being processed. Setting a nil value removes key. SetMeta is safe for
+// concurrent use.
+func (b *Batch) SetMeta(key string, value interface{}) {
+	b.metaMu.Lock()
+	defer b.metaMu.Unlock()
+
+	if value == nil {
+		delete(b.meta, key)
+		return
+	}
+	if b.meta == nil {
+		b.meta = map[string]interface{}{}
+	}
+	b.meta[key] = value
+}
+
+// Meta returns the metadata value attached to the batch under key.
+func (b *Batch) Meta(key string) (interface{}, bool) {
+	b.metaMu.RLock()
+	defer b.metaMu.RUnlock()
+
+	value, ok := b.meta[key]
+	return value, ok
+}
+
+// Metadata returns a copy of all metadata attached to the batch. Nil if no
+// metadata has been set.
+func (b *Batch) Metadata() map[string]interface{} {
+	b.metaMu.RLock()
+	defer b.metaMu.RUnlock()
+
+	if len(b.meta) == 0 {
+		return nil
+	}
+	meta := make(map[string]interface{}, len(b.meta))
+	for k, v := range b.meta {
+		meta[k] = v
+	}
+	return meta
+}
+
+// AwaitContext waits for the batch to be ACKed. AwaitContext returns the
+// context error if ctx is done before, and ErrBatchCanceled if the batch has
+// been canceled. The channel returned by Await can be used in select
+// statements instead.
+func (b *Batch) AwaitContext(ctx context.Context) error {
+	select {
+	case <-b.ack:
+		return nil
+	case <-b.cancel:
+		return ErrBatchCanceled
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Cancel rejects the batch without ACKing it, e.g. if the batch can not be
+// processed for now. The server closes the connection the batch has been
+// received on, such that the client resends all events not ACKed yet. Events
+// ACKed via ACKUpTo before are not resent. Cancel on a batch split off via
+// Split cancels the original batch. Calls after the first call are ignored.
+func (b *Batch) Cancel() {
+	if !atomic.CompareAndSwapUint32(&b.canceled, 0, 1) {
+		return
+	}
+	close(b.cancel)
+	if b.parent != nil {
+		b.parent.Cancel()
+	}
+}
+
+// Canceled returns a channel being closed once the batch has been canceled
+// via Cancel.
+func (b *Batch) Canceled() <-chan struct{} {
+	return b.cancel
+}
+
+// Retain requires n additional calls to Done before the batch is ACKed, for
+// consumers handing the batch to several independent sinks. Retain must be
+// called before the batch is passed on to the sinks.
+func (b *Batch) Retain(n int) {
+	atomic.AddInt64(&b.retained, int64(n))
+}
+
+// Done reports a sink being done with a batch retained via Retain. The batch
+// is ACKed by the last call to Done. Calls exceeding the number of retains
+// are ignored.
+func (b *Batch) Done() {
+	for {
+		n := atomic.LoadInt64(&b.retained)
+		if n <= 0 {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&b.retained, n, n-1) {
+			if n == 1 {
+				b.ACK()
+			}
+			return
+		}
+	}
+}
+
+// ACKed returns the number of events acknowledged via ACKUpTo.
+func (b *Batch) ACKed() int {
+	return int(atomic.LoadUint64(&b.acked))
+}
+
+// Progress returns a channel signaling additional events being acknowledged
+// via ACKUpTo.
+func (b *Batch) Progress() <-chan struct{} {
+	return b.progress
 }
 
 // Await returns a channel for waiting for a batch to be ACKed.
 func (b *Batch) Await() <-chan struct{} {
 	return b.ack
 }
+
+// Release returns the memory backing Events to the pool it has been allocated
+// from, if the server is configured to pool events. Release should be called
+// once the consumer is done with the batch. Events must not be accessed after
+// Release. Release is a no-op for batches not using pooled memory and after
+// the first call.
+func (b *Batch) Release() {
+	if b.release != nil && atomic.CompareAndSwapUint32(&b.released, 0, 1) {
+		b.release()
+	}
+}
+
+// OnRelease registers fn being run by Release. Servers use OnRelease to return
+// pooled memory backing the batch.
+func (b *Batch) OnRelease(fn func()) {
+	b.release = fn
+}
@@ -0,0 +1,99 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package log
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Field is a key-value pair added to log messages as context, e.g. the ID of
+// the connection a message refers to.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// ContextLogging is implemented by custom loggers supporting structured
+// context. If Logger implements ContextLogging, messages logged via a Context
+// are passed to LogContextf with the fields of the Context. Otherwise the
+// fields are prepended to the message.
+type ContextLogging interface {
+	LogContextf(level Level, fields []Field, format string, args ...interface{})
+}
+
+// Context logs messages with a fixed set of fields, e.g. the connection ID,
+// remote address and protocol version of a client connection. A nil Context
+// logs messages without fields.
+type Context struct {
+	fields []Field
+	prefix string
+}
+
+// With creates a Context logging messages with the given fields.
+func With(fields ...Field) *Context {
+	return (*Context)(nil).With(fields...)
+}
+
+// With creates a Context logging messages with the fields of c and the given
+// fields.
+func (c *Context) With(fields ...Field) *Context {
+	var all []Field
+	if c != nil {
+		all = append(all, c.fields...)
+	}
+	all = append(all, fields...)
+
+	parts := make([]string, len(all))
+	for i, f := range all {
+		parts[i] = fmt.Sprintf("%v=%v", f.Key, f.Value)
+	}
+	return &Context{fields: all, prefix: strings.Join(parts, " ") + ": "}
+}
+
+// Debugf logs a message at LevelDebug.
+func (c *Context) Debugf(format string, args ...interface{}) {
+	c.logf(LevelDebug, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func (c *Context) Infof(format string, args ...interface{}) {
+	c.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a message at LevelWarn.
+func (c *Context) Warnf(format string, args ...interface{}) {
+	c.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs a message at LevelError.
+func (c *Context) Errorf(format string, args ...interface{}) {
+	c.logf(LevelError, format, args...)
+}
+
+func (c *Context) logf(level Level, format string, args ...interface{}) {
+	if c == nil || len(c.fields) == 0 {
+		logf(level, format, args...)
+		return
+	}
+	if l, ok := Logger.(ContextLogging); ok {
+		l.LogContextf(level, c.fields, format, args...)
+		return
+	}
+	logf(level, "%s"+format, append([]interface{}{c.prefix}, args...)...)
+}
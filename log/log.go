@@ -19,7 +19,9 @@
 //
 // The log package provides replaceable logging for use from within go-lumber.
 // Overwrite Logging variable with custom Logging implementation for integrating
-// go-lumber logging with applications logging strategy.
+// go-lumber logging with applications logging strategy. Loggers implementing
+// LeveledLogging receive the level of each message, e.g. the log/slog adapter
+// returned by NewSlog.
 package log
 
 import "log"
@@ -54,6 +56,53 @@ func Print(args ...interface{}) {
 	Logger.Print(args...)
 }
 
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from least to most severe.
+const (
+	LevelDebug Level = iota - 1 // e.g. connection and frame traces
+	LevelInfo                   // e.g. connections being opened and closed
+	LevelWarn                   // e.g. protocol errors of clients
+	LevelError                  // e.g. failing to reload certificates
+)
+
+// LeveledLogging is implemented by custom loggers supporting log levels. If
+// Logger implements LeveledLogging, go-lumber logs all messages with their
+// level via Logf. Otherwise messages are logged via Printf regardless of their
+// level.
+type LeveledLogging interface {
+	Logf(level Level, format string, args ...interface{})
+}
+
+// Debugf logs a message at LevelDebug.
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+// Infof logs a message at LevelInfo.
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+// Warnf logs a message at LevelWarn.
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+// Errorf logs a message at LevelError.
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+func logf(level Level, format string, args ...interface{}) {
+	if l, ok := Logger.(LeveledLogging); ok {
+		l.Logf(level, format, args...)
+		return
+	}
+	Logger.Printf(format, args...)
+}
+
 func (defaultLogger) Printf(format string, args ...interface{}) {
 	log.Printf(format, args...)
 }
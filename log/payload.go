@@ -0,0 +1,88 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package log
+
+import (
+	"fmt"
+	"unicode/utf8"
+)
+
+// PayloadPolicy controls how event payloads are included in log messages,
+// e.g. in traces of events failing to decode.
+type PayloadPolicy struct {
+	// Redact replaces payloads with their size, such that payload contents
+	// are never logged, not even at LevelDebug. Errors returned by decoders,
+	// which may quote payload contents, are logged by type only.
+	Redact bool
+
+	// MaxBytes caps the number of payload bytes and error message bytes
+	// logged. 0 logs payloads in full.
+	MaxBytes int
+}
+
+// Payloads is the policy applied to payloads in log messages. Payloads must be
+// configured before servers are started.
+var Payloads PayloadPolicy
+
+type payload []byte
+
+type payloadError struct {
+	err error
+}
+
+// Payload formats an event payload for log messages according to Payloads.
+func Payload(b []byte) fmt.Stringer {
+	return payload(b)
+}
+
+// PayloadError formats an error returned by an event decoder for log messages
+// according to Payloads.
+func PayloadError(err error) fmt.Stringer {
+	return payloadError{err}
+}
+
+func (p payload) String() string {
+	if Payloads.Redact {
+		return fmt.Sprintf("[redacted %d bytes]", len(p))
+	}
+	return truncate(fmt.Sprintf("%q", []byte(p)))
+}
+
+func (e payloadError) String() string {
+	if e.err == nil {
+		return "<nil>"
+	}
+	if Payloads.Redact {
+		return fmt.Sprintf("%T [redacted]", e.err)
+	}
+	return truncate(e.err.Error())
+}
+
+func truncate(s string) string {
+	max := Payloads.MaxBytes
+	if max <= 0 || len(s) <= max {
+		return s
+	}
+
+	// do not split multi-byte characters
+	n := max
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", s[:n], len(s)-n)
+}
@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+//go:build go1.21
+// +build go1.21
+
+package log
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog returns a logger writing all go-lumber log messages to l with their
+// level. Messages logged via Printf, Println and Print are logged at
+// slog.LevelInfo. Install the logger via:
+//
+//	log.Logger = log.NewSlog(logger)
+func NewSlog(l *slog.Logger) Logging {
+	return slogLogger{l}
+}
+
+// Logf logs the formatted message at the slog level corresponding to level.
+func (s slogLogger) Logf(level Level, format string, args ...interface{}) {
+	s.log(slogLevel(level), fmt.Sprintf(format, args...))
+}
+
+// LogContextf logs the formatted message with fields as attributes.
+func (s slogLogger) LogContextf(level Level, fields []Field, format string, args ...interface{}) {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	s.l.LogAttrs(context.Background(), slogLevel(level), fmt.Sprintf(format, args...), attrs...)
+}
+
+func (s slogLogger) Printf(format string, args ...interface{}) {
+	s.log(slog.LevelInfo, fmt.Sprintf(format, args...))
+}
+
+func (s slogLogger) Println(args ...interface{}) {
+	msg := fmt.Sprintln(args...)
+	s.log(slog.LevelInfo, msg[:len(msg)-1])
+}
+
+func (s slogLogger) Print(args ...interface{}) {
+	s.log(slog.LevelInfo, fmt.Sprint(args...))
+}
+
+func (s slogLogger) log(level slog.Level, msg string) {
+	s.l.Log(context.Background(), level, msg)
+}
+
+func slogLevel(level Level) slog.Level {
+	switch {
+	case level <= LevelDebug:
+		return slog.LevelDebug
+	case level == LevelInfo:
+		return slog.LevelInfo
+	case level == LevelWarn:
+		return slog.LevelWarn
+	default:
+		return slog.LevelError
+	}
+}
@@ -21,6 +21,11 @@ package v1
 // Version declares the protocol revision supported by this package.
 const Version = 1
 
+// ALPN is the TLS application protocol name identifying lumberjack protocol
+// version 1. Clients add ALPN to tls.Config.NextProtos to negotiate the
+// protocol version during the TLS handshake.
+const ALPN = "lumberjack/1"
+
 // Lumberjack protocol version 1 message types.
 const (
 	CodeVersion byte = '1'
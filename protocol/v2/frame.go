@@ -0,0 +1,190 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v2
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Frame is a decoded lumberjack protocol version 2 frame.
+type Frame struct {
+	// Type is the frame type, e.g. CodeJSONDataFrame.
+	Type byte
+
+	// Seq is the sequence number of data, JSON data, encoded data, protobuf
+	// data and ACK frames.
+	Seq uint32
+
+	// Count is the number of events announced by window size frames.
+	Count uint32
+
+	// Fields holds the key/value pairs of data frames.
+	Fields map[string]string
+
+	// Payload is the JSON document of JSON data and hello frames, the encoded
+	// event of encoded and protobuf data frames, or the compressed payload of
+	// compressed frames.
+	Payload []byte
+}
+
+// AppendFrame appends the encoded frame f to buf.
+//
+// Frames are encoded as:
+//
+//	Window Size Frame:     '2' 'W' count:uint32
+//	Data Frame:            '2' 'D' seq:uint32 pairs:uint32 (keyLen:uint32 key valLen:uint32 val)*
+//	JSON Data Frame:       '2' 'J' seq:uint32 payloadLen:uint32 payload
+//	Encoded Data Frame:    '2' 'E' seq:uint32 payloadLen:uint32 payload
+//	Protobuf Data Frame:   '2' 'P' seq:uint32 payloadLen:uint32 payload
+//	Compressed Data Frame: '2' 'C'|'Z' payloadLen:uint32 payload
+//	Hello Frame:           '2' 'H' payloadLen:uint32 payload
+//	ACK Frame:             '2' 'A' seq:uint32
+func AppendFrame(buf []byte, f *Frame) ([]byte, error) {
+	hdr := []byte{CodeVersion, f.Type}
+	buf = append(buf, hdr...)
+	switch f.Type {
+	case CodeWindowSize:
+		buf = appendUint32(buf, f.Count)
+	case CodeACK:
+		buf = appendUint32(buf, f.Seq)
+	case CodeDataFrame:
+		buf = appendUint32(buf, f.Seq)
+		buf = appendUint32(buf, uint32(len(f.Fields)))
+		for k, v := range f.Fields {
+			buf = appendBytes(buf, []byte(k))
+			buf = appendBytes(buf, []byte(v))
+		}
+	case CodeJSONDataFrame, CodeEncodedDataFrame, CodeProtobufDataFrame:
+		buf = appendUint32(buf, f.Seq)
+		buf = appendBytes(buf, f.Payload)
+	case CodeCompressed, CodeZstdCompressed, CodeHello:
+		buf = appendBytes(buf, f.Payload)
+	default:
+		return nil, &lj.ProtocolError{Msg: "unknown frame type", Frame: f.Type, Header: hdr}
+	}
+	return buf, nil
+}
+
+// Encode writes the encoded frame f to w.
+func Encode(w io.Writer, f *Frame) error {
+	buf, err := AppendFrame(nil, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// Decode reads the next frame from r. Frames with payloads, keys or values
+// larger than maxPayload bytes are rejected. 0 disables the limit. r should
+// be buffered, as Decode issues multiple small reads per frame.
+func Decode(r io.Reader, maxPayload int) (*Frame, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	if hdr[0] != CodeVersion {
+		return nil, &lj.ProtocolError{Msg: "unexpected protocol version", Frame: hdr[1], Header: hdr[:]}
+	}
+
+	f := &Frame{Type: hdr[1]}
+	var err error
+	switch f.Type {
+	case CodeWindowSize:
+		f.Count, err = readUint32(r)
+	case CodeACK:
+		f.Seq, err = readUint32(r)
+	case CodeDataFrame:
+		f.Seq, err = readUint32(r)
+		if err == nil {
+			f.Fields, err = readFields(r, maxPayload)
+		}
+	case CodeJSONDataFrame, CodeEncodedDataFrame, CodeProtobufDataFrame:
+		f.Seq, err = readUint32(r)
+		if err == nil {
+			f.Payload, err = readBytes(r, maxPayload)
+		}
+	case CodeCompressed, CodeZstdCompressed, CodeHello:
+		f.Payload, err = readBytes(r, maxPayload)
+	default:
+		return nil, &lj.ProtocolError{Msg: "unknown frame type", Frame: f.Type, Header: hdr[:]}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+var errPayloadTooLarge = lj.NewError(lj.ErrFrameTooLarge, "frame payload exceeds max size")
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendBytes(buf, b []byte) []byte {
+	buf = appendUint32(buf, uint32(len(b)))
+	return append(buf, b...)
+}
+
+func readUint32(r io.Reader) (uint32, error) {
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(b[:]), nil
+}
+
+func readBytes(r io.Reader, max int) ([]byte, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if max > 0 && uint64(n) > uint64(max) {
+		return nil, errPayloadTooLarge
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func readFields(r io.Reader, max int) (map[string]string, error) {
+	pairs, err := readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	for i := uint32(0); i < pairs; i++ {
+		k, err := readBytes(r, max)
+		if err != nil {
+			return nil, err
+		}
+		v, err := readBytes(r, max)
+		if err != nil {
+			return nil, err
+		}
+		fields[string(k)] = string(v)
+	}
+	return fields, nil
+}
@@ -21,12 +21,90 @@ package v2
 // Version declares the protocol revision supported by this package.
 const Version = 2
 
+// ALPN is the TLS application protocol name identifying lumberjack protocol
+// version 2. Clients add ALPN to tls.Config.NextProtos to negotiate the
+// protocol version during the TLS handshake.
+const ALPN = "lumberjack/2"
+
 // Lumberjack protocol version 2 message types.
 const (
 	CodeVersion byte = '2'
 
 	CodeWindowSize    byte = 'W'
+	CodeDataFrame     byte = 'D'
 	CodeJSONDataFrame byte = 'J'
 	CodeCompressed    byte = 'C'
-	CodeACK           byte = 'A'
+
+	// ACK frames carry the sequence number of the last event processed in
+	// the current window. Sequence numbers less than the window size report
+	// progress. While a window is being processed, keepalives repeat the
+	// highest sequence number processed so far, or 0 if no event has been
+	// processed yet.
+	CodeACK byte = 'A'
+
+	// Protocol extensions. Clients must only send extension frames after the
+	// server has accepted the extension in the hello response.
+	CodeHello          byte = 'H'
+	CodeZstdCompressed byte = 'Z'
+
+	// Encoded data frames carry events encoded with the event codec
+	// negotiated via the hello frame.
+	CodeEncodedDataFrame byte = 'E'
+
+	// Protobuf data frames carry protobuf encoded events. The message type
+	// is agreed on by the deployment, not by the protocol.
+	CodeProtobufDataFrame byte = 'P'
+)
+
+// Compression codecs negotiated via the hello frame.
+const (
+	CodecZlib = "zlib"
+	CodecZstd = "zstd"
+)
+
+// Protocol extensions negotiated via the hello frame.
+const (
+	ExtensionProtobuf = "protobuf"
 )
+
+// Event codecs negotiated via the hello frame.
+const (
+	EventCodecCBOR    = "cbor"
+	EventCodecMsgpack = "msgpack"
+)
+
+// Hello is the JSON encoded payload of the optional hello frame. Clients send
+// the hello frame before the first batch, advertising the extensions and
+// limits supported by the client. The server responds with a hello frame
+// listing the extensions accepted for the connection and the server limits.
+// Zero values indicate no limit or setting being advertised.
+//
+// Hello Frame:
+// version: uint8 = '2'
+// code: uint8 = 'H'
+// payloadLen (bytes): uint32
+// payload: JSON document
+type Hello struct {
+	// Codecs lists the compression codecs supported by the client or accepted
+	// by the server.
+	Codecs []string `json:"codecs,omitempty"`
+
+	// MaxBatchSize is the maximum number of events per batch sent by the
+	// client or accepted by the server.
+	MaxBatchSize int `json:"max_batch_size,omitempty"`
+
+	// KeepaliveMillis is the interval in milliseconds the server sends empty
+	// ACKs in while a batch is being processed. Clients advertise the maximum
+	// interval they can tolerate without timing out.
+	KeepaliveMillis int64 `json:"keepalive_ms,omitempty"`
+
+	// EventCodecs lists the event codecs supported by the client in order of
+	// preference. The server accepts at most one event codec, used by encoded
+	// data frames on the connection. Events are sent as JSON data frames if no
+	// event codec is accepted.
+	EventCodecs []string `json:"event_codecs,omitempty"`
+
+	// Extensions lists the optional frame types supported by the client or
+	// accepted by the server, e.g. ExtensionProtobuf.
+	Extensions []string `json:"extensions,omitempty"`
+}
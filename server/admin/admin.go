@@ -0,0 +1,158 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package admin provides an HTTP endpoint for probing and monitoring
+// lumberjack servers without speaking the lumberjack protocol.
+//
+// The following endpoints are served:
+//
+//	/healthz     Always returns 200 OK while the endpoint is running.
+//	/readyz      Returns 200 OK if the server is marked ready, 503 otherwise.
+//	/stats       Returns the server metrics as JSON document.
+//	/metrics     Returns the server metrics in the Prometheus text format.
+//	/debug/vars  Returns the variables published via expvar, see metrics.Publish.
+package admin
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/scippio/go-lumber/server"
+	"github.com/scippio/go-lumber/server/metrics"
+)
+
+// StatsSource is implemented by lumberjack servers providing metrics.
+type StatsSource interface {
+	Stats() server.Stats
+}
+
+// Handler serves the admin endpoints for a lumberjack server.
+type Handler struct {
+	src   StatsSource
+	mux   *http.ServeMux
+	ready int32
+
+	mu         sync.Mutex
+	lastEvents uint64
+	lastTime   time.Time
+}
+
+// Server is an admin endpoint listening for HTTP requests.
+type Server struct {
+	*Handler
+	http *http.Server
+}
+
+type statsResponse struct {
+	server.Stats
+	EventsPerSecond float64 `json:"events_per_second"`
+}
+
+// NewHandler creates a new Handler reporting the metrics of src. The handler
+// is marked ready.
+func NewHandler(src StatsSource) *Handler {
+	h := &Handler{
+		src:      src,
+		mux:      http.NewServeMux(),
+		ready:    1,
+		lastTime: time.Now(),
+	}
+	h.mux.HandleFunc("/healthz", h.serveHealth)
+	h.mux.HandleFunc("/readyz", h.serveReady)
+	h.mux.HandleFunc("/stats", h.serveStats)
+	h.mux.Handle("/metrics", metrics.Handler(src))
+	h.mux.Handle("/debug/vars", expvar.Handler())
+	return h
+}
+
+// ListenAndServe starts serving the admin endpoints for src on the TCP
+// network address addr.
+func ListenAndServe(addr string, src StatsSource) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := NewHandler(src)
+	s := &Server{
+		Handler: h,
+		http:    &http.Server{Handler: h, ReadHeaderTimeout: 10 * time.Second},
+	}
+	go func() {
+		_ = s.http.Serve(l)
+	}()
+	return s, nil
+}
+
+// Close stops the admin endpoint.
+func (s *Server) Close() error {
+	return s.http.Close()
+}
+
+// SetReady marks the lumberjack server as ready or not ready for receiving
+// connections. Mark the server as not ready before shutting down.
+func (h *Handler) SetReady(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&h.ready, v)
+}
+
+// ServeHTTP dispatches requests to the admin endpoints.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, _ *http.Request) {
+	writeStatus(w, http.StatusOK)
+}
+
+func (h *Handler) serveReady(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&h.ready) == 0 {
+		writeStatus(w, http.StatusServiceUnavailable)
+		return
+	}
+	writeStatus(w, http.StatusOK)
+}
+
+func (h *Handler) serveStats(w http.ResponseWriter, _ *http.Request) {
+	stats := h.src.Stats()
+
+	// compute events/sec since last stats request
+	h.mu.Lock()
+	now := time.Now()
+	var rate float64
+	if dt := now.Sub(h.lastTime).Seconds(); dt > 0 {
+		rate = float64(stats.EventsReceived-h.lastEvents) / dt
+	}
+	h.lastEvents, h.lastTime = stats.EventsReceived, now
+	h.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(statsResponse{Stats: stats, EventsPerSecond: rate})
+}
+
+func writeStatus(w http.ResponseWriter, status int) {
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(http.StatusText(status) + "\n"))
+}
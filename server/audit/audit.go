@@ -0,0 +1,127 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package audit provides the connection audit trail of lumberjack servers.
+//
+// Audit records are passed to the Hook installed via the servers Audit
+// option:
+//
+//	f, err := os.OpenFile("/var/log/lumberjack-audit.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+//	...
+//	s, err := server.ListenAndServe(addr,
+//		server.Audit(audit.JSONLines(f)))
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Kind identifies the connection lifecycle event being audited.
+type Kind uint8
+
+const (
+	// Connect is recorded once a connection has been accepted.
+	Connect Kind = iota + 1
+
+	// Disconnect is recorded once an accepted connection has been closed.
+	Disconnect
+
+	// Reject is recorded for connections being closed before being
+	// accepted, e.g. due to a failed TLS handshake or authorization.
+	Reject
+)
+
+// Record describes a connection lifecycle event.
+type Record struct {
+	Kind       Kind
+	Time       time.Time
+	ConnID     uint64       // ID of the connection. 0 for rejected connections.
+	RemoteAddr string       // Source address of the connection.
+	Identity   *lj.Identity // Verified TLS client identity. Nil if no client certificate has been verified.
+
+	// Reason the connection has been closed or rejected. Nil if the
+	// connection has been closed by the client.
+	Reason error
+
+	// Statistics of the closed connection. Only set for Disconnect records.
+	Duration        time.Duration
+	BytesReceived   uint64
+	BatchesReceived uint64
+	EventsReceived  uint64
+}
+
+// Hook is called for every audit record. Hooks are called concurrently from
+// multiple connections and must not block.
+type Hook func(Record)
+
+var kindNames = map[Kind]string{
+	Connect:    "connect",
+	Disconnect: "disconnect",
+	Reject:     "reject",
+}
+
+func (k Kind) String() string {
+	if s, ok := kindNames[k]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// JSONLines returns a Hook writing one JSON encoded record per line to w.
+// Write errors are ignored.
+func JSONLines(w io.Writer) Hook {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(r Record) {
+		type jsonRecord struct {
+			Kind            string       `json:"kind"`
+			Time            time.Time    `json:"time"`
+			ConnID          uint64       `json:"conn_id,omitempty"`
+			RemoteAddr      string       `json:"remote_addr"`
+			Identity        *lj.Identity `json:"identity,omitempty"`
+			Reason          string       `json:"reason,omitempty"`
+			Duration        float64      `json:"duration_seconds,omitempty"`
+			BytesReceived   uint64       `json:"bytes_received,omitempty"`
+			BatchesReceived uint64       `json:"batches_received,omitempty"`
+			EventsReceived  uint64       `json:"events_received,omitempty"`
+		}
+
+		jr := jsonRecord{
+			Kind:            r.Kind.String(),
+			Time:            r.Time,
+			ConnID:          r.ConnID,
+			RemoteAddr:      r.RemoteAddr,
+			Identity:        r.Identity,
+			Duration:        r.Duration.Seconds(),
+			BytesReceived:   r.BytesReceived,
+			BatchesReceived: r.BatchesReceived,
+			EventsReceived:  r.EventsReceived,
+		}
+		if r.Reason != nil {
+			jr.Reason = r.Reason.Error()
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		_ = enc.Encode(jr)
+	}
+}
@@ -0,0 +1,119 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ACKBuffer coalesces ACK frames written within a flush window into a single
+// write, reducing the number of writes on connections with many small batches
+// in flight.
+type ACKBuffer struct {
+	conn    net.Conn
+	timeout time.Duration
+	window  time.Duration
+	maxACKs int
+
+	mu      sync.Mutex
+	buf     []byte
+	pending int
+	timer   *time.Timer
+	err     error // error of the last flush triggered by the flush window
+}
+
+// NewACKBuffer creates an ACKBuffer flushing pending ACKs to c once the
+// window expires or maxACKs ACKs are pending. maxACKs 0 flushes on window
+// expiry only. timeout is the write timeout applied to each flush.
+func NewACKBuffer(c net.Conn, timeout, window time.Duration, maxACKs int) *ACKBuffer {
+	return &ACKBuffer{
+		conn:    c,
+		timeout: timeout,
+		window:  window,
+		maxACKs: maxACKs,
+	}
+}
+
+// Write buffers the ACK frame p. Write returns the error of a previously
+// failed flush.
+func (b *ACKBuffer) Write(p []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+
+	b.buf = append(b.buf, p...)
+	b.pending++
+	if b.maxACKs > 0 && b.pending >= b.maxACKs {
+		return b.flush()
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.onWindow)
+	}
+	return nil
+}
+
+// Flush writes all pending ACKs.
+func (b *ACKBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err != nil {
+		return b.err
+	}
+	return b.flush()
+}
+
+func (b *ACKBuffer) onWindow() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.err == nil {
+		b.err = b.flush()
+	}
+}
+
+func (b *ACKBuffer) flush() error {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	if err := b.conn.SetWriteDeadline(time.Now().Add(b.timeout)); err != nil {
+		return err
+	}
+	tmp := b.buf
+	for len(tmp) > 0 {
+		n, err := b.conn.Write(tmp)
+		if err != nil {
+			return err
+		}
+		tmp = tmp[n:]
+	}
+
+	b.buf = b.buf[:0]
+	b.pending = 0
+	return nil
+}
@@ -0,0 +1,85 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/server/audit"
+)
+
+// countingConn counts the bytes read from a connection.
+type countingConn struct {
+	net.Conn
+	counters *Counters // server wide byte counter, nil if not counted
+	read     uint64    // updated atomically
+	last     int64     // time of the last read in ns since the Unix epoch, updated atomically
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.AddUint64(&c.read, uint64(n))
+		if c.counters != nil {
+			c.counters.BytesRead(n)
+		}
+		atomic.StoreInt64(&c.last, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// BytesRead returns the number of bytes read from the connection.
+func (c *countingConn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.read)
+}
+
+// LastRead returns the time data has been read last, or the time the
+// connection has been wrapped if no data has been read yet.
+func (c *countingConn) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.last))
+}
+
+// AuditReject reports a connection being rejected to hook. AuditReject is a
+// no-op if hook is nil.
+func AuditReject(hook audit.Hook, conn net.Conn, reason error) {
+	if hook == nil {
+		return
+	}
+
+	rec := newAuditRecord(audit.Reject, 0, conn)
+	rec.Reason = reason
+	hook(rec)
+}
+
+func newAuditRecord(kind audit.Kind, id uint64, conn net.Conn) audit.Record {
+	return audit.Record{
+		Kind:       kind,
+		Time:       time.Now(),
+		ConnID:     id,
+		RemoteAddr: conn.RemoteAddr().String(),
+		Identity:   lj.IdentityFromTLS(TLSConnectionState(conn)),
+	}
+}
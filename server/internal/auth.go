@@ -0,0 +1,95 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/json"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// TokenValidator validates authentication tokens presented by clients.
+type TokenValidator interface {
+	ValidateToken(token string) error
+}
+
+// TokenValidatorFunc adapts a function to the TokenValidator interface.
+type TokenValidatorFunc func(token string) error
+
+// TokenAuth configures token based client authentication. Clients
+// authenticate by sending the token in Field of the first event on a
+// connection.
+type TokenAuth struct {
+	Field     string
+	Validator TokenValidator
+}
+
+// ErrMissingToken indicates the first event on a connection not carrying an
+// authentication token.
+var ErrMissingToken = lj.NewError(lj.ErrAuth, "authentication token missing")
+
+// ValidateToken calls f(token).
+func (f TokenValidatorFunc) ValidateToken(token string) error {
+	return f(token)
+}
+
+// authenticate validates the token in the first event of b. The event
+// carrying the token is removed from b.
+func (a *TokenAuth) authenticate(b *lj.Batch) error {
+	if len(b.Events) == 0 {
+		return ErrMissingToken
+	}
+
+	token := a.token(b.Events[0])
+	if token == "" {
+		return ErrMissingToken
+	}
+
+	if err := a.Validator.ValidateToken(token); err != nil {
+		return lj.WrapError(lj.ErrAuth, err)
+	}
+	b.Events = b.Events[1:]
+	if len(b.EventSizes) > 0 {
+		b.EventSizes = b.EventSizes[1:]
+	}
+	return nil
+}
+
+// token returns the token in event, or the empty string if event does not
+// carry a token. Events not being maps, e.g. raw JSON events or events
+// created by an event factory or protobuf decoder, are looked up in their
+// JSON representation.
+func (a *TokenAuth) token(event interface{}) string {
+	switch event.(type) {
+	case map[string]interface{}, map[string]string:
+	default:
+		raw, err := json.Marshal(event)
+		if err != nil {
+			return ""
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return ""
+		}
+		event = m
+	}
+
+	token, _ := lj.Field(event, a.Field)
+	s, _ := token.(string)
+	return s
+}
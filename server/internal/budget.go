@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync"
+
+// EventBudget limits the total number of un-ACKed events across all
+// connections. A nil EventBudget is unlimited.
+type EventBudget struct {
+	max int
+
+	mu       sync.Mutex
+	inflight int
+	avail    chan struct{} // closed once the budget is available again
+}
+
+// NewEventBudget creates a new EventBudget allowing up to max un-ACKed
+// events. Returns nil if max is 0.
+func NewEventBudget(max int) *EventBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &EventBudget{max: max, avail: make(chan struct{})}
+}
+
+// Wait blocks until the budget is not exhausted. Returns false if done is
+// closed while waiting.
+func (b *EventBudget) Wait(done <-chan struct{}) bool {
+	if b == nil {
+		return true
+	}
+
+	for {
+		b.mu.Lock()
+		if b.inflight < b.max {
+			b.mu.Unlock()
+			return true
+		}
+		avail := b.avail
+		b.mu.Unlock()
+
+		select {
+		case <-done:
+			return false
+		case <-avail:
+		}
+	}
+}
+
+// Add accounts for n new un-ACKed events. The budget can be exceeded by the
+// last batch read.
+func (b *EventBudget) Add(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.inflight += n
+	b.mu.Unlock()
+}
+
+// Done releases n events from the budget once they have been ACKed or the
+// connection has been closed.
+func (b *EventBudget) Done(n int) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	exhausted := b.inflight >= b.max
+	b.inflight -= n
+	if exhausted && b.inflight < b.max {
+		close(b.avail)
+		b.avail = make(chan struct{})
+	}
+}
+
+// InFlight returns the number of un-ACKed events.
+func (b *EventBudget) InFlight() int {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.inflight
+}
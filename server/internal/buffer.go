@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync"
+
+// maxPooledBuffer is the capacity of the largest buffer returned to the pool.
+// Larger buffers, e.g. of rare huge frames, are left to the garbage collector.
+const maxPooledBuffer = 1 << 20
+
+// buffers pools payload buffers across batches and connections.
+var buffers sync.Pool
+
+// Buffer is a payload buffer borrowed from a pool shared by all connections.
+// The zero value is ready to use.
+type Buffer struct {
+	b []byte
+}
+
+// Get returns a slice of n bytes, borrowing a larger buffer from the pool if
+// required. The slice is only valid until the next call to Get or Release.
+func (b *Buffer) Get(n int) []byte {
+	if cap(b.b) < n {
+		b.Release()
+		if p, ok := buffers.Get().(*[]byte); ok && cap(*p) >= n {
+			b.b = *p
+		} else {
+			if ok {
+				buffers.Put(p)
+			}
+			b.b = make([]byte, n)
+		}
+	}
+	return b.b[:n]
+}
+
+// Release returns the buffer to the pool.
+func (b *Buffer) Release() {
+	PutBytes(b.b)
+	b.b = nil
+}
+
+// GetBytes returns an empty byte slice from the pool, to be appended to.
+func GetBytes() []byte {
+	if p, ok := buffers.Get().(*[]byte); ok {
+		return (*p)[:0]
+	}
+	return nil
+}
+
+// PutBytes returns b to the pool. b must not be used afterwards.
+func PutBytes(b []byte) {
+	if b == nil || cap(b) > maxPooledBuffer {
+		return
+	}
+	b = b[:0]
+	buffers.Put(&b)
+}
+
+// maxPooledEvents is the capacity of the largest events slice returned to the
+// pool.
+const maxPooledEvents = 1 << 16
+
+// eventSlices pools the events slices of batches released by consumers.
+var eventSlices sync.Pool
+
+// GetEvents returns an empty events slice with a capacity of at least n.
+func GetEvents(n int) []interface{} {
+	if p, ok := eventSlices.Get().(*[]interface{}); ok {
+		if cap(*p) >= n {
+			return (*p)[:0]
+		}
+		eventSlices.Put(p)
+	}
+	return make([]interface{}, 0, n)
+}
+
+// PutEvents clears events and returns it to the pool. events must not be used
+// afterwards.
+func PutEvents(events []interface{}) {
+	if cap(events) > maxPooledEvents {
+		return
+	}
+	events = events[:cap(events)]
+	for i := range events {
+		events[i] = nil
+	}
+	events = events[:0]
+	eventSlices.Put(&events)
+}
@@ -0,0 +1,123 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats provides a snapshot of the metrics of a client connection.
+type ConnStats struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Version    int       `json:"version"`     // Lumberjack protocol version served.
+	TLSVersion uint16    `json:"tls_version"` // Negotiated TLS version, 0 for non-TLS connections.
+	Connected  time.Time `json:"connected"`
+
+	// LastActivity is the time data has been read from the connection last.
+	LastActivity time.Time `json:"last_activity"`
+
+	BatchesReceived uint64 `json:"batches_received"`
+	EventsReceived  uint64 `json:"events_received"`
+	BytesReceived   uint64 `json:"bytes_received"`
+
+	// InFlightBatches is the number of batches waiting for being ACKed.
+	InFlightBatches int `json:"in_flight_batches"`
+
+	// ReceiveBlocked is the total time the connection handler has been
+	// blocked on forwarding batches to the receive channel.
+	ReceiveBlocked time.Duration `json:"receive_blocked"`
+}
+
+// connState tracks a connection being served.
+type connState struct {
+	conn      *countingConn
+	cb        *chanCallback
+	handler   Handler
+	version   int
+	connected time.Time
+}
+
+// connRegistry tracks the connections being served by a server.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[uint64]*connState
+}
+
+func (r *connRegistry) add(c *connState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = map[uint64]*connState{}
+	}
+	r.conns[c.cb.id] = c
+}
+
+func (r *connRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// snapshot returns the stats of all connections ordered by connection ID.
+func (r *connRegistry) snapshot() []ConnStats {
+	r.mu.Lock()
+	conns := make([]*connState, 0, len(r.conns))
+	for _, c := range r.conns {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	stats := make([]ConnStats, len(conns))
+	for i, c := range conns {
+		stats[i] = c.stats()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+func (c *connState) stats() ConnStats {
+	s := ConnStats{
+		ID:              c.cb.id,
+		RemoteAddr:      c.conn.RemoteAddr().String(),
+		Version:         c.version,
+		Connected:       c.connected,
+		LastActivity:    c.conn.LastRead(),
+		BatchesReceived: atomic.LoadUint64(&c.cb.batches),
+		EventsReceived:  atomic.LoadUint64(&c.cb.events),
+		BytesReceived:   c.conn.BytesRead(),
+		ReceiveBlocked:  time.Duration(atomic.LoadUint64(&c.cb.blocked)),
+	}
+	if tlsState := TLSConnectionState(c.conn); tlsState != nil {
+		s.TLSVersion = tlsState.Version
+	}
+	if h, ok := c.handler.(interface{ InFlight() int }); ok {
+		s.InFlightBatches = h.InFlight()
+	}
+	return s
+}
+
+// newCountingConn wraps conn counting the bytes read in the connection and
+// in counters.
+func newCountingConn(conn net.Conn, counters *Counters) *countingConn {
+	return &countingConn{Conn: conn, counters: counters, last: time.Now().UnixNano()}
+}
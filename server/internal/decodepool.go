@@ -0,0 +1,74 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync"
+
+// DecodePool runs a fixed number of long-lived workers decoding events. A pool
+// is shared by all connections of a server.
+type DecodePool struct {
+	jobs      chan func()
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDecodePool creates a pool of workers decoding events concurrently.
+// Returns nil if workers is 0.
+func NewDecodePool(workers int) *DecodePool {
+	if workers <= 0 {
+		return nil
+	}
+
+	p := &DecodePool{
+		jobs: make(chan func()),
+		done: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+func (p *DecodePool) run() {
+	for {
+		select {
+		case fn := <-p.jobs:
+			fn()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// Go hands fn to an idle worker. If all workers are busy or the pool has been
+// closed, fn is run on the calling goroutine.
+func (p *DecodePool) Go(fn func()) {
+	select {
+	case p.jobs <- fn:
+	default:
+		fn()
+	}
+}
+
+// Close stops the workers once they are done with their current jobs. Close
+// is a no-op on a nil pool.
+func (p *DecodePool) Close() {
+	if p != nil {
+		p.closeOnce.Do(func() { close(p.done) })
+	}
+}
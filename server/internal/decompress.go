@@ -0,0 +1,92 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"io"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// ErrDecompressedTooLarge indicates a batch exceeding the decompressed size
+// limit.
+var ErrDecompressedTooLarge = lj.NewError(lj.ErrFrameTooLarge, "decompressed payload exceeds size limit")
+
+// DecompressBudget limits the number of bytes decompressed per batch,
+// including nested compressed frames. A nil DecompressBudget is unlimited.
+type DecompressBudget struct {
+	max  int64
+	left int64
+}
+
+// DecompressReader reads decompressed data, failing with
+// ErrDecompressedTooLarge once the budget is exhausted.
+type DecompressReader struct {
+	r      io.Reader
+	budget *DecompressBudget
+}
+
+// NewDecompressBudget creates a new DecompressBudget allowing up to max bytes
+// being decompressed per batch. Returns nil if max is 0.
+func NewDecompressBudget(max int64) *DecompressBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &DecompressBudget{max: max, left: max}
+}
+
+// Reset restores the full budget for the next batch.
+func (b *DecompressBudget) Reset() {
+	if b != nil {
+		b.left = b.max
+	}
+}
+
+// Reader wraps r, a reader returning decompressed data, such that reads are
+// accounted for by the budget.
+func (b *DecompressBudget) Reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &DecompressReader{r: r, budget: b}
+}
+
+func (d *DecompressReader) Read(p []byte) (int, error) {
+	b := d.budget
+	if b.left <= 0 {
+		// fail only if more data is available
+		var tmp [1]byte
+		if n, err := d.r.Read(tmp[:]); n == 0 {
+			return 0, err
+		}
+		return 0, ErrDecompressedTooLarge
+	}
+
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := d.r.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+// Fits returns false if reading n more bytes exceeds the budget. Fits can be
+// used to check sizes read from the stream before allocating buffers.
+func (d *DecompressReader) Fits(n int) bool {
+	return int64(n) <= d.budget.left
+}
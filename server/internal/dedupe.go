@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Deduplicator remembers the IDs of recently delivered events, detecting
+// events being retransmitted by clients. A Deduplicator is shared by all
+// connections of a server.
+type Deduplicator struct {
+	field  string
+	size   int
+	window time.Duration
+
+	mu  sync.Mutex
+	ids map[string]*list.Element
+	lru *list.List // *seenID, most recently seen first
+}
+
+type seenID struct {
+	id   string
+	seen time.Time
+}
+
+// NewDeduplicator creates a Deduplicator keyed on the event ID in field,
+// remembering up to size IDs for window. IDs do not expire if window is 0.
+// Returns nil if field is empty.
+func NewDeduplicator(field string, size int, window time.Duration) *Deduplicator {
+	if field == "" {
+		return nil
+	}
+	return &Deduplicator{
+		field:  field,
+		size:   size,
+		window: window,
+		ids:    map[string]*list.Element{},
+		lru:    list.New(),
+	}
+}
+
+// Duplicate returns true if an event with the same ID has been seen before,
+// else the ID of event is recorded. Events lacking the ID field are never
+// duplicates.
+func (d *Deduplicator) Duplicate(event interface{}) bool {
+	v, ok := lj.Field(event, d.field)
+	if !ok {
+		return false
+	}
+	id, isString := v.(string)
+	if !isString {
+		id = fmt.Sprint(v)
+	}
+
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now)
+	if _, seen := d.ids[id]; seen {
+		return true
+	}
+
+	d.ids[id] = d.lru.PushFront(&seenID{id: id, seen: now})
+	if d.lru.Len() > d.size {
+		d.remove(d.lru.Back())
+	}
+	return false
+}
+
+// expire removes the IDs seen before the dedupe window.
+func (d *Deduplicator) expire(now time.Time) {
+	if d.window <= 0 {
+		return
+	}
+	for el := d.lru.Back(); el != nil && now.Sub(el.Value.(*seenID).seen) >= d.window; el = d.lru.Back() {
+		d.remove(el)
+	}
+}
+
+func (d *Deduplicator) remove(el *list.Element) {
+	delete(d.ids, el.Value.(*seenID).id)
+	d.lru.Remove(el)
+}
@@ -0,0 +1,89 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Enrichment configures fields added to the events of batches before delivery.
+// Fields are only added to events being maps and lacking the field. Empty
+// field names disable adding the respective field.
+type Enrichment struct {
+	// RemoteAddrField is set to the address of the client.
+	RemoteAddrField string
+
+	// IdentityField is set to the common name of the verified TLS client
+	// certificate. Not set if no client certificate has been verified.
+	IdentityField string
+
+	// ConnIDField is set to the ID of the connection.
+	ConnIDField string
+
+	// Fields are static fields added to all events. Values added to events
+	// with string values, like v1 events, are formatted using fmt.Sprint.
+	Fields map[string]interface{}
+}
+
+// Apply adds the configured fields to the events of b. Apply is a no-op if e
+// is nil.
+func (e *Enrichment) Apply(b *lj.Batch) {
+	if e == nil || (len(e.Fields) == 0 && e.RemoteAddrField == "" && e.IdentityField == "" && e.ConnIDField == "") {
+		return
+	}
+
+	fields := make(map[string]interface{}, len(e.Fields)+3)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	if e.RemoteAddrField != "" {
+		fields[e.RemoteAddrField] = b.RemoteAddr
+	}
+	if e.IdentityField != "" && b.Identity != nil {
+		fields[e.IdentityField] = b.Identity.CommonName
+	}
+	if e.ConnIDField != "" {
+		fields[e.ConnIDField] = b.ConnID
+	}
+
+	var strFields map[string]string // formatted on first use
+	for _, event := range b.Events {
+		switch ev := event.(type) {
+		case map[string]interface{}:
+			for k, v := range fields {
+				if _, exists := ev[k]; !exists {
+					ev[k] = v
+				}
+			}
+		case map[string]string:
+			if strFields == nil {
+				strFields = make(map[string]string, len(fields))
+				for k, v := range fields {
+					strFields[k] = fmt.Sprint(v)
+				}
+			}
+			for k, v := range strFields {
+				if _, exists := ev[k]; !exists {
+					ev[k] = v
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Sampling keeps a random sample of the events matching Match, dropping the
+// other matching events. Events not matching are always kept.
+type Sampling struct {
+	Rate  float64                      // fraction of matching events kept
+	Match func(event interface{}) bool // matches all events if nil
+}
+
+// sampler returns a predicate dropping events matching s.Match with a
+// probability of 1-s.Rate. The predicate must not be used concurrently.
+func (s *Sampling) sampler() func(event interface{}) bool {
+	if s == nil {
+		return nil
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return func(event interface{}) bool {
+		return (s.Match == nil || s.Match(event)) && rnd.Float64() >= s.Rate
+	}
+}
+
+// dropEvents removes the events of b matching drop, returning the number of
+// events removed. Event sizes and the window positions of the events are
+// removed accordingly, positions being nil if not tracked.
+func dropEvents(b *lj.Batch, positions []int, drop func(event interface{}) bool) (int, []int) {
+	keep := b.Events[:0]
+	keepPositions := positions[:0]
+	var sizes []int
+	if len(b.EventSizes) == len(b.Events) {
+		sizes = b.EventSizes[:0]
+	}
+	for i, event := range b.Events {
+		if drop(event) {
+			continue
+		}
+		keep = append(keep, event)
+		if sizes != nil {
+			sizes = append(sizes, b.EventSizes[i])
+		}
+		if positions != nil {
+			keepPositions = append(keepPositions, positions[i])
+		}
+	}
+
+	dropped := len(b.Events) - len(keep)
+	b.Events = keep
+	if sizes != nil {
+		b.EventSizes = sizes
+	}
+	return dropped, keepPositions
+}
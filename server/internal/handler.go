@@ -18,26 +18,108 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/log"
 )
 
+// queuedBatch is a batch waiting for being ACKed. positions holds the index
+// of each event of the batch in the window, as events of the window might
+// have been removed from the batch, e.g. the authentication token or dropped
+// events. positions is nil if no event has been removed, the events being at
+// base onwards. end is the number of events of the window ACKed once the
+// batch is ACKed. queued is the time the batch has been queued for being
+// ACKed. delivered signals the batch having been handed to the consumer, the
+// slow consumer timeout starts at, nil if the slow consumer timeout is
+// disabled or the batch is not delivered. lastSeq is the sequence number of
+// the event at window position end-1.
+type queuedBatch struct {
+	b         *lj.Batch
+	positions []int
+	base      int
+	end       int
+	lastSeq   uint32
+	queued    time.Time
+	delivered *delivery
+}
+
+// delivery signals a batch having been handed to the consumer.
+type delivery struct {
+	done chan struct{}
+	at   time.Time
+}
+
+func newDelivery() *delivery {
+	return &delivery{done: make(chan struct{})}
+}
+
+// mark records the batch having been handed to the consumer. mark is a no-op
+// on a nil delivery.
+func (d *delivery) mark() {
+	if d != nil {
+		d.at = time.Now()
+		close(d.done)
+	}
+}
+
+// seq returns the sequence number to ACK once the first n events of the
+// batch have been processed. Events of the window removed from the batch
+// preceding the next event to process are ACKed as well.
+func (qb *queuedBatch) seq(n int) int {
+	switch {
+	case n >= len(qb.b.Events):
+		return qb.end
+	case qb.positions != nil:
+		return qb.positions[n]
+	default:
+		return qb.base + n
+	}
+}
+
 type defaultHandler struct {
+	id        uint64
 	cb        Eventer
 	client    net.Conn
 	reader    BatchReader
 	writer    ACKWriter
 	keepalive time.Duration
 	logging   bool
+	logger    *log.Context // logs with the connection context
+	budget    *EventBudget
+	counters  *Counters
+
+	slowConsumerTimeout time.Duration
+	autoACK             bool
+	autoACKDelay        time.Duration
+	onPanic             PanicHandler
+	onError             func(net.Conn, error)
+	auth                *TokenAuth
+	authenticated       bool
+	windowPos           int  // events of the current window delivered in previous chunks
+	seqACKs             bool // ACK sequence numbers instead of event counts
+	eventRate           *RateLimiter
+	idle                *idleConn // nil if idle connections are not closed
+	idleTimeout         time.Duration
+	pending             int32 // batches waiting for being ACKed, updated atomically
+	drop                func(event interface{}) bool
+	dedupe              *Deduplicator
+	sample              func(event interface{}) bool
+	enrich              *Enrichment
+	validate            *Validation
 
-	signal chan struct{}
-	ch     chan *lj.Batch
+	signal   chan struct{}
+	ch       chan queuedBatch
+	inflight chan struct{} // nil if number of in-flight batches is not limited
 
 	stopGuard sync.Once
+	err       error // reason the connection has been closed
 }
 
 type BatchReader interface {
@@ -45,146 +127,656 @@ type BatchReader interface {
 }
 
 type ACKWriter interface {
+	// Keepalive notifies the client of the batch still being processed. The
+	// highest sequence number processed so far is passed, such that clients
+	// can release the events processed. 0 if no progress has been made.
 	Keepalive(int) error
+
+	// ACK sends the sequence number of the last event processed. Sequence
+	// numbers less than the batch size report progress.
 	ACK(int) error
 }
 
-type ProtocolFactory func(conn net.Conn) (BatchReader, ACKWriter, error)
+// ChunkedReader is implemented by BatchReaders able to deliver the events of
+// large windows in chunks while the window is still being read.
+type ChunkedReader interface {
+	// StreamChunks registers fn receiving the chunks of a window in order. The
+	// batch returned by ReadBatch holds the remaining events of the window.
+	// Reading is aborted if fn returns an error.
+	StreamChunks(fn func(*lj.Batch) error)
+}
+
+type ProtocolFactory func(conn net.Conn, logger *log.Context) (BatchReader, ACKWriter, error)
+
+// HandlerConfig configures the default connection handler.
+type HandlerConfig struct {
+	// Keepalive configures the interval ACK(0) is send to the client while a
+	// batch is waiting for being ACKed. 0 disables keepalive.
+	Keepalive time.Duration
+
+	Logging bool
+
+	// Version is the protocol version served, added to log messages.
+	Version int
+
+	// SequenceACKs ACKs the sequence number of the last event processed,
+	// derived from lj.Batch.LastSeq, rather than the number of events of the
+	// window processed. Clients continuing the sequence across windows are
+	// ACKed the sequence numbers of their events, wrapping around after
+	// math.MaxUint32. Clients restarting the sequence at 1 with every window
+	// are ACKed the number of events processed either way.
+	SequenceACKs bool
+
+	// MaxInFlightBatches limits the number of batches being received but not
+	// yet ACKed per connection. 0 disables the limit.
+	MaxInFlightBatches int
+
+	// SlowConsumerTimeout closes the connection if a batch has not been ACKed
+	// within the given duration of being delivered, regardless of keepalives
+	// and partial ACKs. 0 disables the timeout.
+	SlowConsumerTimeout time.Duration
+
+	// AutoACK ACKs batches AutoACKDelay after being received, regardless of
+	// the batches being processed. Batches are dropped if the receive channel
+	// is full.
+	AutoACK      bool
+	AutoACKDelay time.Duration
+
+	// OnPanic is called if a panic has been recovered in the connection
+	// handler. The connection is closed after OnPanic returns. If OnPanic is
+	// nil the panic is logged.
+	OnPanic PanicHandler
+
+	// OnError is called with protocol errors, decode failures, read timeouts
+	// and frames exceeding size limits, either closing the connection or
+	// delivered as lj.InvalidEvent.
+	OnError func(conn net.Conn, err error)
+
+	// TokenAuth requires clients to authenticate with a token in the first
+	// event on a connection. The connection is closed if authentication
+	// fails. Authentication is disabled if TokenAuth is nil.
+	TokenAuth *TokenAuth
+
+	// EventsPerSecond and BytesPerSecond limit the rate events and bytes are
+	// read from the connection. Reads are delayed if a limit is exceeded,
+	// throttling the client. 0 disables the limit.
+	EventsPerSecond int
+	BytesPerSecond  int
+
+	// IdleTimeout closes the connection if no data has been read from the
+	// client and no batch has been waiting for being ACKed within the given
+	// duration. 0 disables the timeout.
+	IdleTimeout time.Duration
+
+	// Drop removes events matching Drop from batches before delivery. The
+	// events removed are ACKed with the batch. Events are not filtered if Drop
+	// is nil.
+	Drop func(event interface{}) bool
+
+	// Dedupe drops events with IDs seen before. Events are not deduplicated
+	// if Dedupe is nil.
+	Dedupe *Deduplicator
+
+	// Sample keeps a random sample of the events matched by the sampling
+	// configuration. Events are not sampled if Sample is nil.
+	Sample *Sampling
+
+	// Enrich adds fields to the events of batches before delivery. Events are
+	// not enriched if Enrich is nil.
+	Enrich *Enrichment
+
+	// Validate validates the events of batches before delivery. Events are
+	// not validated if Validate is nil.
+	Validate *Validation
+
+	// WireTap dumps the data read from matching connections. Connections are
+	// not tapped if WireTap is nil.
+	WireTap *WireTap
+}
+
+// PanicHandler is called with the connection, the recovered value and the
+// stack trace of a panic recovered in a connection handler.
+type PanicHandler func(conn net.Conn, v interface{}, stack []byte)
+
+var (
+	errSlowConsumer = lj.NewError(lj.ErrTimeout, "batch not ACKed in time")
+	errServerClosed = lj.NewError(lj.ErrClosed, "server closed")
+	errCanceled     = lj.ErrBatchCanceled
 
-func DefaultHandler(
-	keepalive time.Duration,
-	mk ProtocolFactory,
-	logging bool,
-) HandlerFactory {
+	// errStopped aborts reading a window if the handler has been stopped
+	// while delivering chunks.
+	errStopped = errors.New("connection handler stopped")
+)
+
+func DefaultHandler(cfg HandlerConfig, mk ProtocolFactory) HandlerFactory {
 	return func(cb Eventer, client net.Conn) (Handler, error) {
-		r, w, err := mk(client)
+		client = cfg.WireTap.Wrap(client, cb.ConnID())
+		client = newThrottledConn(client, NewRateLimiter(cfg.BytesPerSecond), cb.Bandwidth())
+		var idle *idleConn
+		if cfg.IdleTimeout > 0 {
+			idle = newIdleConn(client)
+			client = idle
+		}
+
+		logger := log.With(
+			log.Field{Key: "conn_id", Value: cb.ConnID()},
+			log.Field{Key: "remote_addr", Value: client.RemoteAddr()},
+			log.Field{Key: "version", Value: cfg.Version},
+		)
+		r, w, err := mk(client, logger)
 		if err != nil {
 			return nil, err
 		}
 
-		return &defaultHandler{
+		h := &defaultHandler{
+			id:        cb.ConnID(),
 			cb:        cb,
 			client:    client,
 			reader:    r,
 			writer:    w,
-			keepalive: keepalive,
+			keepalive: cfg.Keepalive,
 			signal:    make(chan struct{}),
-			ch:        make(chan *lj.Batch),
-			logging:   logging,
-		}, nil
+			ch:        make(chan queuedBatch),
+			logging:   cfg.Logging,
+			logger:    logger,
+			budget:    cb.Budget(),
+			counters:  cb.Counters(),
+
+			slowConsumerTimeout: cfg.SlowConsumerTimeout,
+			autoACK:             cfg.AutoACK,
+			autoACKDelay:        cfg.AutoACKDelay,
+			onPanic:             cfg.OnPanic,
+			onError:             cfg.OnError,
+			auth:                cfg.TokenAuth,
+			authenticated:       cfg.TokenAuth == nil,
+			eventRate:           NewRateLimiter(cfg.EventsPerSecond),
+			idle:                idle,
+			idleTimeout:         cfg.IdleTimeout,
+			drop:                cfg.Drop,
+			dedupe:              cfg.Dedupe,
+			sample:              cfg.Sample.sampler(),
+			enrich:              cfg.Enrich,
+			validate:            cfg.Validate,
+			seqACKs:             cfg.SequenceACKs,
+		}
+		if cfg.MaxInFlightBatches > 0 {
+			h.ch = make(chan queuedBatch, cfg.MaxInFlightBatches)
+			h.inflight = make(chan struct{}, cfg.MaxInFlightBatches)
+		}
+		if cr, ok := r.(ChunkedReader); ok {
+			cr.StreamChunks(h.streamChunk)
+		}
+		return h, nil
 	}
 }
 
-func (h *defaultHandler) Run() {
+func (h *defaultHandler) Run() error {
 	// start async routine for returning ACKs to client.
 	// Sends ACK of 0 every 'keepalive' seconds to signal
 	// client the batch still being in pipeline
 	go h.ackLoop()
+	if h.idle != nil {
+		go h.idleLoop()
+	}
 	if err := h.handle(); err != nil {
-		log.Println(err)
+		h.logger.Infof("%v", err)
 	}
+
+	<-h.signal
+	return h.err
 }
 
 func (h *defaultHandler) Stop() {
+	h.stopWith(errServerClosed)
+}
+
+// stopWith closes the connection, recording err as the reason the connection
+// has been closed. Only the first reason is recorded.
+func (h *defaultHandler) stopWith(err error) {
 	h.stopGuard.Do(func() {
+		h.err = lj.WrapNetError(err)
 		close(h.signal)
 		_ = h.client.Close()
 	})
 }
 
-func (h *defaultHandler) handle() error {
+func (h *defaultHandler) handle() (err error) {
 	if h.logging {
-		log.Printf("Start client handler")
-		defer log.Printf("client handler stopped")
+		h.logger.Debugf("Start client handler")
+		defer h.logger.Debugf("client handler stopped")
 	}
 	defer close(h.ch)
 	defer h.Stop()
+	defer func() {
+		if err != nil {
+			h.stopWith(err)
+		}
+	}()
+	defer h.recoverPanic()
 
 	for {
+		// 0. wait for in-flight batches being ACKed if limits are exhausted
+		if !h.acquire() {
+			return nil
+		}
+
 		// 1. read data into batch
 		b, err := h.reader.ReadBatch()
 		if err != nil {
+			if errors.Is(err, errStopped) {
+				return nil
+			}
+			if errors.Is(err, ErrInvalidSequence) {
+				h.logger.Warnf("Closing connection: %v", err)
+				h.counters.SequenceViolated()
+			}
+			h.readFailed(err)
 			return err
 		}
 
 		// read next batch if empty batch has been received
 		if b == nil {
+			h.releaseInFlight()
 			continue
 		}
 
-		// 2. push batch to ACK queue
-		select {
-		case <-h.signal:
-			return nil
-		case h.ch <- b:
+		if stop, err := h.deliver(b, true); stop || err != nil {
+			return err
 		}
+	}
+}
 
-		// 3. push batch to server receive queue:
-		if err := h.cb.OnEvents(b); err != nil {
-			return nil
+// deliver pushes a batch to the ACK queue and the server receive queue. last
+// is set if the batch completes the window, else the batch is a chunk of a
+// window still being read. Returns true if the handler must stop.
+func (h *defaultHandler) deliver(b *lj.Batch, last bool) (bool, error) {
+	// track the window positions of the events if events might be removed
+	base, end := h.windowPos, h.windowPos+len(b.Events)
+	h.windowPos = end
+	if last {
+		h.windowPos = 0
+	}
+	var positions []int
+	if !h.authenticated || h.drop != nil || h.sample != nil || h.validate != nil || h.dedupe != nil {
+		positions = make([]int, len(b.Events))
+		for i := range positions {
+			positions[i] = base + i
 		}
 	}
+
+	if !h.authenticated {
+		if err := h.auth.authenticate(b); err != nil {
+			h.logger.Warnf("Authentication failed: %v", err)
+			h.counters.AuthenticationFailed()
+			h.releaseInFlight()
+			h.stopWith(err)
+			return true, nil
+		}
+		h.authenticated = true
+		positions = positions[1:] // the token event is ACKed with the batch
+	}
+
+	h.decodeFailed(b)
+
+	// dropped events are ACKed with the batch
+	if h.drop != nil {
+		var filtered int
+		filtered, positions = dropEvents(b, positions, h.drop)
+		h.counters.EventsFiltered(filtered)
+	}
+	if h.sample != nil {
+		var sampledOut int
+		sampledOut, positions = dropEvents(b, positions, h.sample)
+		h.counters.EventsSampledOut(sampledOut)
+	}
+
+	invalid, positions, err := h.validate.Apply(b, positions)
+	if invalid > 0 {
+		h.counters.EventsInvalid(invalid)
+	}
+	if err != nil {
+		h.logger.Warnf("Closing connection: %v", err)
+		h.releaseInFlight()
+		h.stopWith(err)
+		return true, nil
+	}
+
+	// record IDs of events passing validation only, such that events of
+	// rejected batches are not dropped once retransmitted
+	if h.dedupe != nil {
+		var duplicates int
+		duplicates, positions = dropEvents(b, positions, h.dedupe.Duplicate)
+		h.counters.EventsDuplicate(duplicates)
+	}
+
+	// ACK batch only carrying the token or dropped events via the ACK queue,
+	// such that the ACK is not sent before the ACKs of previous windows still
+	// in flight, else ACK these events with the batch
+	if len(b.Events) == 0 {
+		if !last {
+			h.releaseInFlight()
+			return false, nil
+		}
+		b.ACK()
+		return h.queue(queuedBatch{b: b, end: end, lastSeq: b.LastSeq, queued: time.Now()}), nil
+	}
+
+	b.ConnID = h.id
+	h.enrich.Apply(b)
+	h.counters.BatchReceived(len(b.Events))
+	h.budget.Add(len(b.Events))
+
+	// 2. push batch to ACK queue
+	qb := queuedBatch{b: b, positions: positions, base: base, end: end, lastSeq: b.LastSeq, queued: time.Now()}
+	if h.slowConsumerTimeout > 0 {
+		qb.delivered = newDelivery()
+	}
+	if h.queue(qb) {
+		return true, nil
+	}
+
+	// 3. push batch to server receive queue:
+	if h.autoACK {
+		// ACK batch independent of the consumer, dropping the batch if the
+		// consumer does not keep up
+		if h.autoACKDelay > 0 {
+			time.AfterFunc(h.autoACKDelay, b.ACK)
+		} else {
+			b.ACK()
+		}
+		if !h.cb.OfferEvents(b) {
+			h.counters.EventsDropped(len(b.Events))
+		}
+	} else if err := h.cb.OnEvents(b, h.signal); err != nil {
+		return true, nil
+	}
+	qb.delivered.mark()
+
+	// 4. throttle client if event rate limit is exceeded
+	if !h.eventRate.Wait(len(b.Events), h.signal) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// queue pushes a batch to the ACK queue. Returns true if the handler must
+// stop.
+func (h *defaultHandler) queue(qb queuedBatch) bool {
+	atomic.AddInt32(&h.pending, 1)
+	select {
+	case <-h.signal:
+		atomic.AddInt32(&h.pending, -1)
+		h.budget.Done(len(qb.b.Events))
+		h.releaseInFlight()
+		return true
+	case h.ch <- qb:
+		return false
+	}
+}
+
+// streamChunk delivers a chunk of the window being read, waiting for
+// in-flight limits before the next chunk is read.
+func (h *defaultHandler) streamChunk(b *lj.Batch) error {
+	stop, err := h.deliver(b, false)
+	if err != nil {
+		return err
+	}
+	if stop || !h.acquire() {
+		return errStopped
+	}
+	return nil
 }
 
 func (h *defaultHandler) ackLoop() {
 	if h.logging {
-		log.Println("start client ack loop")
-		defer log.Println("client ack loop stopped")
+		h.logger.Debugf("start client ack loop")
+		defer h.logger.Debugf("client ack loop stopped")
 	}
 
 	// drain queue on shutdown.
 	// Stop ACKing batches in case of error, forcing client to reconnect
 	defer func() {
-		log.Println("drain ack loop")
-		//nolint:revive // This drains the channel.
-		for range h.ch {
+		h.logger.Debugf("drain ack loop")
+		for qb := range h.ch {
+			h.budget.Done(len(qb.b.Events))
+			h.releaseInFlight()
 		}
 	}()
+	defer h.recoverPanic()
+	defer h.flushACKs()
 
 	for {
 		select {
 		case <-h.signal: // return on client/server shutdown
 			if h.logging {
-				log.Println("receive client connection close signal")
+				h.logger.Debugf("receive client connection close signal")
 			}
 			return
-		case b, open := <-h.ch:
+		case qb, open := <-h.ch:
 			if !open {
 				return
 			}
-			if err := h.waitACK(b); err != nil {
+			err := h.waitACK(qb)
+			h.budget.Done(len(qb.b.Events))
+			h.releaseInFlight()
+			h.batchDone()
+			if err != nil {
+				if errors.Is(err, errSlowConsumer) {
+					h.logger.Warnf("Closing connection: %v", err)
+					h.counters.SlowConsumerEvicted()
+					h.stopWith(err)
+				}
+				if errors.Is(err, errCanceled) {
+					h.logger.Warnf("Closing connection: %v", err)
+					h.counters.BatchCanceled()
+					h.stopWith(err)
+				}
 				return
 			}
 		}
 	}
 }
 
-func (h *defaultHandler) waitACK(batch *lj.Batch) error {
-	n := len(batch.Events)
+// readFailed counts and reports the error closing the connection if caused
+// by the client.
+func (h *defaultHandler) readFailed(err error) {
+	err = lj.WrapNetError(err)
+	switch {
+	case errors.Is(err, lj.ErrDecode):
+		h.counters.DecodeFailed(1)
+	case errors.Is(err, lj.ErrFrameTooLarge):
+		h.counters.FrameTooLarge()
+	case errors.Is(err, lj.ErrProtocol):
+		h.counters.ProtocolError()
+	case errors.Is(err, lj.ErrTimeout):
+		h.counters.ReadTimedOut()
+	default:
+		return
+	}
+	if h.onError != nil {
+		h.onError(h.client, err)
+	}
+}
 
-	if h.keepalive <= 0 {
-		for {
-			select {
-			case <-h.signal:
-				return nil
-			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
+// decodeFailed counts and reports the events of b failing to decode.
+func (h *defaultHandler) decodeFailed(b *lj.Batch) {
+	for _, event := range b.Events {
+		if invalid, ok := event.(*lj.InvalidEvent); ok && invalid.Raw != nil {
+			h.counters.DecodeFailed(1)
+			if h.onError != nil {
+				h.onError(h.client, invalid.Err)
 			}
 		}
+	}
+}
+
+// InFlight returns the number of batches waiting for being ACKed.
+func (h *defaultHandler) InFlight() int {
+	return int(atomic.LoadInt32(&h.pending))
+}
+
+// batchDone marks a batch as no longer waiting for being ACKed. The idle
+// timeout restarts once the batch has been ACKed.
+func (h *defaultHandler) batchDone() {
+	atomic.AddInt32(&h.pending, -1)
+	if h.idle != nil {
+		h.idle.touch()
+	}
+}
+
+// idleLoop closes the connection if no data has been read from the client and
+// no batch has been waiting for being ACKed within the idle timeout.
+func (h *defaultHandler) idleLoop() {
+	timer := time.NewTimer(h.idleTimeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-h.signal:
+			return
+		case <-timer.C:
+		}
+
+		idle := h.idle.idle()
+		if idle < h.idleTimeout {
+			timer.Reset(h.idleTimeout - idle)
+			continue
+		}
+		if atomic.LoadInt32(&h.pending) > 0 {
+			timer.Reset(h.idleTimeout)
+			continue
+		}
+
+		h.logger.Infof("Closing idle connection")
+		h.counters.IdleClosed()
+		h.stopWith(errIdle)
+		return
+	}
+}
+
+// flushACKs writes ACKs coalesced by the writer.
+func (h *defaultHandler) flushACKs() {
+	if f, ok := h.writer.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+}
+
+// recoverPanic recovers from a panic in the connection handler, reports the
+// panic and closes the connection.
+func (h *defaultHandler) recoverPanic() {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	stack := debug.Stack()
+	h.counters.PanicRecovered()
+	if h.onPanic != nil {
+		h.onPanic(h.client, v, stack)
 	} else {
-		for {
-			select {
-			case <-h.signal:
-				return nil
-			case <-batch.Await():
-				// send ack
-				return h.writer.ACK(n)
-			case <-time.After(h.keepalive):
-				if err := h.writer.Keepalive(0); err != nil {
-					return err
-				}
+		h.logger.Errorf("Recovered from panic in handler: %v\n%s", v, stack)
+	}
+	h.stopWith(fmt.Errorf("panic: %v", v))
+}
+
+// acquire waits for in-flight batches and events being ACKed if limits are
+// exhausted.
+func (h *defaultHandler) acquire() bool {
+	return h.acquireInFlight() && h.budget.Wait(h.signal)
+}
+
+func (h *defaultHandler) acquireInFlight() bool {
+	if h.inflight == nil {
+		return true
+	}
+
+	select {
+	case <-h.signal:
+		return false
+	case h.inflight <- struct{}{}:
+		return true
+	}
+}
+
+func (h *defaultHandler) releaseInFlight() {
+	if h.inflight != nil {
+		<-h.inflight
+	}
+}
+
+// wireSeq converts the number of events of the window processed into the
+// sequence number sent to the client. With sequence ACKs, the sequence number
+// of the event at window position n-1 is computed using uint32 arithmetic,
+// such that ACKs of windows straddling the wrap point are correct.
+func (h *defaultHandler) wireSeq(qb queuedBatch, n int) int {
+	if !h.seqACKs {
+		return n
+	}
+	return int(qb.lastSeq - uint32(qb.end-n))
+}
+
+func (h *defaultHandler) waitACK(qb queuedBatch) error {
+	batch := qb.b
+
+	// events of the window preceding the first event of the batch (e.g. the
+	// authentication token or previous chunks of the window) have been
+	// processed already
+	n := qb.end
+	acked := qb.seq(0) // highest sequence number processed, reported by keepalives
+
+	var keepalive <-chan time.Time
+	if h.keepalive > 0 {
+		ticker := time.NewTicker(h.keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// the slow consumer timeout starts once the batch has been handed to the
+	// consumer. Batches queued behind other in-flight batches might have been
+	// delivered already.
+	var delivered <-chan struct{}
+	if qb.delivered != nil {
+		delivered = qb.delivered.done
+	}
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-h.signal:
+			return nil
+		case <-batch.Await():
+			if len(batch.Events) > 0 {
+				h.counters.BatchACKed(time.Since(qb.queued))
+			}
+			// send ack
+			return h.writer.ACK(h.wireSeq(qb, n))
+		case <-batch.Progress():
+			seq := qb.seq(batch.ACKed())
+			if seq <= acked || seq >= n {
+				continue
+			}
+			if err := h.writer.ACK(h.wireSeq(qb, seq)); err != nil {
+				return err
+			}
+			acked = seq
+		case <-keepalive:
+			if err := h.writer.Keepalive(h.wireSeq(qb, acked)); err != nil {
+				return err
 			}
+		case <-batch.Canceled():
+			return errCanceled
+		case <-delivered:
+			delivered = nil
+			timer = time.NewTimer(h.slowConsumerTimeout - time.Since(qb.delivered.at))
+			timeout = timer.C
+		case <-timeout:
+			return errSlowConsumer
 		}
 	}
 }
@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+var errIdle = lj.NewError(lj.ErrTimeout, "connection idle")
+
+// idleConn records the last time data has been read from a connection.
+type idleConn struct {
+	net.Conn
+	last int64 // unix nano timestamp of last activity, updated atomically
+}
+
+func newIdleConn(c net.Conn) *idleConn {
+	ic := &idleConn{Conn: c}
+	ic.touch()
+	return ic
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// touch marks the connection as active.
+func (c *idleConn) touch() {
+	atomic.StoreInt64(&c.last, time.Now().UnixNano())
+}
+
+// idle returns the time passed since the connection has last been active.
+func (c *idleConn) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&c.last))
+}
+
+// NetConn returns the underlying connection.
+func (c *idleConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,75 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "sync/atomic"
+
+// ConnLimiter tracks the number of active connections and optionally caps
+// the number of concurrent connections.
+type ConnLimiter struct {
+	active int64
+	block  bool
+	slots  chan struct{} // nil if unlimited
+}
+
+// NewConnLimiter creates a new ConnLimiter allowing up to max concurrent
+// connections. A max of 0 disables the limit. If block is set, Acquire waits
+// for a free slot instead of failing.
+func NewConnLimiter(max int, block bool) *ConnLimiter {
+	l := &ConnLimiter{block: block}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// Acquire reserves a connection slot. Returns false if no slot is available,
+// or, in blocking mode, if done is closed before a slot becomes available.
+func (l *ConnLimiter) Acquire(done <-chan struct{}) bool {
+	if l.slots != nil {
+		if l.block {
+			select {
+			case <-done:
+				return false
+			case l.slots <- struct{}{}:
+			}
+		} else {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				return false
+			}
+		}
+	}
+
+	atomic.AddInt64(&l.active, 1)
+	return true
+}
+
+// Release returns a slot reserved by Acquire.
+func (l *ConnLimiter) Release() {
+	atomic.AddInt64(&l.active, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// Active returns the number of currently active connections.
+func (l *ConnLimiter) Active() int {
+	return int(atomic.LoadInt64(&l.active))
+}
@@ -0,0 +1,51 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "github.com/scippio/go-lumber/lj"
+
+// ErrBatchTooLarge indicates a client announcing a batch with more events
+// than allowed.
+var ErrBatchTooLarge = lj.NewError(lj.ErrFrameTooLarge, "batch exceeds max number of events")
+
+// ErrFrameTooLarge indicates a client sending a frame larger than allowed.
+var ErrFrameTooLarge = lj.NewError(lj.ErrFrameTooLarge, "frame exceeds max size")
+
+// ReadLimits bounds the sizes read from the wire before allocating memory.
+// Zero values disable the respective limit.
+type ReadLimits struct {
+	MaxBatchEvents int
+	MaxFrameBytes  int
+}
+
+// CheckBatch returns ErrBatchTooLarge if count exceeds the max number of
+// events per batch.
+func (l ReadLimits) CheckBatch(count int) error {
+	if l.MaxBatchEvents > 0 && count > l.MaxBatchEvents {
+		return ErrBatchTooLarge
+	}
+	return nil
+}
+
+// CheckFrame returns ErrFrameTooLarge if size exceeds the max frame size.
+func (l ReadLimits) CheckFrame(size int) error {
+	if l.MaxFrameBytes > 0 && size > l.MaxFrameBytes {
+		return ErrFrameTooLarge
+	}
+	return nil
+}
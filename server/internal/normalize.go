@@ -0,0 +1,56 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/json"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// MessageField is the field holding events not being JSON objects once
+// normalized.
+const MessageField = "message"
+
+// NormalizeEvents converts all events to map[string]interface{} in place.
+// Events not being maps are stored in MessageField. Invalid and raw events are
+// kept as is.
+func NormalizeEvents(events []interface{}) {
+	for i, event := range events {
+		switch event.(type) {
+		case *lj.InvalidEvent, json.RawMessage:
+			continue
+		}
+		events[i] = normalizeEvent(event)
+	}
+}
+
+func normalizeEvent(event interface{}) map[string]interface{} {
+	switch e := event.(type) {
+	case map[string]interface{}:
+		return e
+	case map[string]string:
+		m := make(map[string]interface{}, len(e))
+		for k, v := range e {
+			m[k] = v
+		}
+		return m
+	default:
+		return map[string]interface{}{MessageField: e}
+	}
+}
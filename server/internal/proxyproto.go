@@ -0,0 +1,202 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// proxyConn is a connection with source and destination addresses read from
+// the PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	in         *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+// ErrProxyHeader indicates an invalid or missing PROXY protocol header.
+var ErrProxyHeader = lj.NewError(lj.ErrProtocol, "invalid PROXY protocol header")
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ReadProxyHeader reads the HAProxy PROXY protocol (version 1 or 2) header
+// from c. The returned connection reports the original client address as
+// remote address. Reading the header fails if it does not complete within
+// timeout. No timeout is applied if timeout is 0.
+func ReadProxyHeader(c net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		if err := c.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, err
+		}
+	}
+
+	pc := &proxyConn{
+		Conn: c,
+		in:   bufio.NewReader(c),
+	}
+
+	// check the first byte only, so to fail early on connections not
+	// sending a header at all
+	first, err := pc.in.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	case proxyV1Prefix[0]:
+		err = pc.readV1()
+	default:
+		err = ErrProxyHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func (pc *proxyConn) Read(b []byte) (int, error) {
+	return pc.in.Read(b)
+}
+
+func (pc *proxyConn) RemoteAddr() net.Addr {
+	if pc.remoteAddr != nil {
+		return pc.remoteAddr
+	}
+	return pc.Conn.RemoteAddr()
+}
+
+func (pc *proxyConn) LocalAddr() net.Addr {
+	if pc.localAddr != nil {
+		return pc.localAddr
+	}
+	return pc.Conn.LocalAddr()
+}
+
+// NetConn returns the underlying connection.
+func (pc *proxyConn) NetConn() net.Conn {
+	return pc.Conn
+}
+
+// readV1 parses the human readable header, e.g.:
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n".
+func (pc *proxyConn) readV1() error {
+	const maxLen = 107
+
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxLen {
+			return ErrProxyHeader
+		}
+		b, err := pc.in.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if len(line) <= len(proxyV1Prefix) && !bytes.HasPrefix(proxyV1Prefix, line) {
+			return ErrProxyHeader
+		}
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return ErrProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return ErrProxyHeader
+	}
+
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return ErrProxyHeader
+	}
+
+	pc.remoteAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	pc.localAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 parses the binary header.
+func (pc *proxyConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(pc.in, hdr[:]); err != nil {
+		return err
+	}
+
+	verCmd, family := hdr[12], hdr[13]
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || verCmd>>4 != 2 {
+		return ErrProxyHeader
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(pc.in, payload); err != nil {
+		return err
+	}
+
+	// LOCAL command: connection established by the proxy itself
+	if verCmd&0x0f == 0 {
+		return nil
+	}
+	if verCmd&0x0f != 1 {
+		return ErrProxyHeader
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default: // AF_UNSPEC, AF_UNIX: keep connection addresses
+		return nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return ErrProxyHeader
+	}
+	src := net.IP(payload[:ipLen])
+	dst := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(payload[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(payload[2*ipLen+2:])
+
+	pc.remoteAddr = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	pc.localAddr = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
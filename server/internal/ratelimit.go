@@ -0,0 +1,141 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket rate limiter. The bucket holds up to one
+// second worth of tokens. A nil RateLimiter is unlimited.
+type RateLimiter struct {
+	rate float64 // tokens per second
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// throttledConn limits the rate bytes are read from a connection. Time spent
+// waiting for the limiter does not count towards the read deadline.
+type throttledConn struct {
+	net.Conn
+	limiters []*RateLimiter
+
+	deadline  time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewRateLimiter creates a new RateLimiter allowing rate tokens per second.
+// Returns nil if rate is 0.
+func NewRateLimiter(rate int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &RateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Wait takes n tokens from the bucket. If the bucket is exhausted, Wait blocks
+// until the bucket has been refilled. n can exceed the bucket size. Returns
+// false if done is closed while waiting.
+func (l *RateLimiter) Wait(n int, done <-chan struct{}) bool {
+	if l == nil || n <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(time.Duration(deficit / l.rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// newThrottledConn wraps c, such that reads are limited by all non-nil
+// limiters. Returns c if all limiters are nil.
+func newThrottledConn(c net.Conn, limiters ...*RateLimiter) net.Conn {
+	var active []*RateLimiter
+	for _, l := range limiters {
+		if l != nil {
+			active = append(active, l)
+		}
+	}
+	if len(active) == 0 {
+		return c
+	}
+	return &throttledConn{Conn: c, limiters: active, closed: make(chan struct{})}
+}
+
+func (c *throttledConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		start := time.Now()
+		for _, l := range c.limiters {
+			l.Wait(n, c.closed)
+		}
+		if !c.deadline.IsZero() {
+			c.deadline = c.deadline.Add(time.Since(start))
+			_ = c.Conn.SetReadDeadline(c.deadline)
+		}
+	}
+	return n, err
+}
+
+func (c *throttledConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *throttledConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *throttledConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *throttledConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,84 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"fmt"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// ErrInvalidSequence indicates events being received with sequence numbers
+// not continuing the sequence of previously received events.
+var ErrInvalidSequence = lj.NewError(lj.ErrProtocol, "invalid event sequence number")
+
+// SequenceTracker validates the sequence numbers of events received on a
+// connection. Clients either restart the sequence at 1 with every window, or
+// continue the sequence of the previous window. The first event on a
+// connection may start with any sequence number, such that clients can resume
+// their sequence after reconnecting.
+type SequenceTracker struct {
+	last     uint32 // sequence number of the last event received
+	started  bool   // events have been received on the connection
+	inWindow bool   // events of the current window have been received
+}
+
+// StartWindow resets the tracker for validating the events of a new window.
+func (t *SequenceTracker) StartWindow() {
+	t.inWindow = false
+}
+
+// Next records the sequence number of the next event. Next returns an error
+// if seq is out of sequence. The tracker continues with seq after an error.
+// The first sequence number on a connection is accepted unconditionally, as
+// the sequence numbers used before reconnecting are unknown.
+//
+// Sequence numbers wrap around after math.MaxUint32. Clients may continue
+// with 0 or 1 after the wrap point.
+func (t *SequenceTracker) Next(seq uint32) error {
+	expected := t.last + 1
+	valid := !t.started || seq == expected ||
+		(!t.inWindow && seq == 1) || // sequence restarted with the window
+		(expected == 0 && seq == 1) // 0 skipped on wrap around
+
+	var err error
+	if !valid {
+		kind := "gap"
+		if seqBefore(seq, expected) {
+			kind = "regression"
+		}
+		err = fmt.Errorf("%w: %v (expected %v, received %v)", ErrInvalidSequence, kind, expected, seq)
+	}
+
+	t.last = seq
+	t.started = true
+	t.inWindow = true
+	return err
+}
+
+// Last returns the sequence number of the last event received.
+func (t *SequenceTracker) Last() uint32 {
+	return t.last
+}
+
+// seqBefore returns true if a precedes b using serial number arithmetic
+// (RFC 1982), such that sequence numbers right after the wrap point follow
+// the sequence numbers right before the wrap point.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
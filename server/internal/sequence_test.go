@@ -0,0 +1,130 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSequenceTrackerNext(t *testing.T) {
+	cases := map[string]struct {
+		windows [][]uint32 // sequence numbers of the events per window
+		err     string     // kind of error expected on the last event, empty if valid
+	}{
+		"first sequence number accepted": {
+			windows: [][]uint32{{42, 43}},
+		},
+		"first sequence number at wrap point": {
+			windows: [][]uint32{{math.MaxUint32, 0, 1}},
+		},
+		"restart with window": {
+			windows: [][]uint32{{1, 2, 3}, {1, 2}},
+		},
+		"continue across windows": {
+			windows: [][]uint32{{1, 2}, {3, 4}},
+		},
+		"wrap to 0 in window": {
+			windows: [][]uint32{{math.MaxUint32 - 1, math.MaxUint32, 0, 1}},
+		},
+		"wrap to 1 in window": {
+			windows: [][]uint32{{math.MaxUint32 - 1, math.MaxUint32, 1, 2}},
+		},
+		"wrap to 0 across windows": {
+			windows: [][]uint32{{math.MaxUint32 - 1, math.MaxUint32}, {0, 1}},
+		},
+		"wrap to 1 across windows": {
+			windows: [][]uint32{{math.MaxUint32 - 1, math.MaxUint32}, {1, 2}},
+		},
+		"gap": {
+			windows: [][]uint32{{1, 2, 4}},
+			err:     "gap",
+		},
+		"gap after wrap": {
+			windows: [][]uint32{{math.MaxUint32, 2}},
+			err:     "gap",
+		},
+		"regression": {
+			windows: [][]uint32{{1, 2, 3, 2}},
+			err:     "regression",
+		},
+		"regression before wrap": {
+			windows: [][]uint32{{math.MaxUint32, 0, 1, math.MaxUint32}},
+			err:     "regression",
+		},
+		"restart within window": {
+			windows: [][]uint32{{5, 6, 1}},
+			err:     "regression",
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var tracker SequenceTracker
+			var err error
+			for w, window := range tc.windows {
+				tracker.StartWindow()
+				for i, seq := range window {
+					err = tracker.Next(seq)
+					last := w == len(tc.windows)-1 && i == len(window)-1
+					if err != nil && !last {
+						t.Fatalf("unexpected error on sequence number %v: %v", seq, err)
+					}
+				}
+			}
+
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tc.err != "" && err == nil:
+				t.Fatalf("expected %v error", tc.err)
+			case tc.err != "" && (!errors.Is(err, ErrInvalidSequence) || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("expected %v error, got: %v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestSequenceACKsWrap(t *testing.T) {
+	// window of 4 events straddling the wrap point, the last event having
+	// sequence number 1
+	qb := queuedBatch{end: 4, lastSeq: 1}
+	h := &defaultHandler{seqACKs: true}
+	for n, want := range []uint32{math.MaxUint32 - 2, math.MaxUint32 - 1, math.MaxUint32, 0, 1} {
+		if got := uint32(h.wireSeq(qb, n)); got != want {
+			t.Errorf("ACK of %v events: expected %v, got %v", n, want, got)
+		}
+	}
+
+	// clients restarting the sequence with every window are ACKed the number
+	// of events processed
+	qb = queuedBatch{end: 3, lastSeq: 3}
+	for n := 0; n <= 3; n++ {
+		if got := h.wireSeq(qb, n); got != n {
+			t.Errorf("ACK of %v events: expected %v, got %v", n, n, got)
+		}
+	}
+
+	h.seqACKs = false
+	qb = queuedBatch{end: 4, lastSeq: 1}
+	if got := h.wireSeq(qb, 4); got != 4 {
+		t.Errorf("ACK without sequence ACKs: expected 4, got %v", got)
+	}
+}
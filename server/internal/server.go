@@ -19,20 +19,28 @@ package internal
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/log"
+	"github.com/scippio/go-lumber/server/audit"
 )
 
 type Server struct {
-	listener net.Listener
-	opts     Config
-	ch       chan *lj.Batch
-	ownCH    bool
-	sig      closeSignaler
+	listener  net.Listener
+	opts      Config
+	ch        chan *lj.Batch
+	ownCH     bool
+	sig       closeSignaler
+	limiter   *ConnLimiter
+	budget    *EventBudget
+	bandwidth *RateLimiter
+	counters  Counters
+	conns     connRegistry
 }
 
 type Config struct {
@@ -40,43 +48,202 @@ type Config struct {
 	Handler HandlerFactory
 	Channel chan *lj.Batch
 	Logging bool
+
+	// Version is the protocol version served, reported by Connections.
+	Version int
+
+	// MaxConnections limits the number of concurrent connections. 0 disables
+	// the limit.
+	MaxConnections int
+
+	// BlockOnMaxConnections makes Handle wait for a free connection slot,
+	// instead of closing new connections once MaxConnections is reached.
+	BlockOnMaxConnections bool
+
+	// MaxInFlightEvents limits the number of un-ACKed events across all
+	// connections. 0 disables the limit.
+	MaxInFlightEvents int
+
+	// HandshakeTimeout closes TLS connections not completing the TLS
+	// handshake in time. 0 disables the timeout.
+	HandshakeTimeout time.Duration
+
+	// Authorize is called after the TLS handshake. The connection is closed
+	// if Authorize returns an error. The TLS connection state is nil for non
+	// TLS connections.
+	Authorize func(*tls.ConnectionState) error
+
+	// ProxyProtocol requires connections to start with a PROXY protocol
+	// header. If TLS is configured, the server runs TLS on top of the
+	// connection after reading the header.
+	ProxyProtocol bool
+
+	// Audit is called when connections are accepted, closed or rejected.
+	Audit audit.Hook
+
+	// BandwidthLimit limits the total number of bytes per second read from
+	// all connections. 0 disables the limit.
+	BandwidthLimit int
+}
+
+// Shared holds resources shared between multiple servers serving
+// connections accepted from the same listener.
+type Shared struct {
+	Budget    *EventBudget
+	Bandwidth *RateLimiter
+}
+
+// SharedListener is implemented by listeners passing shared resources to the
+// servers created for them. Shared resources take precedence over the
+// resources configured via Config.
+type SharedListener interface {
+	net.Listener
+	Shared() *Shared
 }
 
 type Handler interface {
-	Run()
+	// Run serves the connection until it is closed. Run returns the reason
+	// the connection has been closed.
+	Run() error
+
 	Stop()
 }
 
 type HandlerFactory func(Eventer, net.Conn) (Handler, error)
 
 type Eventer interface {
-	OnEvents(*lj.Batch) error
+	// OnEvents forwards a batch to the server. OnEvents returns an error if
+	// the server or cancel is closed before the batch could be forwarded.
+	OnEvents(b *lj.Batch, cancel <-chan struct{}) error
+
+	// OfferEvents forwards a batch to the server without blocking. OfferEvents
+	// returns false if the server is not ready to receive the batch.
+	OfferEvents(b *lj.Batch) bool
+
+	// Budget returns the in-flight event budget shared by all connections.
+	Budget() *EventBudget
+
+	// Counters returns the server metrics.
+	Counters() *Counters
+
+	// ConnID returns the ID of the connection being served.
+	ConnID() uint64
+
+	// Bandwidth returns the ingress bandwidth limiter shared by all
+	// connections.
+	Bandwidth() *RateLimiter
 }
 
+// chanCallback forwards batches of a single connection to the servers
+// receive channel.
 type chanCallback struct {
-	done <-chan struct{}
-	ch   chan *lj.Batch
+	done      <-chan struct{}
+	ch        chan *lj.Batch
+	budget    *EventBudget
+	bandwidth *RateLimiter
+	counters  *Counters
+	id        uint64
+
+	// batches and events forwarded from the connection and the time spent
+	// blocked on forwarding (in ns), updated atomically
+	batches uint64
+	events  uint64
+	blocked uint64
 }
 
-func newChanCallback(done <-chan struct{}, ch chan *lj.Batch) *chanCallback {
-	return &chanCallback{done, ch}
+// connIDs is the process wide counter used to assign connection IDs.
+var connIDs uint64
+
+func nextConnID() uint64 {
+	return atomic.AddUint64(&connIDs, 1)
+}
+
+func newChanCallback(s *Server) *chanCallback {
+	return &chanCallback{
+		done:      s.sig.Sig(),
+		ch:        s.ch,
+		budget:    s.budget,
+		bandwidth: s.bandwidth,
+		counters:  &s.counters,
+		id:        nextConnID(),
+	}
 }
 
-func (c *chanCallback) OnEvents(b *lj.Batch) error {
+func (c *chanCallback) OnEvents(b *lj.Batch, cancel <-chan struct{}) error {
+	if c.OfferEvents(b) {
+		c.counters.ReceiveBlocked(0)
+		return nil
+	}
+
+	// receive channel is full or server is closing -> wait for consumer
+	start := time.Now()
+	defer func() {
+		blocked := time.Since(start)
+		atomic.AddUint64(&c.blocked, uint64(blocked))
+		c.counters.ReceiveBlocked(blocked)
+	}()
+
 	select {
 	case <-c.done:
 		return io.EOF
+	case <-cancel:
+		return io.EOF
 	case c.ch <- b:
+		atomic.AddUint64(&c.batches, 1)
+		atomic.AddUint64(&c.events, uint64(len(b.Events)))
 		return nil
 	}
 }
 
+func (c *chanCallback) OfferEvents(b *lj.Batch) bool {
+	select {
+	case <-c.done:
+		return false
+	case c.ch <- b:
+		atomic.AddUint64(&c.batches, 1)
+		atomic.AddUint64(&c.events, uint64(len(b.Events)))
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *chanCallback) Budget() *EventBudget {
+	return c.budget
+}
+
+func (c *chanCallback) Counters() *Counters {
+	return c.counters
+}
+
+func (c *chanCallback) ConnID() uint64 {
+	return c.id
+}
+
+func (c *chanCallback) Bandwidth() *RateLimiter {
+	return c.bandwidth
+}
+
 func NewWithListener(l net.Listener, opts Config) (*Server, error) {
 	s := &Server{
-		listener: l,
-		sig:      makeCloseSignaler(),
-		ch:       opts.Channel,
-		opts:     opts,
+		listener:  l,
+		sig:       makeCloseSignaler(),
+		ch:        opts.Channel,
+		opts:      opts,
+		limiter:   NewConnLimiter(opts.MaxConnections, opts.BlockOnMaxConnections),
+		budget:    NewEventBudget(opts.MaxInFlightEvents),
+		bandwidth: NewRateLimiter(opts.BandwidthLimit),
+	}
+
+	if sl, ok := l.(SharedListener); ok {
+		if shared := sl.Shared(); shared != nil {
+			if shared.Budget != nil {
+				s.budget = shared.Budget
+			}
+			if shared.Bandwidth != nil {
+				s.bandwidth = shared.Bandwidth
+			}
+		}
 	}
 
 	if s.ch == nil {
@@ -104,7 +271,7 @@ func ListenAndServeWith(
 
 func ListenAndServe(addr string, opts Config) (*Server, error) {
 	binder := net.Listen
-	if opts.TLS != nil {
+	if opts.TLS != nil && !opts.ProxyProtocol {
 		binder = func(network, addr string) (net.Listener, error) {
 			return tls.Listen(network, addr, opts.TLS)
 		}
@@ -138,6 +305,23 @@ func (s *Server) ReceiveChan() <-chan *lj.Batch {
 	return s.ch
 }
 
+func (s *Server) ActiveConnections() int {
+	return s.limiter.Active()
+}
+
+// Connections returns a snapshot of the metrics of all connections being
+// served, ordered by connection ID.
+func (s *Server) Connections() []ConnStats {
+	return s.conns.snapshot()
+}
+
+func (s *Server) Stats() Stats {
+	stats := s.counters.snapshot()
+	stats.ActiveConnections = s.limiter.Active()
+	stats.QueueDepth = len(s.ch)
+	return stats
+}
+
 func (s *Server) run() {
 	defer s.sig.Done()
 
@@ -147,24 +331,32 @@ func (s *Server) run() {
 			break
 		}
 		if s.opts.Logging {
-			log.Printf("New connection from %v", client.RemoteAddr())
+			log.Debugf("New connection from %v", client.RemoteAddr())
 		}
-		s.startConnHandler(client)
+		s.Handle(client)
 	}
 }
 
 func (s *Server) Handle(c net.Conn) {
-	if s.opts.Logging {
-		log.Printf("New connection from %v", c.RemoteAddr())
+	if !s.limiter.Acquire(s.sig.Sig()) {
+		if s.opts.Logging {
+			log.Warnf("Connection limit reached, closing connection from %v", c.RemoteAddr())
+		}
+		_ = c.Close()
+		return
 	}
+
 	s.startConnHandler(c)
 }
 
 func NewServer(opts Config) (*Server, error) {
 	s := &Server{
-		sig:  makeCloseSignaler(),
-		ch:   opts.Channel,
-		opts: opts,
+		sig:       makeCloseSignaler(),
+		ch:        opts.Channel,
+		opts:      opts,
+		limiter:   NewConnLimiter(opts.MaxConnections, opts.BlockOnMaxConnections),
+		budget:    NewEventBudget(opts.MaxInFlightEvents),
+		bandwidth: NewRateLimiter(opts.BandwidthLimit),
 	}
 
 	if s.ch == nil {
@@ -179,36 +371,125 @@ func NewServer(opts Config) (*Server, error) {
 }
 
 func (s *Server) startConnHandler(client net.Conn) {
-	var wgStart sync.WaitGroup
+	s.sig.Add(1)
+	go func() {
+		defer s.sig.Done()
+		defer s.limiter.Release()
+
+		// close connection if server is shut down during connection setup
+		setupDone := make(chan struct{})
+		go func() {
+			select {
+			case <-s.sig.Sig():
+				_ = client.Close()
+			case <-setupDone:
+			}
+		}()
+		conn, err := s.setupConn(client)
+		close(setupDone)
+		if err != nil {
+			AuditReject(s.opts.Audit, client, lj.WrapNetError(err))
+			_ = client.Close()
+			return
+		}
 
-	h, err := s.opts.Handler(newChanCallback(s.sig.Sig(), s.ch), client)
-	if err != nil {
 		if s.opts.Logging {
-			log.Printf("Failed to initialize client handler: %v", h)
+			log.Debugf("New connection from %v", conn.RemoteAddr())
 		}
-		return
-	}
 
-	s.sig.Add(1)
-	wgStart.Add(1)
-	stopped := make(chan struct{}, 1)
-	go func() {
-		defer s.sig.Done()
+		cb := newChanCallback(s)
+		counter := newCountingConn(conn, &s.counters)
+		conn = counter
+		s.counters.ConnectionAccepted()
+
+		h, err := s.opts.Handler(cb, conn)
+		if err != nil {
+			if s.opts.Logging {
+				log.Errorf("Failed to initialize client handler: %v", err)
+			}
+			AuditReject(s.opts.Audit, conn, err)
+			_ = conn.Close()
+			return
+		}
+
+		s.conns.add(&connState{
+			conn:      counter,
+			cb:        cb,
+			handler:   h,
+			version:   s.opts.Version,
+			connected: time.Now(),
+		})
+		defer s.conns.remove(cb.id)
+
+		stopped := make(chan struct{})
 		defer close(stopped) // signal handler loop stopped
+		go func() {
+			select {
+			case <-s.sig.Sig():
+				// server shutdown
+				h.Stop()
+
+			case <-stopped:
+				// handler loop stopped
+			}
+		}()
+
+		if s.opts.Audit == nil {
+			_ = h.Run()
+			return
+		}
 
-		wgStart.Done()
-		h.Run()
+		rec := newAuditRecord(audit.Connect, cb.id, conn)
+		start := rec.Time
+		s.opts.Audit(rec)
+
+		err = h.Run()
+		if errors.Is(err, io.EOF) {
+			err = nil // connection closed by client
+		}
+
+		rec = newAuditRecord(audit.Disconnect, cb.id, conn)
+		rec.Reason = err
+		rec.Duration = rec.Time.Sub(start)
+		rec.BytesReceived = counter.BytesRead()
+		rec.BatchesReceived = atomic.LoadUint64(&cb.batches)
+		rec.EventsReceived = atomic.LoadUint64(&cb.events)
+		s.opts.Audit(rec)
 	}()
+}
 
-	wgStart.Wait()
-	go func() {
-		select {
-		case <-s.sig.Sig():
-			// server shutdown
-			h.Stop()
+// setupConn reads the PROXY protocol header, runs the TLS handshake and
+// authorizes the connection. Plain connections are upgraded to TLS if TLS is
+// configured.
+func (s *Server) setupConn(client net.Conn) (net.Conn, error) {
+	conn := client
+	if s.opts.ProxyProtocol {
+		pc, err := ReadProxyHeader(conn, s.opts.HandshakeTimeout)
+		if err != nil {
+			if s.opts.Logging {
+				log.Warnf("Failed to read PROXY protocol header from %v: %v", client.RemoteAddr(), err)
+			}
+			return nil, err
+		}
+		conn = pc
+	}
+	if s.opts.TLS != nil && unwrapTLS(conn) == nil {
+		conn = tls.Server(conn, s.opts.TLS)
+	}
 
-		case <-stopped:
-			// handler loop stopped
+	if err := Handshake(conn, s.opts.HandshakeTimeout); err != nil {
+		if s.opts.Logging {
+			log.Warnf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
 		}
-	}()
+		return nil, err
+	}
+
+	if s.opts.Authorize != nil {
+		if err := s.opts.Authorize(TLSConnectionState(conn)); err != nil {
+			log.Warnf("Connection from %v not authorized: %v", conn.RemoteAddr(), err)
+			s.counters.AuthorizationFailed()
+			return nil, lj.WrapError(lj.ErrAuth, err)
+		}
+	}
+	return conn, nil
 }
@@ -0,0 +1,38 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "time"
+
+// StampEvents sets field to the receive time t in all events being maps and
+// lacking the field. The time is formatted as RFC 3339 in UTC.
+func StampEvents(events []interface{}, field string, t time.Time) {
+	ts := t.UTC().Format(time.RFC3339Nano)
+	for _, event := range events {
+		switch e := event.(type) {
+		case map[string]interface{}:
+			if _, exists := e[field]; !exists {
+				e[field] = ts
+			}
+		case map[string]string:
+			if _, exists := e[field]; !exists {
+				e[field] = ts
+			}
+		}
+	}
+}
@@ -0,0 +1,377 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats provides a snapshot of server metrics.
+type Stats struct {
+	// ActiveConnections is the number of client connections currently being
+	// served.
+	ActiveConnections int `json:"active_connections"`
+
+	// BatchesReceived counts the batches read from clients.
+	BatchesReceived uint64 `json:"batches_received"`
+
+	// EventsReceived counts the events read from clients.
+	EventsReceived uint64 `json:"events_received"`
+
+	// ConnectionsAccepted counts the client connections served.
+	ConnectionsAccepted uint64 `json:"connections_accepted"`
+
+	// BytesReceived counts the bytes read from clients.
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// ACKLatency is the distribution of the time batches take to be ACKed
+	// once delivered.
+	ACKLatency Histogram `json:"ack_latency"`
+
+	// ReceiveBlocked is the distribution of the time handlers spend blocked
+	// on forwarding batches to the receive channel.
+	ReceiveBlocked Histogram `json:"receive_blocked"`
+
+	// QueueDepth is the number of batches waiting in the receive channel.
+	QueueDepth int `json:"queue_depth"`
+
+	// SlowConsumerEvictions counts the connections closed due to batches not
+	// being ACKed within the configured timeout.
+	SlowConsumerEvictions uint64 `json:"slow_consumer_evictions"`
+
+	// CanceledBatches counts the connections closed due to batches being
+	// canceled by the consumer.
+	CanceledBatches uint64 `json:"canceled_batches"`
+
+	// RecoveredPanics counts the panics recovered in connection handlers.
+	RecoveredPanics uint64 `json:"recovered_panics"`
+
+	// AuthorizationFailures counts the connections closed due to failed
+	// authorization.
+	AuthorizationFailures uint64 `json:"authorization_failures"`
+
+	// AuthenticationFailures counts the connections closed due to missing or
+	// invalid authentication tokens.
+	AuthenticationFailures uint64 `json:"authentication_failures"`
+
+	// SequenceViolations counts the connections closed due to events being
+	// received out of sequence.
+	SequenceViolations uint64 `json:"sequence_violations"`
+
+	// IdleConnectionsClosed counts the connections closed due to no traffic
+	// within the configured idle timeout.
+	IdleConnectionsClosed uint64 `json:"idle_connections_closed"`
+
+	// UnknownVersions counts the connections closed due to the client sending
+	// a protocol version not enabled in the server.
+	UnknownVersions uint64 `json:"unknown_versions"`
+
+	// InvalidEvents counts the events failing validation.
+	InvalidEvents uint64 `json:"invalid_events"`
+
+	// FilteredEvents counts the events dropped by the configured filter.
+	FilteredEvents uint64 `json:"filtered_events"`
+
+	// SampledOutEvents counts the events dropped by sampling.
+	SampledOutEvents uint64 `json:"sampled_out_events"`
+
+	// DuplicateEvents counts the events dropped due to their ID having been
+	// seen before.
+	DuplicateEvents uint64 `json:"duplicate_events"`
+
+	// DroppedEvents counts the events ACKed in auto-ACK mode, but dropped due
+	// to the receive channel being full.
+	DroppedEvents uint64 `json:"dropped_events"`
+
+	// ProtocolErrors counts the connections closed due to clients violating
+	// the protocol.
+	ProtocolErrors uint64 `json:"protocol_errors"`
+
+	// DecodeErrors counts the events failing to decode, whether delivered as
+	// lj.InvalidEvent or closing the connection.
+	DecodeErrors uint64 `json:"decode_errors"`
+
+	// ReadTimeouts counts the connections closed due to reads timing out.
+	ReadTimeouts uint64 `json:"read_timeouts"`
+
+	// OversizedFrames counts the connections closed due to frames or batches
+	// exceeding a size limit.
+	OversizedFrames uint64 `json:"oversized_frames"`
+}
+
+// Add returns the sum of s and o.
+func (s Stats) Add(o Stats) Stats {
+	return Stats{
+		ActiveConnections:      s.ActiveConnections + o.ActiveConnections,
+		BatchesReceived:        s.BatchesReceived + o.BatchesReceived,
+		EventsReceived:         s.EventsReceived + o.EventsReceived,
+		ConnectionsAccepted:    s.ConnectionsAccepted + o.ConnectionsAccepted,
+		BytesReceived:          s.BytesReceived + o.BytesReceived,
+		ACKLatency:             s.ACKLatency.Add(o.ACKLatency),
+		ReceiveBlocked:         s.ReceiveBlocked.Add(o.ReceiveBlocked),
+		QueueDepth:             s.QueueDepth + o.QueueDepth,
+		SlowConsumerEvictions:  s.SlowConsumerEvictions + o.SlowConsumerEvictions,
+		CanceledBatches:        s.CanceledBatches + o.CanceledBatches,
+		RecoveredPanics:        s.RecoveredPanics + o.RecoveredPanics,
+		AuthorizationFailures:  s.AuthorizationFailures + o.AuthorizationFailures,
+		AuthenticationFailures: s.AuthenticationFailures + o.AuthenticationFailures,
+		SequenceViolations:     s.SequenceViolations + o.SequenceViolations,
+		IdleConnectionsClosed:  s.IdleConnectionsClosed + o.IdleConnectionsClosed,
+		UnknownVersions:        s.UnknownVersions + o.UnknownVersions,
+		InvalidEvents:          s.InvalidEvents + o.InvalidEvents,
+		FilteredEvents:         s.FilteredEvents + o.FilteredEvents,
+		SampledOutEvents:       s.SampledOutEvents + o.SampledOutEvents,
+		DuplicateEvents:        s.DuplicateEvents + o.DuplicateEvents,
+		DroppedEvents:          s.DroppedEvents + o.DroppedEvents,
+		ProtocolErrors:         s.ProtocolErrors + o.ProtocolErrors,
+		DecodeErrors:           s.DecodeErrors + o.DecodeErrors,
+		ReadTimeouts:           s.ReadTimeouts + o.ReadTimeouts,
+		OversizedFrames:        s.OversizedFrames + o.OversizedFrames,
+	}
+}
+
+// Counters collects server metrics. Counters are updated atomically.
+type Counters struct {
+	batchesReceived        uint64
+	eventsReceived         uint64
+	connectionsAccepted    uint64
+	bytesReceived          uint64
+	ackLatency             latencyCounters
+	receiveBlocked         latencyCounters
+	slowConsumerEvictions  uint64
+	canceledBatches        uint64
+	recoveredPanics        uint64
+	authorizationFailures  uint64
+	authenticationFailures uint64
+	sequenceViolations     uint64
+	idleConnectionsClosed  uint64
+	invalidEvents          uint64
+	filteredEvents         uint64
+	sampledOutEvents       uint64
+	duplicateEvents        uint64
+	droppedEvents          uint64
+	protocolErrors         uint64
+	decodeErrors           uint64
+	readTimeouts           uint64
+	oversizedFrames        uint64
+}
+
+// BatchReceived counts a batch of n events read from a client.
+func (c *Counters) BatchReceived(n int) {
+	atomic.AddUint64(&c.batchesReceived, 1)
+	atomic.AddUint64(&c.eventsReceived, uint64(n))
+}
+
+// ConnectionAccepted counts a client connection being served.
+func (c *Counters) ConnectionAccepted() {
+	atomic.AddUint64(&c.connectionsAccepted, 1)
+}
+
+// BytesRead counts n bytes read from a client.
+func (c *Counters) BytesRead(n int) {
+	atomic.AddUint64(&c.bytesReceived, uint64(n))
+}
+
+// BatchACKed records the time a batch took to be ACKed once delivered.
+func (c *Counters) BatchACKed(d time.Duration) {
+	c.ackLatency.observe(d)
+}
+
+// ReceiveBlocked records the time a handler was blocked on forwarding a batch
+// to the receive channel.
+func (c *Counters) ReceiveBlocked(d time.Duration) {
+	c.receiveBlocked.observe(d)
+}
+
+// SlowConsumerEvicted counts a connection closed due to batches not being
+// ACKed in time.
+func (c *Counters) SlowConsumerEvicted() {
+	atomic.AddUint64(&c.slowConsumerEvictions, 1)
+}
+
+// BatchCanceled counts a connection closed due to a batch being canceled.
+func (c *Counters) BatchCanceled() {
+	atomic.AddUint64(&c.canceledBatches, 1)
+}
+
+// PanicRecovered counts a panic recovered in a connection handler.
+func (c *Counters) PanicRecovered() {
+	atomic.AddUint64(&c.recoveredPanics, 1)
+}
+
+// AuthorizationFailed counts a connection closed due to failed authorization.
+func (c *Counters) AuthorizationFailed() {
+	atomic.AddUint64(&c.authorizationFailures, 1)
+}
+
+// AuthenticationFailed counts a connection closed due to failed
+// authentication.
+func (c *Counters) AuthenticationFailed() {
+	atomic.AddUint64(&c.authenticationFailures, 1)
+}
+
+// SequenceViolated counts a connection closed due to events being received
+// out of sequence.
+func (c *Counters) SequenceViolated() {
+	atomic.AddUint64(&c.sequenceViolations, 1)
+}
+
+// IdleClosed counts a connection closed due to being idle.
+func (c *Counters) IdleClosed() {
+	atomic.AddUint64(&c.idleConnectionsClosed, 1)
+}
+
+// EventsInvalid counts n events failing validation.
+func (c *Counters) EventsInvalid(n int) {
+	atomic.AddUint64(&c.invalidEvents, uint64(n))
+}
+
+// EventsFiltered counts n events dropped by the filter.
+func (c *Counters) EventsFiltered(n int) {
+	atomic.AddUint64(&c.filteredEvents, uint64(n))
+}
+
+// EventsSampledOut counts n events dropped by sampling.
+func (c *Counters) EventsSampledOut(n int) {
+	atomic.AddUint64(&c.sampledOutEvents, uint64(n))
+}
+
+// EventsDuplicate counts n events dropped as duplicates.
+func (c *Counters) EventsDuplicate(n int) {
+	atomic.AddUint64(&c.duplicateEvents, uint64(n))
+}
+
+// EventsDropped counts n events dropped in auto-ACK mode.
+func (c *Counters) EventsDropped(n int) {
+	atomic.AddUint64(&c.droppedEvents, uint64(n))
+}
+
+// ProtocolError counts a connection closed due to a protocol violation.
+func (c *Counters) ProtocolError() {
+	atomic.AddUint64(&c.protocolErrors, 1)
+}
+
+// DecodeFailed counts n events failing to decode.
+func (c *Counters) DecodeFailed(n int) {
+	atomic.AddUint64(&c.decodeErrors, uint64(n))
+}
+
+// ReadTimedOut counts a connection closed due to a read timeout.
+func (c *Counters) ReadTimedOut() {
+	atomic.AddUint64(&c.readTimeouts, 1)
+}
+
+// FrameTooLarge counts a connection closed due to a frame or batch exceeding
+// a size limit.
+func (c *Counters) FrameTooLarge() {
+	atomic.AddUint64(&c.oversizedFrames, 1)
+}
+
+func (c *Counters) snapshot() Stats {
+	return Stats{
+		BatchesReceived:        atomic.LoadUint64(&c.batchesReceived),
+		EventsReceived:         atomic.LoadUint64(&c.eventsReceived),
+		ConnectionsAccepted:    atomic.LoadUint64(&c.connectionsAccepted),
+		BytesReceived:          atomic.LoadUint64(&c.bytesReceived),
+		ACKLatency:             c.ackLatency.snapshot(),
+		ReceiveBlocked:         c.receiveBlocked.snapshot(),
+		SlowConsumerEvictions:  atomic.LoadUint64(&c.slowConsumerEvictions),
+		CanceledBatches:        atomic.LoadUint64(&c.canceledBatches),
+		RecoveredPanics:        atomic.LoadUint64(&c.recoveredPanics),
+		AuthorizationFailures:  atomic.LoadUint64(&c.authorizationFailures),
+		AuthenticationFailures: atomic.LoadUint64(&c.authenticationFailures),
+		SequenceViolations:     atomic.LoadUint64(&c.sequenceViolations),
+		IdleConnectionsClosed:  atomic.LoadUint64(&c.idleConnectionsClosed),
+		InvalidEvents:          atomic.LoadUint64(&c.invalidEvents),
+		FilteredEvents:         atomic.LoadUint64(&c.filteredEvents),
+		SampledOutEvents:       atomic.LoadUint64(&c.sampledOutEvents),
+		DuplicateEvents:        atomic.LoadUint64(&c.duplicateEvents),
+		DroppedEvents:          atomic.LoadUint64(&c.droppedEvents),
+		ProtocolErrors:         atomic.LoadUint64(&c.protocolErrors),
+		DecodeErrors:           atomic.LoadUint64(&c.decodeErrors),
+		ReadTimeouts:           atomic.LoadUint64(&c.readTimeouts),
+		OversizedFrames:        atomic.LoadUint64(&c.oversizedFrames),
+	}
+}
+
+// latencyCounters counts durations per latency bucket, updated atomically.
+type latencyCounters struct {
+	counts [len(latencyBounds) + 1]uint64
+	sum    uint64 // in ns
+}
+
+// latencyBounds are the upper bounds of the latency buckets in seconds.
+var latencyBounds = [...]float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30}
+
+func (l *latencyCounters) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d.Seconds() > latencyBounds[i] {
+		i++
+	}
+	atomic.AddUint64(&l.counts[i], 1)
+	atomic.AddUint64(&l.sum, uint64(d))
+}
+
+func (l *latencyCounters) snapshot() Histogram {
+	h := Histogram{
+		Bounds: append([]float64(nil), latencyBounds[:]...),
+		Counts: make([]uint64, len(l.counts)),
+		Sum:    time.Duration(atomic.LoadUint64(&l.sum)).Seconds(),
+	}
+	for i := range l.counts {
+		h.Counts[i] = atomic.LoadUint64(&l.counts[i])
+		h.Count += h.Counts[i]
+	}
+	return h
+}
+
+// Histogram is a snapshot of a distribution of durations.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets in seconds.
+	Bounds []float64 `json:"bounds"`
+
+	// Counts are the number of observations per bucket. The last bucket
+	// counts the observations exceeding the last bound.
+	Counts []uint64 `json:"counts"`
+
+	Sum   float64 `json:"sum"` // Sum of all observations in seconds.
+	Count uint64  `json:"count"`
+}
+
+// Add returns the sum of h and o. Both histograms must have the same bounds
+// or be empty.
+func (h Histogram) Add(o Histogram) Histogram {
+	if len(h.Counts) == 0 {
+		return o
+	}
+	if len(o.Counts) == 0 {
+		return h
+	}
+
+	sum := Histogram{
+		Bounds: h.Bounds,
+		Counts: make([]uint64, len(h.Counts)),
+		Sum:    h.Sum + o.Sum,
+		Count:  h.Count + o.Count,
+	}
+	for i := range sum.Counts {
+		sum.Counts[i] = h.Counts[i] + o.Counts[i]
+	}
+	return sum
+}
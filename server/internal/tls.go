@@ -0,0 +1,151 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// TLSConnectionState returns the TLS connection state of c, unwrapping
+// connections wrapped by the server. Returns nil if c is not a TLS connection
+// or the TLS handshake has not been completed yet.
+func TLSConnectionState(c net.Conn) *tls.ConnectionState {
+	tlsConn := unwrapTLS(c)
+	if tlsConn == nil {
+		return nil
+	}
+
+	s := tlsConn.ConnectionState()
+	if !s.HandshakeComplete {
+		return nil
+	}
+	return &s
+}
+
+// Handshake runs the TLS handshake if c is a TLS connection. The handshake
+// fails if it does not complete within timeout. No timeout is applied if
+// timeout is 0.
+func Handshake(c net.Conn, timeout time.Duration) error {
+	tlsConn := unwrapTLS(c)
+	if tlsConn == nil {
+		return nil
+	}
+
+	if timeout > 0 {
+		if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+			return err
+		}
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return c.SetDeadline(time.Time{})
+}
+
+// IsTLS returns true if c is or wraps a TLS connection.
+func IsTLS(c net.Conn) bool {
+	return unwrapTLS(c) != nil
+}
+
+// unwrapTLS returns the TLS connection wrapped by c. Returns nil if c is not a
+// TLS connection.
+func unwrapTLS(c net.Conn) *tls.Conn {
+	for c != nil {
+		switch conn := c.(type) {
+		case *tls.Conn:
+			return conn
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// TLSSettings overrides security relevant settings of a TLS configuration.
+// Zero values keep the settings of the original configuration.
+type TLSSettings struct {
+	MinVersion       uint16
+	CipherSuites     []uint16
+	CurvePreferences []tls.CurveID
+	NextProtos       []string
+}
+
+// SecureTLSSettings returns hardened TLS settings requiring TLS 1.2 or newer
+// with forward secrecy and AEAD cipher suites only.
+func SecureTLSSettings() TLSSettings {
+	return TLSSettings{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+	}
+}
+
+// IsZero returns true if no setting is overridden.
+func (s TLSSettings) IsZero() bool {
+	return s.MinVersion == 0 && len(s.CipherSuites) == 0 && len(s.CurvePreferences) == 0 &&
+		len(s.NextProtos) == 0
+}
+
+// Apply returns a copy of c with the settings applied. Configurations
+// returned by c.GetConfigForClient are updated as well.
+func (s TLSSettings) Apply(c *tls.Config) *tls.Config {
+	if c == nil || s.IsZero() {
+		return c
+	}
+
+	c = c.Clone()
+	s.apply(c)
+	if getConfig := c.GetConfigForClient; getConfig != nil {
+		c.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cc, err := getConfig(hello)
+			if err != nil || cc == nil {
+				return cc, err
+			}
+			cc = cc.Clone()
+			s.apply(cc)
+			return cc, nil
+		}
+	}
+	return c
+}
+
+func (s TLSSettings) apply(c *tls.Config) {
+	if s.MinVersion != 0 {
+		c.MinVersion = s.MinVersion
+	}
+	if len(s.CipherSuites) > 0 {
+		c.CipherSuites = s.CipherSuites
+	}
+	if len(s.CurvePreferences) > 0 {
+		c.CurvePreferences = s.CurvePreferences
+	}
+	if len(s.NextProtos) > 0 {
+		c.NextProtos = s.NextProtos
+	}
+}
@@ -0,0 +1,91 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import "github.com/scippio/go-lumber/lj"
+
+// ValidationPolicy determines how events failing validation are handled.
+type ValidationPolicy int
+
+const (
+	// ValidationFail closes the connection if an event fails validation. The
+	// batch is not delivered.
+	ValidationFail ValidationPolicy = iota
+
+	// ValidationDrop removes events failing validation from the batch. Dropped
+	// events are ACKed with the batch.
+	ValidationDrop
+
+	// ValidationDeadLetter delivers events failing validation as
+	// *lj.InvalidEvent, holding the event and the validation error.
+	ValidationDeadLetter
+)
+
+// Validation validates the events of batches before delivery.
+type Validation struct {
+	Validate func(event interface{}) error
+	Policy   ValidationPolicy
+}
+
+// Apply validates the events of b, handling events failing validation
+// according to the policy. Returns the number of events failing validation,
+// the window positions of the events kept and the error closing the
+// connection if the policy is ValidationFail. positions holds the window
+// positions of the events of b, nil if not tracked. Events failing to decode
+// are not validated. Apply is a no-op if v is nil.
+func (v *Validation) Apply(b *lj.Batch, positions []int) (invalid int, kept []int, err error) {
+	if v == nil || v.Validate == nil {
+		return 0, positions, nil
+	}
+
+	keep := b.Events[:0]
+	keepPositions := positions[:0]
+	var sizes []int
+	if len(b.EventSizes) == len(b.Events) {
+		sizes = b.EventSizes[:0]
+	}
+	for i, event := range b.Events {
+		if _, skip := event.(*lj.InvalidEvent); !skip {
+			if err := v.Validate(event); err != nil {
+				invalid++
+				switch v.Policy {
+				case ValidationDrop:
+					continue
+				case ValidationDeadLetter:
+					event = &lj.InvalidEvent{Event: event, Err: err}
+				default:
+					return invalid, positions, &lj.Error{Kind: lj.ErrProtocol, Msg: "event failed validation", Err: err}
+				}
+			}
+		}
+
+		keep = append(keep, event)
+		if sizes != nil {
+			sizes = append(sizes, b.EventSizes[i])
+		}
+		if positions != nil {
+			keepPositions = append(keepPositions, positions[i])
+		}
+	}
+
+	b.Events = keep
+	if sizes != nil {
+		b.EventSizes = sizes
+	}
+	return invalid, keepPositions, nil
+}
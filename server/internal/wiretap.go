@@ -0,0 +1,113 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package internal
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// WireTap writes the data read from connections matching a filter to a dump
+// writer, for analyzing interoperability problems with clients.
+//
+// Each read is written as a record of the read time in nanoseconds since the
+// Unix epoch (8 bytes), the connection ID (8 bytes) and the length of the data
+// (4 bytes), followed by the data. Integers are big endian.
+type WireTap struct {
+	w     io.Writer
+	match func(net.Addr) bool
+}
+
+// tapRecordHeader is the size of the record header preceding the data.
+const tapRecordHeader = 20
+
+// NewWireTap creates a WireTap writing to w. Connections are tapped if match
+// returns true for the remote address, or all connections if match is nil.
+// Returns nil if w is nil.
+func NewWireTap(w io.Writer, match func(net.Addr) bool) *WireTap {
+	if w == nil {
+		return nil
+	}
+	return &WireTap{w: SyncWriter(w), match: match}
+}
+
+// Wrap returns conn tapping reads if the remote address of conn matches. id is
+// the connection ID written with each record.
+func (t *WireTap) Wrap(conn net.Conn, id uint64) net.Conn {
+	if t == nil || (t.match != nil && !t.match(conn.RemoteAddr())) {
+		return conn
+	}
+	return &tapConn{Conn: conn, tap: t, id: id}
+}
+
+func (t *WireTap) record(id uint64, data []byte) {
+	rec := make([]byte, tapRecordHeader+len(data))
+	binary.BigEndian.PutUint64(rec, uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint64(rec[8:], id)
+	binary.BigEndian.PutUint32(rec[16:], uint32(len(data)))
+	copy(rec[tapRecordHeader:], data)
+
+	// tapping is best effort, failing writes must not affect the connection
+	_, _ = t.w.Write(rec)
+}
+
+type tapConn struct {
+	net.Conn
+	tap *WireTap
+	id  uint64
+}
+
+func (c *tapConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.tap.record(c.id, b[:n])
+	}
+	return n, err
+}
+
+// NetConn returns the underlying connection.
+func (c *tapConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// SyncWriter returns a writer serializing writes to w, such that writes from
+// several connections do not interleave. Writers returned by SyncWriter are
+// returned as is. Returns nil if w is nil.
+func SyncWriter(w io.Writer) io.Writer {
+	if w == nil {
+		return nil
+	}
+	if _, ok := w.(*syncWriter); ok {
+		return w
+	}
+	return &syncWriter{w: w}
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
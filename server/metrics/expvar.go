@@ -0,0 +1,31 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package metrics
+
+import "expvar"
+
+// Publish publishes the metrics of src as expvar variable name, such that the
+// metrics are served as JSON document by the /debug/vars endpoint next to the
+// runtime memory statistics.
+//
+// Like expvar.Publish, Publish panics if name is already in use.
+func Publish(name string, src StatsSource) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return src.Stats()
+	}))
+}
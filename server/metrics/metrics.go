@@ -0,0 +1,125 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package metrics exports the metrics of lumberjack servers in the Prometheus
+// text exposition format, such that servers can be scraped by Prometheus
+// without additional dependencies.
+//
+// All metrics are prefixed with "lumberjack_". Serve the metrics via Handler,
+// or via the /metrics endpoint of the admin package.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/scippio/go-lumber/server"
+)
+
+// StatsSource is implemented by lumberjack servers providing metrics.
+type StatsSource interface {
+	Stats() server.Stats
+}
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name  string
+	kind  string // counter or gauge
+	help  string
+	value func(s *server.Stats) float64
+}
+
+var metrics = []metric{
+	{"connections_accepted_total", "counter", "Client connections served.", func(s *server.Stats) float64 { return float64(s.ConnectionsAccepted) }},
+	{"active_connections", "gauge", "Client connections currently being served.", func(s *server.Stats) float64 { return float64(s.ActiveConnections) }},
+	{"batches_received_total", "counter", "Batches read from clients.", func(s *server.Stats) float64 { return float64(s.BatchesReceived) }},
+	{"events_received_total", "counter", "Events read from clients.", func(s *server.Stats) float64 { return float64(s.EventsReceived) }},
+	{"bytes_received_total", "counter", "Bytes read from clients.", func(s *server.Stats) float64 { return float64(s.BytesReceived) }},
+	{"queue_depth", "gauge", "Batches waiting in the receive channel.", func(s *server.Stats) float64 { return float64(s.QueueDepth) }},
+	{"protocol_errors_total", "counter", "Connections closed due to protocol violations.", func(s *server.Stats) float64 { return float64(s.ProtocolErrors) }},
+	{"decode_errors_total", "counter", "Events failing to decode.", func(s *server.Stats) float64 { return float64(s.DecodeErrors) }},
+	{"read_timeouts_total", "counter", "Connections closed due to read timeouts.", func(s *server.Stats) float64 { return float64(s.ReadTimeouts) }},
+	{"oversized_frames_total", "counter", "Connections closed due to frames exceeding size limits.", func(s *server.Stats) float64 { return float64(s.OversizedFrames) }},
+	{"slow_consumer_evictions_total", "counter", "Connections closed due to batches not being ACKed in time.", func(s *server.Stats) float64 { return float64(s.SlowConsumerEvictions) }},
+	{"canceled_batches_total", "counter", "Connections closed due to batches being canceled.", func(s *server.Stats) float64 { return float64(s.CanceledBatches) }},
+	{"recovered_panics_total", "counter", "Panics recovered in connection handlers.", func(s *server.Stats) float64 { return float64(s.RecoveredPanics) }},
+	{"authorization_failures_total", "counter", "Connections closed due to failed authorization.", func(s *server.Stats) float64 { return float64(s.AuthorizationFailures) }},
+	{"authentication_failures_total", "counter", "Connections closed due to failed authentication.", func(s *server.Stats) float64 { return float64(s.AuthenticationFailures) }},
+	{"sequence_violations_total", "counter", "Connections closed due to events out of sequence.", func(s *server.Stats) float64 { return float64(s.SequenceViolations) }},
+	{"idle_connections_closed_total", "counter", "Connections closed due to being idle.", func(s *server.Stats) float64 { return float64(s.IdleConnectionsClosed) }},
+	{"unknown_versions_total", "counter", "Connections closed due to unknown protocol versions.", func(s *server.Stats) float64 { return float64(s.UnknownVersions) }},
+	{"invalid_events_total", "counter", "Events failing validation.", func(s *server.Stats) float64 { return float64(s.InvalidEvents) }},
+	{"filtered_events_total", "counter", "Events dropped by the filter.", func(s *server.Stats) float64 { return float64(s.FilteredEvents) }},
+	{"sampled_out_events_total", "counter", "Events dropped by sampling.", func(s *server.Stats) float64 { return float64(s.SampledOutEvents) }},
+	{"duplicate_events_total", "counter", "Events dropped as duplicates.", func(s *server.Stats) float64 { return float64(s.DuplicateEvents) }},
+	{"dropped_events_total", "counter", "Events dropped in auto-ACK mode.", func(s *server.Stats) float64 { return float64(s.DroppedEvents) }},
+}
+
+// Write writes stats to w in the Prometheus text exposition format.
+func Write(w io.Writer, stats server.Stats) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		writeHeader(bw, m.name, m.kind, m.help)
+		writeSample(bw, m.name, "", m.value(&stats))
+	}
+
+	writeHistogram(bw, "ack_latency_seconds",
+		"Time batches take to be ACKed once delivered.", stats.ACKLatency)
+	writeHistogram(bw, "receive_blocked_seconds",
+		"Time handlers are blocked on forwarding batches to the receive channel.", stats.ReceiveBlocked)
+
+	return bw.Flush()
+}
+
+// Handler returns a HTTP handler serving the metrics of src in the Prometheus
+// text exposition format.
+func Handler(src StatsSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = Write(w, src.Stats())
+	})
+}
+
+func writeHeader(w *bufio.Writer, name, kind, help string) {
+	_, _ = w.WriteString("# HELP lumberjack_" + name + " " + help + "\n")
+	_, _ = w.WriteString("# TYPE lumberjack_" + name + " " + kind + "\n")
+}
+
+func writeHistogram(w *bufio.Writer, name, help string, h server.Histogram) {
+	writeHeader(w, name, "histogram", help)
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		writeSample(w, name+"_bucket", `le="`+le+`"`, float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", `le="+Inf"`, float64(h.Count))
+	writeSample(w, name+"_sum", "", h.Sum)
+	writeSample(w, name+"_count", "", float64(h.Count))
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	_, _ = w.WriteString("lumberjack_" + name)
+	if labels != "" {
+		_, _ = w.WriteString("{" + labels + "}")
+	}
+	_, _ = w.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
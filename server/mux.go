@@ -18,17 +18,23 @@
 package server
 
 import (
-	"errors"
 	"net"
+	"sync"
+
+	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/server/internal"
 )
 
 type muxListener struct {
 	net.Listener
-	ch chan net.Conn
+	ch     chan net.Conn
+	shared *internal.Shared
 }
 
 type muxConn struct {
 	net.Conn
+	onClose   func()
+	closeOnce sync.Once
 }
 
 type versionConn struct {
@@ -38,14 +44,14 @@ type versionConn struct {
 }
 
 // ErrListenerClosed indicates the multiplexing network listener being closed.
-var ErrListenerClosed = errors.New("listener closed")
+var ErrListenerClosed = lj.NewError(lj.ErrClosed, "listener closed")
 
-func newMuxListener(l net.Listener) *muxListener {
-	return &muxListener{l, make(chan net.Conn, 1)}
+func newMuxListener(l net.Listener, shared *internal.Shared) *muxListener {
+	return &muxListener{l, make(chan net.Conn, 1), shared}
 }
 
-func newEmptyMuxListener() *muxListener {
-	return &muxListener{nil, make(chan net.Conn, 1)}
+func newEmptyMuxListener(shared *internal.Shared) *muxListener {
+	return &muxListener{nil, make(chan net.Conn, 1), shared}
 }
 
 // Accept waits for and returns the next connection to the listener.
@@ -57,6 +63,12 @@ func (l *muxListener) Accept() (net.Conn, error) {
 	return conn, nil
 }
 
+// Shared returns the resources shared by all servers multiplexed on the
+// listener.
+func (l *muxListener) Shared() *internal.Shared {
+	return l.shared
+}
+
 // Close closes the listener.
 // Any blocked Accept operations will be unblocked and return errors.
 func (l *muxListener) Close() error {
@@ -64,13 +76,29 @@ func (l *muxListener) Close() error {
 	return nil
 }
 
-func newMuxConn(v byte, c net.Conn) *muxConn {
-	mc := &muxConn{}
+func newMuxConn(v byte, c net.Conn, onClose func()) *muxConn {
+	mc := &muxConn{onClose: onClose}
 	vc := &versionConn{c, mc, v}
 	mc.Conn = vc
 	return mc
 }
 
+// NetConn returns the underlying connection.
+func (mc *muxConn) NetConn() net.Conn {
+	if vc, ok := mc.Conn.(*versionConn); ok {
+		return vc.Conn
+	}
+	return mc.Conn
+}
+
+// Close closes the connection. The onClose callback is run once the
+// connection has been closed.
+func (mc *muxConn) Close() error {
+	err := mc.Conn.Close()
+	mc.closeOnce.Do(mc.onClose)
+	return err
+}
+
 func (vc *versionConn) Read(buf []byte) (int, error) {
 	if len(buf) == 0 {
 		return 0, nil
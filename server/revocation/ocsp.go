@@ -0,0 +1,376 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package revocation
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/sha1" // register SHA-1 for OCSP certificate IDs
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/log"
+)
+
+// OCSP checks certificates by querying the OCSP responders named in the
+// certificates authority information access extension. Responses are cached
+// until their next update time. Certificates not naming an OCSP responder are
+// accepted.
+type OCSP struct {
+	client   *http.Client
+	softFail bool
+
+	mu    sync.Mutex
+	cache map[string]ocspStatus
+}
+
+type ocspStatus struct {
+	revoked    bool
+	nextUpdate time.Time
+}
+
+// ErrOCSP indicates no valid OCSP response being available for a certificate.
+var ErrOCSP = lj.NewError(lj.ErrAuth, "OCSP check failed")
+
+// maxOCSPResponseSize limits the size of OCSP responses read from responders.
+const maxOCSPResponseSize = 1 << 20
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidBasicResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+)
+
+var signatureAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	algo x509.SignatureAlgorithm
+}{
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}, x509.SHA1WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, x509.SHA256WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, x509.SHA384WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, x509.SHA512WithRSA},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 1}, x509.ECDSAWithSHA1},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, x509.ECDSAWithSHA256},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, x509.ECDSAWithSHA384},
+	{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, x509.ECDSAWithSHA512},
+	{asn1.ObjectIdentifier{1, 3, 101, 112}, x509.PureEd25519},
+}
+
+// ASN.1 structures of RFC 6960 OCSP requests and responses.
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []singleRequest
+}
+
+type singleRequest struct {
+	CertID certID
+}
+
+type certID struct {
+	HashAlgorithm  pkix.AlgorithmIdentifier
+	IssuerNameHash []byte
+	IssuerKeyHash  []byte
+	SerialNumber   *big.Int
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    responseData
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type responseData struct {
+	Raw         asn1.RawContent
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []singleResponse
+}
+
+type singleResponse struct {
+	CertID     certID
+	Good       asn1.Flag   `asn1:"tag:0,optional"`
+	Revoked    revokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag   `asn1:"tag:2,optional"`
+	ThisUpdate time.Time   `asn1:"generalized"`
+	NextUpdate time.Time   `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// NewOCSP creates an OCSP checker, querying responders with the given
+// timeout. If softFail is set, certificates are accepted if no valid response
+// can be obtained from any responder, logging the failure. Otherwise these
+// certificates are rejected with ErrOCSP.
+func NewOCSP(timeout time.Duration, softFail bool) *OCSP {
+	return &OCSP{
+		client:   &http.Client{Timeout: timeout},
+		softFail: softFail,
+		cache:    map[string]ocspStatus{},
+	}
+}
+
+// Check returns ErrRevoked if the OCSP responder of cert reports cert as
+// revoked.
+func (o *OCSP) Check(cert, issuer *x509.Certificate) error {
+	if len(cert.OCSPServer) == 0 {
+		return nil
+	}
+
+	id, err := newCertID(cert, issuer)
+	if err != nil {
+		return o.fail(cert, err)
+	}
+	key := string(id.IssuerKeyHash) + "/" + cert.SerialNumber.String()
+
+	now := time.Now()
+	o.mu.Lock()
+	status, cached := o.cache[key]
+	o.mu.Unlock()
+	if !cached || !now.Before(status.nextUpdate) {
+		status, err = o.query(cert, issuer, id)
+		if err != nil {
+			return o.fail(cert, err)
+		}
+		o.store(key, status)
+	}
+
+	if status.revoked {
+		return fmt.Errorf("%w: serial %v", ErrRevoked, cert.SerialNumber)
+	}
+	return nil
+}
+
+func (o *OCSP) fail(cert *x509.Certificate, err error) error {
+	if o.softFail {
+		log.Warnf("OCSP check of certificate %v (serial %v) failed, accepting certificate: %v",
+			cert.Subject, cert.SerialNumber, err)
+		return nil
+	}
+	return fmt.Errorf("%w: serial %v: %v", ErrOCSP, cert.SerialNumber, err)
+}
+
+// store caches status until its next update time, removing expired entries.
+// Responses without next update time are not cached.
+func (o *OCSP) store(key string, status ocspStatus) {
+	if status.nextUpdate.IsZero() {
+		return
+	}
+
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for k, st := range o.cache {
+		if !now.Before(st.nextUpdate) {
+			delete(o.cache, k)
+		}
+	}
+	o.cache[key] = status
+}
+
+func (o *OCSP) query(cert, issuer *x509.Certificate, id certID) (ocspStatus, error) {
+	req, err := asn1.Marshal(ocspRequest{TBSRequest: tbsRequest{RequestList: []singleRequest{{CertID: id}}}})
+	if err != nil {
+		return ocspStatus{}, err
+	}
+
+	for _, server := range cert.OCSPServer {
+		var resp []byte
+		resp, err = o.post(server, req)
+		if err != nil {
+			continue
+		}
+
+		var status ocspStatus
+		status, err = parseOCSPResponse(resp, id, issuer, time.Now())
+		if err != nil {
+			err = fmt.Errorf("invalid response from %v: %w", server, err)
+			continue
+		}
+		return status, nil
+	}
+	return ocspStatus{}, err
+}
+
+func (o *OCSP) post(server string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder %v returned %v", server, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize))
+}
+
+func newCertID(cert, issuer *x509.Certificate) (certID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return certID{}, err
+	}
+
+	nameHash := crypto.SHA1.New()
+	nameHash.Write(issuer.RawSubject)
+	keyHash := crypto.SHA1.New()
+	keyHash.Write(spki.PublicKey.RightAlign())
+
+	return certID{
+		HashAlgorithm:  pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		IssuerNameHash: nameHash.Sum(nil),
+		IssuerKeyHash:  keyHash.Sum(nil),
+		SerialNumber:   cert.SerialNumber,
+	}, nil
+}
+
+func (id certID) matches(other certID) bool {
+	return id.HashAlgorithm.Algorithm.Equal(other.HashAlgorithm.Algorithm) &&
+		bytes.Equal(id.IssuerNameHash, other.IssuerNameHash) &&
+		bytes.Equal(id.IssuerKeyHash, other.IssuerKeyHash) &&
+		id.SerialNumber.Cmp(other.SerialNumber) == 0
+}
+
+// parseOCSPResponse parses and verifies the OCSP response for id, the
+// response being signed by issuer or a responder certificate issued by
+// issuer. Responses past their next update time are rejected.
+func parseOCSPResponse(der []byte, id certID, issuer *x509.Certificate, now time.Time) (ocspStatus, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(der, &resp); err != nil {
+		return ocspStatus{}, err
+	} else if len(rest) > 0 {
+		return ocspStatus{}, errors.New("trailing data after OCSP response")
+	}
+	if resp.Status != 0 {
+		return ocspStatus{}, fmt.Errorf("responder status %d", resp.Status)
+	}
+	if !resp.Response.ResponseType.Equal(oidBasicResponse) {
+		return ocspStatus{}, fmt.Errorf("unsupported response type %v", resp.Response.ResponseType)
+	}
+
+	var basic basicResponse
+	if _, err := asn1.Unmarshal(resp.Response.Response, &basic); err != nil {
+		return ocspStatus{}, err
+	}
+	signer, err := responseSigner(&basic, issuer, now)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	algo := x509.UnknownSignatureAlgorithm
+	for _, a := range signatureAlgorithms {
+		if a.oid.Equal(basic.SignatureAlgorithm.Algorithm) {
+			algo = a.algo
+			break
+		}
+	}
+	if algo == x509.UnknownSignatureAlgorithm {
+		return ocspStatus{}, fmt.Errorf("unsupported signature algorithm %v", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(algo, basic.TBSResponseData.Raw, basic.Signature.RightAlign()); err != nil {
+		return ocspStatus{}, err
+	}
+
+	for _, r := range basic.TBSResponseData.Responses {
+		if !r.CertID.matches(id) {
+			continue
+		}
+		if now.Before(r.ThisUpdate) {
+			return ocspStatus{}, fmt.Errorf("response not valid before %v", r.ThisUpdate.Format(time.RFC3339))
+		}
+		if !r.NextUpdate.IsZero() && now.After(r.NextUpdate) {
+			return ocspStatus{}, fmt.Errorf("response expired at %v", r.NextUpdate.Format(time.RFC3339))
+		}
+
+		switch {
+		case bool(r.Good):
+			return ocspStatus{nextUpdate: r.NextUpdate}, nil
+		case !r.Revoked.RevocationTime.IsZero():
+			return ocspStatus{revoked: true, nextUpdate: r.NextUpdate}, nil
+		default:
+			return ocspStatus{}, errors.New("certificate status unknown")
+		}
+	}
+	return ocspStatus{}, errors.New("no response for certificate")
+}
+
+// responseSigner returns the certificate signing the OCSP response. Responses
+// are signed by the issuer directly, or by a responder certificate issued by
+// the issuer and authorized for OCSP signing.
+func responseSigner(basic *basicResponse, issuer *x509.Certificate, now time.Time) (*x509.Certificate, error) {
+	if len(basic.Certificates) == 0 {
+		return issuer, nil
+	}
+
+	cert, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Equal(issuer) {
+		return issuer, nil
+	}
+
+	if err := cert.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("responder certificate not issued by %v: %w", issuer.Subject, err)
+	}
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, errors.New("responder certificate expired or not yet valid")
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("responder certificate not authorized for OCSP signing")
+}
@@ -0,0 +1,240 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package revocation provides client certificate revocation checking for
+// lumberjack servers.
+//
+// Checkers are installed via tls.Config.VerifyConnection or the servers
+// Authorize option:
+//
+//	crl, err := revocation.NewCRL("/etc/pki/clients.crl", time.Minute)
+//	...
+//	s, err := server.ListenAndServe(addr,
+//		server.TLS(tlsConfig),
+//		server.Authorize(revocation.Authorize(crl)))
+//
+// OCSP checks certificates by querying the OCSP responders named in the
+// certificates. Custom checkers can be implemented via the Checker interface.
+package revocation
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/log"
+)
+
+// Checker checks certificates for revocation.
+type Checker interface {
+	// Check returns an error if cert, issued by issuer, has been revoked.
+	Check(cert, issuer *x509.Certificate) error
+}
+
+// CheckerFunc adapts a function to the Checker interface.
+type CheckerFunc func(cert, issuer *x509.Certificate) error
+
+// CRL checks certificates against the certificate revocation lists read from
+// a file. The file is checked for changes at most once per refresh interval.
+// If reloading fails, the previously loaded lists are kept.
+type CRL struct {
+	path    string
+	refresh time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	lists   []*crlList
+}
+
+type crlList struct {
+	rawIssuer []byte
+	list      *x509.RevocationList
+	revoked   map[string]struct{}
+}
+
+// ErrRevoked indicates a certificate has been revoked.
+var ErrRevoked = lj.NewError(lj.ErrAuth, "certificate revoked")
+
+// ErrNoCRL indicates the CRL file not containing any revocation list.
+var ErrNoCRL = errors.New("no certificate revocation list found")
+
+// ErrStaleCRL indicates the revocation lists of an issuer being past their
+// next update time. Certificates of the issuer are rejected until an updated
+// revocation list is loaded.
+var ErrStaleCRL = lj.NewError(lj.ErrAuth, "certificate revocation list expired")
+
+// Check calls f(cert, issuer).
+func (f CheckerFunc) Check(cert, issuer *x509.Certificate) error {
+	return f(cert, issuer)
+}
+
+// NewCRL loads the PEM or DER encoded certificate revocation lists from path.
+// The file is reloaded on change, checking for changes at most once per
+// refresh interval. Reloading is disabled if refresh is 0.
+func NewCRL(path string, refresh time.Duration) (*CRL, error) {
+	c := &CRL{path: path, refresh: refresh}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check returns ErrRevoked if cert has been revoked by a revocation list
+// signed by issuer. Certificates for issuers without revocation list are
+// accepted. ErrStaleCRL is returned if all revocation lists of issuer are
+// past their next update time.
+func (c *CRL) Check(cert, issuer *x509.Certificate) error {
+	c.mu.Lock()
+	c.reloadIfDue()
+	lists := c.lists
+	c.mu.Unlock()
+
+	now := time.Now()
+	var stale *crlList
+	fresh := false
+	for _, l := range lists {
+		if !bytes.Equal(l.rawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := l.list.CheckSignatureFrom(issuer); err != nil {
+			continue
+		}
+		if _, revoked := l.revoked[cert.SerialNumber.String()]; revoked {
+			return fmt.Errorf("%w: serial %v", ErrRevoked, cert.SerialNumber)
+		}
+		if next := l.list.NextUpdate; !next.IsZero() && now.After(next) {
+			stale = l
+		} else {
+			fresh = true
+		}
+	}
+	if stale != nil && !fresh {
+		return fmt.Errorf("%w: issuer %v, next update %v", ErrStaleCRL,
+			issuer.Subject, stale.list.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (c *CRL) reloadIfDue() {
+	if c.refresh <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(c.checked) < c.refresh {
+		return
+	}
+	c.checked = now
+
+	info, err := os.Stat(c.path)
+	if err != nil || info.ModTime().Equal(c.modTime) {
+		return
+	}
+	if err := c.load(); err != nil {
+		log.Errorf("Failed to reload CRL %v, keep using previous CRL: %v", c.path, err)
+	}
+}
+
+func (c *CRL) load() error {
+	info, err := os.Stat(c.path)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+
+	var ders [][]byte
+	for rest := content; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type == "X509 CRL" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		ders = [][]byte{content} // assume DER encoding
+	}
+
+	lists := make([]*crlList, 0, len(ders))
+	for _, der := range ders {
+		list, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return err
+		}
+
+		revoked := make(map[string]struct{}, len(list.RevokedCertificates))
+		for _, entry := range list.RevokedCertificates {
+			revoked[entry.SerialNumber.String()] = struct{}{}
+		}
+		lists = append(lists, &crlList{rawIssuer: list.RawIssuer, list: list, revoked: revoked})
+	}
+	if len(lists) == 0 {
+		return ErrNoCRL
+	}
+
+	c.lists = lists
+	c.modTime = info.ModTime()
+	c.checked = time.Now()
+	return nil
+}
+
+// VerifyConnection returns a function for use with
+// tls.Config.VerifyConnection, checking all certificates in the verified
+// client certificate chains with each checker.
+func VerifyConnection(checkers ...Checker) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		return check(&cs, checkers)
+	}
+}
+
+// Authorize returns a function for use with the servers Authorize option,
+// checking all certificates in the verified client certificate chains with
+// each checker. Non-TLS connections are accepted.
+func Authorize(checkers ...Checker) func(*tls.ConnectionState) error {
+	return func(cs *tls.ConnectionState) error {
+		if cs == nil {
+			return nil
+		}
+		return check(cs, checkers)
+	}
+}
+
+func check(cs *tls.ConnectionState, checkers []Checker) error {
+	for _, chain := range cs.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			for _, checker := range checkers {
+				if err := checker.Check(chain[i], chain[i+1]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -19,13 +19,21 @@ package server
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/log"
+	protov1 "github.com/scippio/go-lumber/protocol/v1"
+	protov2 "github.com/scippio/go-lumber/protocol/v2"
+	"github.com/scippio/go-lumber/server/audit"
+	"github.com/scippio/go-lumber/server/internal"
 	v1 "github.com/scippio/go-lumber/server/v1"
 	v2 "github.com/scippio/go-lumber/server/v2"
 )
@@ -44,6 +52,20 @@ type Server interface {
 	// receiver channel returned from ReceiveChan().
 	Close() error
 
+	// ActiveConnections returns the number of client connections currently
+	// being served.
+	ActiveConnections() int
+
+	// Stats returns a snapshot of the server metrics.
+	Stats() Stats
+
+	// Connections returns a snapshot of the metrics of all connections being
+	// served, ordered by connection ID.
+	Connections() []ConnStats
+
+	// StatsJSON returns a snapshot of the server metrics as JSON document.
+	StatsJSON() ([]byte, error)
+
 	Handle(net.Conn)
 }
 
@@ -56,6 +78,52 @@ type server struct {
 
 	netListener net.Listener
 	mux         []muxServer
+	limiter     *internal.ConnLimiter
+	logging     bool
+
+	handshakeTimeout time.Duration
+	sniffTimeout     time.Duration
+	proxyProtocol    bool
+	tls              *tls.Config
+	audit            audit.Hook
+	onUnknownVersion func(v byte, addr net.Addr)
+
+	unknownVersions uint64 // updated atomically
+}
+
+// Stats provides a snapshot of server metrics.
+type Stats = internal.Stats
+
+// ConnStats provides a snapshot of the metrics of a client connection.
+type ConnStats = internal.ConnStats
+
+// Histogram provides a snapshot of a distribution of durations.
+type Histogram = internal.Histogram
+
+// TokenValidator validates authentication tokens presented by clients.
+type TokenValidator = internal.TokenValidator
+
+// TokenValidatorFunc adapts a function to the TokenValidator interface.
+type TokenValidatorFunc = internal.TokenValidatorFunc
+
+// Enrichment configures the fields added to events by Enrich.
+type Enrichment = internal.Enrichment
+
+// ValidationPolicy determines how events failing validation are handled.
+type ValidationPolicy = internal.ValidationPolicy
+
+// Policies handling events failing validation, see Validate.
+const (
+	ValidationFail       = internal.ValidationFail
+	ValidationDrop       = internal.ValidationDrop
+	ValidationDeadLetter = internal.ValidationDeadLetter
+)
+
+// alpnVersions maps ALPN protocol names to the protocol version code sent by
+// clients.
+var alpnVersions = map[string]byte{
+	protov1.ALPN: protov1.CodeVersion,
+	protov2.ALPN: protov2.CodeVersion,
 }
 
 type muxServer struct {
@@ -68,6 +136,14 @@ type muxServer struct {
 // when instantiating a server.
 var ErrNoVersionEnabled = errors.New("no protocol version enabled")
 
+// ErrUnsupportedVersion indicates a client using a protocol version not
+// enabled in the server.
+var ErrUnsupportedVersion = lj.NewError(lj.ErrProtocol, "unsupported protocol version")
+
+// ErrProtocolMismatch indicates a client using a protocol version other than
+// the version negotiated via ALPN.
+var ErrProtocolMismatch = lj.NewError(lj.ErrProtocol, "protocol version does not match ALPN")
+
 // NewWithListener creates a new Server using an existing net.Listener. Use
 // options V1 and V2 to enable wanted protocol versions.
 func NewWithListener(l net.Listener, opts ...Option) (Server, error) {
@@ -103,7 +179,7 @@ func ListenAndServe(addr string, opts ...Option) (Server, error) {
 	}
 
 	binder := net.Listen
-	if o.tls != nil {
+	if o.tls != nil && !o.proxyProtocol {
 		binder = func(network, addr string) (net.Listener, error) {
 			return tls.Listen(network, addr, o.tls)
 		}
@@ -136,6 +212,40 @@ func (s *server) ReceiveChan() <-chan *lj.Batch {
 	return s.ch
 }
 
+// ActiveConnections returns the number of client connections currently being
+// served.
+func (s *server) ActiveConnections() int {
+	return s.limiter.Active()
+}
+
+// Stats returns a snapshot of the server metrics.
+func (s *server) Stats() Stats {
+	var stats Stats
+	for _, m := range s.mux {
+		stats = stats.Add(m.server.Stats())
+	}
+	stats.ActiveConnections = s.limiter.Active()
+	stats.QueueDepth = len(s.ch) // receive channel is shared by all servers
+	stats.UnknownVersions = atomic.LoadUint64(&s.unknownVersions)
+	return stats
+}
+
+// Connections returns a snapshot of the metrics of all connections being
+// served, ordered by connection ID.
+func (s *server) Connections() []ConnStats {
+	var conns []ConnStats
+	for _, m := range s.mux {
+		conns = append(conns, m.server.Connections()...)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// StatsJSON returns a snapshot of the server metrics as JSON document.
+func (s *server) StatsJSON() ([]byte, error) {
+	return json.Marshal(s.Stats())
+}
+
 // Receive returns the next received batch from the receiver channel.
 // Batches returned by Receive must be ACKed.
 func (s *server) Receive() *lj.Batch {
@@ -160,7 +270,19 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 	var servers []func(net.Listener) (Server, byte, error)
 
 	if cfg.logging {
-		log.Printf("Server config: %#v", cfg)
+		log.Debugf("Server config: %#v", cfg)
+	}
+
+	// connections of both protocol versions are tapped into the same writer
+	wireTap := internal.SyncWriter(cfg.wireTap)
+
+	// The connection limit and PROXY protocol header are handled by the
+	// multiplexer if more than one protocol version is enabled.
+	maxConns := cfg.maxConns
+	proxyProtocol := cfg.proxyProtocol
+	if cfg.v1 && cfg.v2 {
+		maxConns = 0
+		proxyProtocol = false
 	}
 
 	if cfg.v1 {
@@ -169,19 +291,98 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 				v1.Timeout(cfg.timeout),
 				v1.Channel(cfg.ch),
 				v1.TLS(cfg.tls),
-				v1.Logging(cfg.logging))
+				v1.Logging(cfg.logging),
+				v1.MaxConnections(maxConns),
+				v1.BlockOnMaxConnections(cfg.blockOnMaxConns),
+				v1.MaxInFlightEvents(cfg.maxInFlight),
+				v1.MaxInFlightBatches(cfg.maxInFlightBatches),
+				v1.SlowConsumerTimeout(cfg.slowConsumerTimeout),
+				v1.AutoACK(cfg.autoACK, cfg.autoACKDelay),
+				v1.IdleTimeout(cfg.idleTimeout),
+				v1.OnPanic(cfg.onPanic),
+				v1.OnError(cfg.onError),
+				v1.HandshakeTimeout(cfg.handshakeTimeout),
+				v1.Authorize(cfg.authorize),
+				v1.ProxyProtocol(proxyProtocol),
+				v1.TokenAuth(cfg.tokenField, cfg.tokenValidator),
+				v1.Audit(cfg.audit),
+				v1.RateLimit(cfg.eventsPerSecond, cfg.bytesPerSecond),
+				v1.BandwidthLimit(cfg.bandwidthLimit),
+				v1.MaxDecompressedBytes(cfg.maxDecompressedBytes),
+				v1.MaxBatchEvents(cfg.maxBatchEvents),
+				v1.MaxFrameBytes(cfg.maxFrameBytes),
+				v1.ReadBufferSize(cfg.readBufferSize),
+				v1.DecodeJSONFields(cfg.jsonFields...),
+				v1.NormalizeEvents(cfg.normalize),
+				v1.ReceivedAt(cfg.receivedAt),
+				v1.Enrich(cfg.enrichment()),
+				v1.Validate(cfg.validate, cfg.validatePolicy),
+				v1.DropEvents(cfg.drop),
+				v1.Deduplicate(cfg.dedupeField, cfg.dedupeSize, cfg.dedupeWindow),
+				v1.WireTap(wireTap, cfg.wireTapMatch),
+				v1.Sample(cfg.sampleRate, cfg.sampleMatch),
+				v1.PoolEvents(cfg.poolEvents),
+				v1.RetainCompressed(cfg.retainCompressed),
+				v1.CoalesceACKs(cfg.ackFlushWindow, cfg.ackFlushMax),
+				v1.IncrementalTimeout(!cfg.batchTimeout))
 			return s, '1', err
 		})
 	}
 	if cfg.v2 {
 		servers = append(servers, func(l net.Listener) (Server, byte, error) {
-			s, err := v2.NewWithListener(l,
+			v2opts := []v2.Option{
 				v2.Keepalive(cfg.keepalive),
 				v2.Timeout(cfg.timeout),
 				v2.Channel(cfg.ch),
 				v2.TLS(cfg.tls),
 				v2.JSONDecoder(cfg.decoder),
-				v2.Logging(cfg.logging))
+				v2.Logging(cfg.logging),
+				v2.MaxConnections(maxConns),
+				v2.BlockOnMaxConnections(cfg.blockOnMaxConns),
+				v2.MaxInFlightEvents(cfg.maxInFlight),
+				v2.MaxInFlightBatches(cfg.maxInFlightBatches),
+				v2.SlowConsumerTimeout(cfg.slowConsumerTimeout),
+				v2.AutoACK(cfg.autoACK, cfg.autoACKDelay),
+				v2.IdleTimeout(cfg.idleTimeout),
+				v2.OnPanic(cfg.onPanic),
+				v2.OnError(cfg.onError),
+				v2.HandshakeTimeout(cfg.handshakeTimeout),
+				v2.Authorize(cfg.authorize),
+				v2.ProxyProtocol(proxyProtocol),
+				v2.TokenAuth(cfg.tokenField, cfg.tokenValidator),
+				v2.Audit(cfg.audit),
+				v2.RateLimit(cfg.eventsPerSecond, cfg.bytesPerSecond),
+				v2.BandwidthLimit(cfg.bandwidthLimit),
+				v2.MaxDecompressedBytes(cfg.maxDecompressedBytes),
+				v2.MaxBatchEvents(cfg.maxBatchEvents),
+				v2.MaxFrameBytes(cfg.maxFrameBytes),
+				v2.ReadBufferSize(cfg.readBufferSize),
+				v2.NormalizeEvents(cfg.normalize),
+				v2.ReceivedAt(cfg.receivedAt),
+				v2.Enrich(cfg.enrichment()),
+				v2.Validate(cfg.validate, cfg.validatePolicy),
+				v2.DropEvents(cfg.drop),
+				v2.Deduplicate(cfg.dedupeField, cfg.dedupeSize, cfg.dedupeWindow),
+				v2.WireTap(wireTap, cfg.wireTapMatch),
+				v2.Sample(cfg.sampleRate, cfg.sampleMatch),
+				v2.PoolEvents(cfg.poolEvents),
+				v2.RetainCompressed(cfg.retainCompressed),
+				v2.Zstd(cfg.zstd),
+				v2.Codecs(cfg.codecs...),
+				v2.EventCodecs(cfg.eventCodecs...),
+				v2.Protobuf(cfg.protobuf),
+				v2.StreamChunks(cfg.chunkSize),
+				v2.DecodeWorkers(cfg.decodeWorkers),
+				v2.CoalesceACKs(cfg.ackFlushWindow, cfg.ackFlushMax),
+				v2.StrictSequence(cfg.strictSeq),
+				v2.IncrementalTimeout(!cfg.batchTimeout),
+				v2.RawEvents(cfg.rawEvents),
+				v2.Events(cfg.factory),
+			}
+			if cfg.decodeErrors {
+				v2opts = append(v2opts, v2.ContinueOnDecodeError(cfg.deadLetter))
+			}
+			s, err := v2.NewWithListener(l, v2opts...)
 			return s, '2', err
 		})
 	}
@@ -200,11 +401,16 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 		cfg.ch = make(chan *lj.Batch, 128)
 	}
 
+	shared := &internal.Shared{
+		Budget:    internal.NewEventBudget(cfg.maxInFlight),
+		Bandwidth: internal.NewRateLimiter(cfg.bandwidthLimit),
+	}
+
 	mux := make([]muxServer, len(servers))
 	for i, mk := range servers {
-		muxL := newEmptyMuxListener()
+		muxL := newEmptyMuxListener(shared)
 		if cfg.logging {
-			log.Printf("mk: %v", i)
+			log.Debugf("mk: %v", i)
 		}
 		s, b, err := mk(muxL)
 		if err != nil {
@@ -224,6 +430,15 @@ func newServer(l net.Listener, opts ...Option) (Server, error) {
 		netListener: l,
 		mux:         mux,
 		done:        make(chan struct{}),
+		limiter:     internal.NewConnLimiter(cfg.maxConns, cfg.blockOnMaxConns),
+		logging:     cfg.logging,
+
+		handshakeTimeout: cfg.handshakeTimeout,
+		sniffTimeout:     cfg.sniffTimeout,
+		proxyProtocol:    cfg.proxyProtocol,
+		tls:              cfg.tls,
+		audit:            cfg.audit,
+		onUnknownVersion: cfg.onUnknownVersion,
 	}
 	// s.wg.Add(1)
 	// go s.run()
@@ -251,6 +466,14 @@ func (s *server) run() {
 }
 
 func (s *server) handle(client net.Conn) {
+	if !s.limiter.Acquire(s.done) {
+		if s.logging {
+			log.Warnf("Connection limit reached, closing connection from %v", client.RemoteAddr())
+		}
+		client.Close()
+		return
+	}
+
 	// read first byte and decide multiplexer
 
 	sig := make(chan struct{})
@@ -258,23 +481,72 @@ func (s *server) handle(client net.Conn) {
 	go func() {
 		defer close(sig)
 
-		var buf [1]byte
-		if _, err := io.ReadFull(client, buf[:]); err != nil {
+		conn := client
+		reject := func(err error) {
+			internal.AuditReject(s.audit, conn, lj.WrapNetError(err))
 			client.Close()
+			s.limiter.Release()
+		}
+
+		if s.proxyProtocol {
+			pc, err := internal.ReadProxyHeader(client, s.handshakeTimeout)
+			if err != nil {
+				if s.logging {
+					log.Warnf("Failed to read PROXY protocol header from %v: %v", client.RemoteAddr(), err)
+				}
+				reject(err)
+				return
+			}
+			conn = pc
+		}
+		if s.tls != nil && !internal.IsTLS(conn) {
+			conn = tls.Server(conn, s.tls)
+		}
+
+		if err := internal.Handshake(conn, s.handshakeTimeout); err != nil {
+			if s.logging {
+				log.Warnf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+			}
+			reject(err)
 			return
 		}
 
+		buf, err := s.sniff(conn)
+		if err != nil {
+			if s.logging {
+				log.Warnf("Failed to read protocol version from %v: %v", conn.RemoteAddr(), err)
+			}
+			reject(err)
+			return
+		}
+
+		// the protocol version negotiated via ALPN must match the version
+		// sent by the client
+		if state := internal.TLSConnectionState(conn); state != nil && state.NegotiatedProtocol != "" {
+			if v, ok := alpnVersions[state.NegotiatedProtocol]; !ok || v != buf[0] {
+				if s.logging {
+					log.Warnf("Protocol version mismatch for ALPN %v from %v", state.NegotiatedProtocol, conn.RemoteAddr())
+				}
+				reject(ErrProtocolMismatch)
+				return
+			}
+		}
+
 		for _, m := range s.mux {
 			if m.mux != buf[0] {
 				continue
 			}
 
-			conn := newMuxConn(buf[0], client)
-			m.l.ch <- conn
-			m.server.Handle(conn)
+			m.server.Handle(newMuxConn(buf[0], conn, s.limiter.Release))
 			return
 		}
-		client.Close()
+
+		log.Warnf("Closing connection from %v: unsupported protocol version %q", conn.RemoteAddr(), buf[0])
+		atomic.AddUint64(&s.unknownVersions, 1)
+		if s.onUnknownVersion != nil {
+			s.onUnknownVersion(buf[0], conn.RemoteAddr())
+		}
+		reject(ErrUnsupportedVersion)
 	}()
 
 	go func() {
@@ -286,3 +558,23 @@ func (s *server) handle(client net.Conn) {
 		}
 	}()
 }
+
+// sniff reads the protocol version sent by the client. The connection is
+// closed if the version is not received within the sniff timeout.
+func (s *server) sniff(conn net.Conn) ([1]byte, error) {
+	var buf [1]byte
+	if s.sniffTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(s.sniffTimeout)); err != nil {
+			return buf, err
+		}
+	}
+	if _, err := io.ReadFull(conn, buf[:]); err != nil {
+		return buf, err
+	}
+	if s.sniffTimeout > 0 {
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
@@ -0,0 +1,173 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package spiffe integrates lumberjack servers with SPIFFE workload identities.
+//
+// The server TLS identity is sourced from a Source, typically backed by the
+// SPIFFE Workload API. The current SVID is requested on every TLS handshake,
+// such that SVID rotation is handled automatically. Clients must present an
+// X.509 SVID of an accepted trust domain, verified against the trust bundle of
+// the client's trust domain.
+//
+// This package has no dependency on the go-spiffe SDK. A
+// workloadapi.X509Source can be adapted to Source with a few lines of code.
+package spiffe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+
+	"github.com/scippio/go-lumber/lj"
+)
+
+// Source provides the X.509 SVID of the server and the X.509 trust bundles
+// used for verifying client SVIDs.
+type Source interface {
+	// SVID returns the current X.509 SVID of the server.
+	SVID() (*tls.Certificate, error)
+
+	// Bundle returns the X.509 authorities of trustDomain.
+	Bundle(trustDomain string) ([]*x509.Certificate, error)
+}
+
+// Authorizer authorizes a client by its verified SPIFFE ID.
+type Authorizer func(id *url.URL) error
+
+// ErrInvalidSVID indicates a certificate not being a valid X.509 SVID.
+var ErrInvalidSVID = lj.NewError(lj.ErrAuth, "invalid X.509 SVID")
+
+// ErrUnauthorized indicates a SPIFFE ID not being authorized.
+var ErrUnauthorized = lj.NewError(lj.ErrAuth, "SPIFFE ID not authorized")
+
+// ServerTLSConfig creates a TLS configuration presenting the current SVID
+// from src and requiring clients to present an SVID from one of
+// trustDomains. Verified client IDs are passed to authorize. All clients of
+// the trust domains are accepted if authorize is nil.
+func ServerTLSConfig(src Source, authorize Authorizer, trustDomains ...string) *tls.Config {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		svid, err := src.SVID()
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		bundles := map[string][]*x509.Certificate{}
+		for _, td := range trustDomains {
+			authorities, err := src.Bundle(td)
+			if err != nil {
+				return nil, err
+			}
+			bundles[td] = authorities
+			for _, cert := range authorities {
+				pool.AddCert(cert)
+			}
+		}
+
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*svid}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		c.ClientCAs = pool
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verify(cs, bundles, authorize)
+		}
+		return c, nil
+	}
+	return config
+}
+
+// IDFromCertificate returns the SPIFFE ID of an X.509 SVID.
+func IDFromCertificate(cert *x509.Certificate) (*url.URL, error) {
+	if len(cert.URIs) != 1 {
+		return nil, fmt.Errorf("%w: expected exactly one URI SAN, got %v", ErrInvalidSVID, len(cert.URIs))
+	}
+
+	id := cert.URIs[0]
+	if id.Scheme != "spiffe" || id.Host == "" || id.User != nil || id.RawQuery != "" || id.Fragment != "" {
+		return nil, fmt.Errorf("%w: invalid SPIFFE ID %v", ErrInvalidSVID, id)
+	}
+	return id, nil
+}
+
+// AuthorizeID authorizes the given SPIFFE IDs only.
+func AuthorizeID(ids ...string) Authorizer {
+	return func(id *url.URL) error {
+		for _, allowed := range ids {
+			if id.String() == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrUnauthorized, id)
+	}
+}
+
+// AuthorizeMemberOf authorizes all SPIFFE IDs of the given trust domains.
+func AuthorizeMemberOf(trustDomains ...string) Authorizer {
+	return func(id *url.URL) error {
+		for _, td := range trustDomains {
+			if id.Host == td {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrUnauthorized, id)
+	}
+}
+
+func verify(cs tls.ConnectionState, bundles map[string][]*x509.Certificate, authorize Authorizer) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("%w: no client certificate", ErrInvalidSVID)
+	}
+
+	leaf := cs.PeerCertificates[0]
+	if leaf.IsCA {
+		return fmt.Errorf("%w: leaf certificate must not be a CA", ErrInvalidSVID)
+	}
+	id, err := IDFromCertificate(leaf)
+	if err != nil {
+		return err
+	}
+
+	// the chain must be rooted in the bundle of the client's trust domain
+	authorities, ok := bundles[id.Host]
+	if !ok {
+		return fmt.Errorf("%w: trust domain %v not accepted", ErrUnauthorized, id.Host)
+	}
+	if !rootedIn(cs.VerifiedChains, authorities) {
+		return fmt.Errorf("%w: certificate not issued by trust domain %v", ErrInvalidSVID, id.Host)
+	}
+
+	if authorize != nil {
+		return authorize(id)
+	}
+	return nil
+}
+
+func rootedIn(chains [][]*x509.Certificate, authorities []*x509.Certificate) bool {
+	for _, chain := range chains {
+		root := chain[len(chain)-1]
+		for _, authority := range authorities {
+			if bytes.Equal(root.Raw, authority.Raw) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package server
+
+import (
+	"crypto/tls"
+
+	"github.com/scippio/go-lumber/internal/tlsutil"
+)
+
+// TLSFromFiles creates a TLS configuration loading the server certificate and
+// key from certFile and keyFile. If caFile is not empty, clients must present
+// a certificate signed by one of the CAs in caFile.
+//
+// The files are checked for changes periodically and reloaded without
+// restarting the server, such that certificates can be rotated without
+// dropping active connections. New certificates apply to new connections only.
+func TLSFromFiles(certFile, keyFile, caFile string) (*tls.Config, error) {
+	r, err := tlsutil.NewReloader(certFile, keyFile, caFile, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		// clone config, so modifications to the returned config apply
+		c := config.Clone()
+		c.GetConfigForClient = nil
+		c.Certificates = []tls.Certificate{*r.Certificate()}
+		c.ClientCAs = r.CertPool()
+		return c, nil
+	}
+	return config, nil
+}
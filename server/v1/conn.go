@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package v1
+
+import (
+	"crypto/tls"
+	"net"
+
+	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/log"
+	protocol "github.com/scippio/go-lumber/protocol/v1"
+)
+
+// Conn serves the lumberjack protocol version 1 on a single connection
+// accepted by the application, without the connection handling of Server.
+// Conn does not send ACKs or keepalives on its own, and options configuring
+// the listener, connection limits, authentication or the receive channel are
+// ignored.
+//
+// ReadBatch may be called concurrently with ACK and Keepalive, but neither
+// ReadBatch nor ACK and Keepalive must be called concurrently with itself.
+type Conn struct {
+	conn net.Conn
+	r    *reader
+	w    *writer
+}
+
+// NewConn creates a new Conn reading batches from c. If TLS is configured, c
+// is wrapped in a TLS server connection, with the handshake being run by the
+// first read.
+func NewConn(c net.Conn, opts ...Option) (*Conn, error) {
+	o, err := applyOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.tls != nil {
+		c = tls.Server(c, o.tls)
+	}
+	logger := log.With(
+		log.Field{Key: "remote_addr", Value: c.RemoteAddr()},
+		log.Field{Key: "version", Value: protocol.Version},
+	)
+	r, w := newReaderWriter(o, c, logger)
+	return &Conn{conn: c, r: r, w: w}, nil
+}
+
+// ReadBatch reads the next batch from the connection. Empty windows are
+// skipped. The batch must be acknowledged by calling ACK with the number of
+// events processed, as Conn does not track ACKs on batches.
+func (c *Conn) ReadBatch() (*lj.Batch, error) {
+	for {
+		b, err := c.r.ReadBatch()
+		if b != nil || err != nil {
+			return b, err
+		}
+	}
+}
+
+// ACK sends the sequence number of the last event processed in the current
+// batch. Sequence numbers less than the batch size report progress.
+func (c *Conn) ACK(n int) error {
+	return c.w.ACK(n)
+}
+
+// Keepalive notifies the client of the batch still being processed, passing
+// the highest sequence number processed so far.
+func (c *Conn) Keepalive(n int) error {
+	return c.w.Keepalive(n)
+}
+
+// Flush writes ACKs pending if ACKs are coalesced via CoalesceACKs.
+func (c *Conn) Flush() error {
+	return c.w.Flush()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close flushes pending ACKs and closes the connection.
+func (c *Conn) Close() error {
+	err := c.w.Flush()
+	if cerr := c.conn.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -19,40 +19,66 @@ package v1
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
 	"io"
 	"net"
 	"time"
 
-	"github.com/klauspost/compress/zlib"
-
+	"github.com/scippio/go-lumber/codec"
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/log"
 	protocol "github.com/scippio/go-lumber/protocol/v1"
+	"github.com/scippio/go-lumber/server/internal"
 )
 
+// zlibCodec decompresses compressed frames, reusing readers across frames.
+var zlibCodec, _ = codec.ByName("zlib")
+
 type reader struct {
-	conn       net.Conn
-	in         *bufio.Reader
-	tlsState   *tls.ConnectionState
-	remoteAddr string
-	buf        []byte
-	timeout    time.Duration
+	conn         net.Conn
+	in           *bufio.Reader
+	count        *internal.CountingReader
+	frameAt      int64 // offset of the frame being read, for error reporting
+	tlsState     *tls.ConnectionState
+	remoteAddr   string
+	logger       *log.Context    // logs with the connection context
+	buf          internal.Buffer // payload buffer, released after each batch
+	timeout      time.Duration
+	batchTimeout bool // timeout is not extended per frame
+	decompress   *internal.DecompressBudget
+	limits       internal.ReadLimits
+	normalize    bool
+	jsonFields   []string
+	receivedAt   string // field stamped with the receive time, empty if disabled
+	poolEvents   bool   // events slices are pooled
+
+	retainCompressed bool
+	compressed       []lj.CompressedFrame // compressed frames of the window being read
+	compressedEvents int                  // events read from retained compressed frames
+
+	// size accounting of the window being read
+	wireStart  int64     // offset of the first frame
+	readStart  time.Time // time the first frame has been read
+	frameBytes int64     // size of the event frames read
+	sizes      []int     // payload sizes of the events of the window
+	eventSize  int       // payload size of the event read last
+	frameSize  int       // size of the event frame read last
 }
 
-func newReader(c net.Conn, to time.Duration) *reader {
+func newReader(c net.Conn, to time.Duration, bufSize int) *reader {
 	r := &reader{
 		conn:       c,
-		in:         bufio.NewReader(c),
+		count:      &internal.CountingReader{R: c},
 		remoteAddr: c.RemoteAddr().String(),
-		buf:        make([]byte, 0, 64),
 		timeout:    to,
 	}
-
-	if tlsConn, ok := c.(*tls.Conn); ok {
-		s := tlsConn.ConnectionState()
-		r.tlsState = &s
+	if bufSize > 0 {
+		r.in = bufio.NewReaderSize(r.count, bufSize)
+	} else {
+		r.in = bufio.NewReader(r.count)
 	}
 	return r
 }
@@ -61,53 +87,107 @@ func (r *reader) ReadBatch() (*lj.Batch, error) {
 	// 1. read window size
 	var win [6]byte
 	_ = r.conn.SetReadDeadline(time.Time{}) // wait for next batch without timeout
+	r.frameAt = r.offset()
 	if err := readFull(r.in, win[:]); err != nil {
 		return nil, err
 	}
 
-	if win[0] != protocol.CodeVersion && win[1] != protocol.CodeWindowSize {
-		log.Printf("Expected window from. Received %v", win[0:1])
-		return nil, ErrProtocolError
+	if win[0] != protocol.CodeVersion || win[1] != protocol.CodeWindowSize {
+		return nil, r.protocolError(r.in, win[:], "expected window frame")
+	}
+
+	// TLS handshake has been completed by first read
+	if r.tlsState == nil {
+		r.tlsState = internal.TLSConnectionState(r.conn)
 	}
 
 	count := int(binary.BigEndian.Uint32(win[2:]))
 	if count == 0 {
 		return nil, nil
 	}
+	if err := r.limits.CheckBatch(count); err != nil {
+		return nil, err
+	}
 
 	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
 		return nil, err
 	}
+	r.decompress.Reset()
+	defer r.buf.Release()
+	r.compressed, r.compressedEvents = nil, 0
+	r.wireStart, r.frameBytes = r.frameAt, 0
+	r.readStart = time.Now()
+	r.sizes = make([]int, 0, count)
+
+	var backing []interface{}
+	if r.poolEvents {
+		backing = internal.GetEvents(count)
+	} else {
+		backing = make([]interface{}, 0, count)
+	}
 
-	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
+	events, err := r.readEvents(r.in, backing[:0:count])
 	if events == nil || err != nil {
-		log.Printf("readEvents failed with: %v", err)
+		r.logger.Warnf("readEvents failed with: %v", log.PayloadError(err))
 		return nil, err
 	}
 
-	return lj.NewBatchWithSourceMetadata(events, r.remoteAddr, r.tlsState), nil
+	if r.normalize {
+		internal.NormalizeEvents(events)
+	}
+	now := time.Now()
+	if r.receivedAt != "" {
+		internal.StampEvents(events, r.receivedAt, now)
+	}
+
+	b := lj.NewBatchWithSourceMetadata(events, r.remoteAddr, r.tlsState)
+	b.Version = protocol.Version
+	b.ReceivedAt = now
+	b.ReadStart = r.readStart
+	b.WireBytes = r.offset() - r.wireStart
+	b.UncompressedBytes = r.frameBytes
+	b.EventSizes = r.sizes
+	r.sizes = nil
+	if r.compressedEvents == len(events) {
+		b.Compressed = r.compressed
+	}
+	r.compressed = nil
+	if r.poolEvents {
+		b.OnRelease(func() { internal.PutEvents(backing) })
+	}
+	return b, nil
 }
 
 func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
 	for len(events) < cap(events) {
+		if in == r.in {
+			r.frameAt = r.offset()
+		}
+		if len(events) > 0 {
+			if err := r.extendDeadline(); err != nil {
+				return nil, err
+			}
+		}
+
 		var hdr [2]byte
 		if err := readFull(in, hdr[:]); err != nil {
 			return nil, err
 		}
 
 		if hdr[0] != protocol.CodeVersion {
-			log.Println("Event protocol version error")
-			return nil, ErrProtocolError
+			return nil, r.protocolError(in, hdr[:], "unexpected protocol version")
 		}
 
 		switch hdr[1] {
 		case protocol.CodeDataFrame:
 			event, err := r.readEvent(in)
 			if err != nil {
-				log.Printf("failed to read json event with: %v\n", err)
+				r.logger.Warnf("failed to read json event with: %v", err)
 				return nil, err
 			}
 			events = append(events, event)
+			r.sizes = append(r.sizes, r.eventSize)
+			r.frameBytes += int64(r.frameSize)
 		case protocol.CodeCompressed:
 			readEvents, err := r.readCompressed(in, events)
 			if err != nil {
@@ -115,8 +195,7 @@ func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{},
 			}
 			events = readEvents
 		default:
-			log.Printf("Unknown frame type: %v", hdr[1])
-			return nil, ErrProtocolError
+			return nil, r.protocolError(in, hdr[:], "unknown frame type")
 		}
 	}
 	return events, nil
@@ -129,14 +208,27 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 	}
 
 	payloadSz := binary.BigEndian.Uint32(hdr[:])
+	if err := r.limits.CheckFrame(int(payloadSz)); err != nil {
+		return nil, err
+	}
 	limit := io.LimitReader(in, int64(payloadSz))
-	reader, err := zlib.NewReader(limit)
+	retain := r.retainCompressed && in == r.in
+	if retain {
+		payload, err := readPayload(in, payloadSz)
+		if err != nil {
+			return nil, err
+		}
+		r.compressed = append(r.compressed, lj.CompressedFrame{Type: protocol.CodeCompressed, Payload: payload})
+		limit = bytes.NewReader(payload)
+	}
+	start := len(events)
+	reader, err := zlibCodec.NewReader(limit)
 	if err != nil {
-		log.Printf("Failed to initialized zlib reader %v\n", err)
+		r.logger.Warnf("Failed to initialized zlib reader %v", err)
 		return nil, err
 	}
 
-	events, err = r.readEvents(reader, events)
+	events, err = r.readEvents(r.decompress.Reader(reader), events)
 	if err != nil {
 		_ = reader.Close()
 		return nil, err
@@ -145,6 +237,10 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 		return nil, err
 	}
 
+	if retain {
+		r.compressedEvents += len(events) - start
+	}
+
 	// consume final bytes from limit reader
 	for {
 		var tmp [16]byte
@@ -163,6 +259,7 @@ func (r *reader) readEvent(in io.Reader) (interface{}, error) {
 	if err := readFull(in, hdr[:]); err != nil {
 		return nil, err
 	}
+	r.eventSize, r.frameSize = 0, 10
 
 	readString := func() (string, error) {
 		var bufBytes [4]byte
@@ -171,14 +268,18 @@ func (r *reader) readEvent(in io.Reader) (interface{}, error) {
 		}
 
 		bytes := int(binary.BigEndian.Uint32(bufBytes[:]))
-		if bytes > len(r.buf) {
-			r.buf = make([]byte, bytes)
+		if err := r.limits.CheckFrame(bytes); err != nil {
+			return "", err
 		}
-
-		buf := r.buf[:bytes]
+		if d, ok := in.(*internal.DecompressReader); ok && !d.Fits(bytes) {
+			return "", ErrDecompressedTooLarge
+		}
+		buf := r.buf.Get(bytes)
 		if err := readFull(in, buf); err != nil {
 			return "", err
 		}
+		r.eventSize += bytes
+		r.frameSize += 4 + bytes
 
 		return string(buf[:]), nil
 	}
@@ -198,10 +299,82 @@ func (r *reader) readEvent(in io.Reader) (interface{}, error) {
 
 		event[k] = v
 	}
+
+	if len(r.jsonFields) > 0 {
+		return decodeJSONFields(event, r.jsonFields), nil
+	}
 	return event, nil
 }
 
+// decodeJSONFields converts event into a map[string]interface{}, replacing the
+// values of fields holding valid JSON with the decoded value. Other values are
+// kept as strings.
+func decodeJSONFields(event map[string]string, fields []string) map[string]interface{} {
+	decoded := make(map[string]interface{}, len(event))
+	for k, v := range event {
+		decoded[k] = v
+	}
+
+	for _, field := range fields {
+		v, exists := event[field]
+		if !exists {
+			continue
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(v), &value); err == nil {
+			decoded[field] = value
+		}
+	}
+	return decoded
+}
+
+// extendDeadline extends the read deadline once a frame has been read, unless
+// the timeout applies to the whole batch.
+func (r *reader) extendDeadline() error {
+	if r.batchTimeout {
+		return nil
+	}
+	return r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+}
+
+// offset returns the number of bytes consumed from the connection.
+func (r *reader) offset() int64 {
+	return r.count.N - int64(r.in.Buffered())
+}
+
+// protocolError creates a protocol error for the frame header hdr read from
+// in. Frames read from compressed payloads are reported at the offset of the
+// compressed frame.
+func (r *reader) protocolError(in io.Reader, hdr []byte, msg string) error {
+	err := &lj.ProtocolError{
+		Msg:        msg,
+		RemoteAddr: r.remoteAddr,
+		Offset:     r.frameAt,
+		Compressed: in != r.in,
+		Header:     append([]byte(nil), hdr...),
+	}
+	if len(hdr) > 1 {
+		err.Frame = hdr[1]
+	}
+	return err
+}
+
 func readFull(in io.Reader, buf []byte) error {
 	_, err := io.ReadFull(in, buf)
 	return err
 }
+
+// readPayload reads a payload of size bytes. The buffer grows as the payload
+// is read, such that the size announced by a client can not force allocating
+// more memory than the client actually sends.
+func readPayload(in io.Reader, size uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(in, int64(size))); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
@@ -18,10 +18,12 @@
 package v1
 
 import (
-	"errors"
+	"encoding/json"
 	"net"
 
 	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/log"
+	protocol "github.com/scippio/go-lumber/protocol/v1"
 	"github.com/scippio/go-lumber/server/internal"
 )
 
@@ -30,9 +32,50 @@ type Server struct {
 	s *internal.Server
 }
 
+// Stats provides a snapshot of server metrics.
+type Stats = internal.Stats
+
+// ConnStats provides a snapshot of the metrics of a client connection.
+type ConnStats = internal.ConnStats
+
+// Histogram provides a snapshot of a distribution of durations.
+type Histogram = internal.Histogram
+
+// TokenValidator validates authentication tokens presented by clients.
+type TokenValidator = internal.TokenValidator
+
+// TokenValidatorFunc adapts a function to the TokenValidator interface.
+type TokenValidatorFunc = internal.TokenValidatorFunc
+
+// Enrichment configures the fields added to events by Enrich.
+type Enrichment = internal.Enrichment
+
+// ValidationPolicy determines how events failing validation are handled.
+type ValidationPolicy = internal.ValidationPolicy
+
+// Policies handling events failing validation, see Validate.
+const (
+	ValidationFail       = internal.ValidationFail
+	ValidationDrop       = internal.ValidationDrop
+	ValidationDeadLetter = internal.ValidationDeadLetter
+)
+
 // ErrProtocolError is returned if a protocol error was detected in the
-// conversation with lumberjack server.
-var ErrProtocolError = errors.New("lumberjack protocol error")
+// conversation with lumberjack server. Protocol errors are reported as
+// *lj.ProtocolError, matching ErrProtocolError via errors.Is.
+var ErrProtocolError = lj.ErrProtocol
+
+// ErrDecompressedTooLarge is returned if a batch exceeds the size limit
+// configured by MaxDecompressedBytes once decompressed.
+var ErrDecompressedTooLarge = internal.ErrDecompressedTooLarge
+
+// ErrBatchTooLarge is returned if a client announces a batch with more events
+// than configured by MaxBatchEvents.
+var ErrBatchTooLarge = internal.ErrBatchTooLarge
+
+// ErrFrameTooLarge is returned if a client sends a frame larger than
+// configured by MaxFrameBytes.
+var ErrFrameTooLarge = internal.ErrFrameTooLarge
 
 // NewWithListener creates a new Server using an existing net.Listener.
 func NewWithListener(l net.Listener, opts ...Option) (*Server, error) {
@@ -79,6 +122,28 @@ func (s *Server) Close() error {
 	return s.s.Close()
 }
 
+// ActiveConnections returns the number of client connections currently being
+// served.
+func (s *Server) ActiveConnections() int {
+	return s.s.ActiveConnections()
+}
+
+// Stats returns a snapshot of the server metrics.
+func (s *Server) Stats() Stats {
+	return s.s.Stats()
+}
+
+// StatsJSON returns a snapshot of the server metrics as JSON document.
+func (s *Server) StatsJSON() ([]byte, error) {
+	return json.Marshal(s.Stats())
+}
+
+// Connections returns a snapshot of the metrics of all connections being
+// served, ordered by connection ID.
+func (s *Server) Connections() []ConnStats {
+	return s.s.Connections()
+}
+
 func (s *Server) Handle(c net.Conn) {
 	s.s.Handle(c)
 }
@@ -98,18 +163,69 @@ func newServer(
 		return nil, err
 	}
 
-	mkRW := func(client net.Conn) (internal.BatchReader, internal.ACKWriter, error) {
-		r := newReader(client, o.timeout)
-		w := newWriter(client, o.timeout)
+	mkRW := func(client net.Conn, logger *log.Context) (internal.BatchReader, internal.ACKWriter, error) {
+		r, w := newReaderWriter(o, client, logger)
 		return r, w, nil
 	}
 
+	handler := internal.DefaultHandler(internal.HandlerConfig{
+		Logging:             o.logging,
+		MaxInFlightBatches:  o.maxInFlightBatches,
+		SlowConsumerTimeout: o.slowConsumerTimeout,
+		AutoACK:             o.autoACK,
+		AutoACKDelay:        o.autoACKDelay,
+		IdleTimeout:         o.idleTimeout,
+		Enrich:              o.enrich,
+		Validate:            o.validation(),
+		Drop:                o.drop,
+		Dedupe:              o.dedupe,
+		Sample:              o.sampling(),
+		WireTap:             o.tap,
+		OnPanic:             o.onPanic,
+		OnError:             o.onError,
+		TokenAuth:           o.tokenAuth(),
+		Version:             protocol.Version,
+		EventsPerSecond:     o.eventsPerSecond,
+		BytesPerSecond:      o.bytesPerSecond,
+	}, mkRW)
+
 	cfg := internal.Config{
 		TLS:     o.tls,
-		Handler: internal.DefaultHandler(0, mkRW, o.logging),
+		Handler: handler,
 		Channel: o.ch,
+		Version: protocol.Version,
+
+		MaxConnections:        o.maxConns,
+		BlockOnMaxConnections: o.blockOnMaxConns,
+		MaxInFlightEvents:     o.maxInFlight,
+		HandshakeTimeout:      o.handshakeTimeout,
+		Authorize:             o.authorize,
+		ProxyProtocol:         o.proxyProtocol,
+		Audit:                 o.audit,
+		BandwidthLimit:        o.bandwidthLimit,
 	}
 
 	s, err := mk(cfg)
 	return &Server{s}, err
 }
+
+func newReaderWriter(o options, client net.Conn, logger *log.Context) (*reader, *writer) {
+	r := newReader(client, o.timeout, o.readBufferSize)
+	r.logger = logger
+	r.decompress = internal.NewDecompressBudget(o.maxDecompressedBytes)
+	r.limits = internal.ReadLimits{
+		MaxBatchEvents: o.maxBatchEvents,
+		MaxFrameBytes:  o.maxFrameBytes,
+	}
+	r.normalize = o.normalize
+	r.batchTimeout = o.batchTimeout
+	r.jsonFields = o.jsonFields
+	r.poolEvents = o.poolEvents
+	r.retainCompressed = o.retainCompressed
+	r.receivedAt = o.receivedAt
+	w := newWriter(client, o.timeout)
+	if o.ackFlushWindow > 0 {
+		w.buf = internal.NewACKBuffer(client, o.timeout, o.ackFlushWindow, o.ackFlushMax)
+	}
+	return r, w
+}
@@ -18,16 +18,17 @@
 package v1
 
 import (
-	"encoding/binary"
 	"net"
 	"time"
 
 	protocol "github.com/scippio/go-lumber/protocol/v1"
+	"github.com/scippio/go-lumber/server/internal"
 )
 
 type writer struct {
-	c  net.Conn
-	to time.Duration
+	c   net.Conn
+	to  time.Duration
+	buf *internal.ACKBuffer // nil if ACKs are not coalesced
 }
 
 func newWriter(c net.Conn, to time.Duration) *writer {
@@ -35,26 +36,38 @@ func newWriter(c net.Conn, to time.Duration) *writer {
 }
 
 func (w *writer) ACK(n int) error {
-	var buf [6]byte
-	buf[0] = protocol.CodeVersion
-	buf[1] = protocol.CodeACK
-	binary.BigEndian.PutUint32(buf[2:], uint32(n))
+	var tmp [6]byte
+	buf, err := protocol.AppendFrame(tmp[:0], &protocol.Frame{Type: protocol.CodeACK, Seq: uint32(n)})
+	if err != nil {
+		return err
+	}
+
+	if w.buf != nil {
+		return w.buf.Write(buf)
+	}
 
 	if err := w.c.SetWriteDeadline(time.Now().Add(w.to)); err != nil {
 		return err
 	}
 
-	tmp := buf[:]
-	for len(tmp) > 0 {
-		n, err := w.c.Write(tmp)
+	for len(buf) > 0 {
+		n, err := w.c.Write(buf)
 		if err != nil {
 			return err
 		}
-		tmp = tmp[n:]
+		buf = buf[n:]
 	}
 	return nil
 }
 
+// Flush writes coalesced ACKs.
+func (w *writer) Flush() error {
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
 func (*writer) Keepalive(int) error {
 	// keepalive not supported by v1
 	return nil
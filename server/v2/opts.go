@@ -21,9 +21,16 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"time"
 
+	"github.com/scippio/go-lumber/codec"
 	"github.com/scippio/go-lumber/lj"
+	protocol "github.com/scippio/go-lumber/protocol/v2"
+	"github.com/scippio/go-lumber/server/audit"
+	"github.com/scippio/go-lumber/server/internal"
 )
 
 // Option type for configuring server run options.
@@ -36,6 +43,66 @@ type options struct {
 	tls       *tls.Config
 	ch        chan *lj.Batch
 	logging   bool
+
+	maxConns        int
+	blockOnMaxConns bool
+	maxInFlight     int
+
+	maxInFlightBatches  int
+	slowConsumerTimeout time.Duration
+	onPanic             func(net.Conn, interface{}, []byte)
+	onError             func(net.Conn, error)
+	handshakeTimeout    time.Duration
+	tlsSettings         internal.TLSSettings
+	authorize           func(*tls.ConnectionState) error
+	proxyProtocol       bool
+	alpn                bool
+	tokenField          string
+	tokenValidator      TokenValidator
+	audit               audit.Hook
+	eventsPerSecond     int
+	bytesPerSecond      int
+	bandwidthLimit      int
+
+	maxDecompressedBytes int64
+	maxBatchEvents       int
+	maxFrameBytes        int
+	normalize            bool
+	zstd                 bool
+	codecs               []string
+	ackFlushWindow       time.Duration
+	ackFlushMax          int
+	strictSeq            bool
+	batchTimeout         bool // read timeout is not extended per frame
+	idleTimeout          time.Duration
+	decodeErrors         bool // deliver undecodable events instead of failing
+	deadLetter           func(*lj.InvalidEvent)
+	rawEvents            bool
+	factory              lj.EventFactory
+	eventCodecs          []string
+	protobuf             func([]byte) (interface{}, error)
+	chunkSize            int
+	decodeWorkers        int
+	readBufferSize       int
+	poolEvents           bool
+	retainCompressed     bool
+	receivedAt           string
+	enrich               *Enrichment
+	validate             func(interface{}) error
+	validatePolicy       ValidationPolicy
+	drop                 func(event interface{}) bool
+	sampleRate           float64 // fraction of matching events kept, 1 if not sampled
+	sampleMatch          func(event interface{}) bool
+	dedupeField          string
+	dedupeSize           int
+	dedupeWindow         time.Duration
+	autoACK              bool
+	autoACKDelay         time.Duration
+	wireTap              io.Writer
+	wireTapMatch         func(net.Addr) bool
+	dedupe               *internal.Deduplicator // shared by all connections
+	tap                  *internal.WireTap      // shared by all connections
+	decodePool           *internal.DecodePool   // shared by all connections
 }
 
 // Keepalive configures the keepalive interval returning an ACK of length 0 to
@@ -71,6 +138,8 @@ func Channel(c chan *lj.Batch) Option {
 }
 
 // TLS enables and configures TLS support in lumberjack server.
+// Plain connections passed to Handle are upgraded to TLS. Connections already
+// using TLS are served as is.
 func TLS(tls *tls.Config) Option {
 	return func(opt *options) error {
 		opt.tls = tls
@@ -94,12 +163,648 @@ func Logging(b bool) Option {
 	}
 }
 
+// MaxConnections limits the number of concurrently served client connections.
+// New connections are closed once the limit has been reached, unless
+// BlockOnMaxConnections is enabled. The default of 0 disables the limit.
+func MaxConnections(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max connections must not be negative")
+		}
+		opt.maxConns = n
+		return nil
+	}
+}
+
+// BlockOnMaxConnections configures Handle to block until a connection slot
+// becomes available if MaxConnections has been reached, instead of closing
+// the new connection.
+func BlockOnMaxConnections(b bool) Option {
+	return func(opt *options) error {
+		opt.blockOnMaxConns = b
+		return nil
+	}
+}
+
+// MaxInFlightEvents limits the total number of un-ACKed events across all
+// connections. Once the limit has been reached, no more batches are read from
+// clients until outstanding batches have been ACKed. The default of 0
+// disables the limit.
+func MaxInFlightEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max in-flight events must not be negative")
+		}
+		opt.maxInFlight = n
+		return nil
+	}
+}
+
+// MaxInFlightBatches limits the number of batches per connection being
+// received, but not yet ACKed. Once the limit has been reached, no more
+// batches are read from the client until outstanding batches have been
+// ACKed. The default of 0 disables the limit.
+func MaxInFlightBatches(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max in-flight batches must not be negative")
+		}
+		opt.maxInFlightBatches = n
+		return nil
+	}
+}
+
+// SlowConsumerTimeout closes client connections if a batch has not been ACKed
+// within the given duration of being delivered, forcing the client to
+// reconnect and resend the batch. Keepalives and partial ACKs do not extend
+// the deadline, such that a stalled consumer can not hold on to batches
+// forever. The default of 0 disables the timeout.
+func SlowConsumerTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("slow consumer timeout must not be negative")
+		}
+		opt.slowConsumerTimeout = to
+		return nil
+	}
+}
+
+// AutoACK ACKs batches after the given delay of being received, regardless of
+// the batches being processed by the consumer, for data preferably being
+// dropped over throttling clients. Batches are dropped if the receive channel
+// is full. Dropped events are counted by Stats.DroppedEvents. ACKs by the
+// consumer are ignored. Auto-ACK is disabled by default.
+func AutoACK(enabled bool, delay time.Duration) Option {
+	return func(opt *options) error {
+		if delay < 0 {
+			return errors.New("auto-ACK delay must not be negative")
+		}
+		opt.autoACK = enabled
+		opt.autoACKDelay = delay
+		return nil
+	}
+}
+
+// OnPanic registers a callback being called if a panic has been recovered in
+// a connection handler, e.g. from within a custom JSON decoder. The connection
+// is closed after the callback returns, while the server continues serving
+// other clients. By default the panic is logged.
+func OnPanic(f func(conn net.Conn, v interface{}, stack []byte)) Option {
+	return func(opt *options) error {
+		opt.onPanic = f
+		return nil
+	}
+}
+
+// OnError registers a callback being called with protocol errors, decode
+// failures, read timeouts and frames exceeding size limits, e.g. for alerting
+// on misbehaving clients. The callback is called when such an error closes a
+// connection, and for each event failing to decode being delivered as
+// lj.InvalidEvent. Errors are counted in Stats as well. The callback must not
+// block.
+func OnError(f func(conn net.Conn, err error)) Option {
+	return func(opt *options) error {
+		opt.onError = f
+		return nil
+	}
+}
+
+// HandshakeTimeout closes TLS connections not completing the TLS handshake
+// within the given duration. The default of 0 disables the timeout.
+func HandshakeTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("handshake timeout must not be negative")
+		}
+		opt.handshakeTimeout = to
+		return nil
+	}
+}
+
+// TLSMinVersion sets the minimum TLS version accepted by the server.
+func TLSMinVersion(v uint16) Option {
+	return func(opt *options) error {
+		if v < tls.VersionTLS10 || v > tls.VersionTLS13 {
+			return errors.New("unsupported TLS version")
+		}
+		opt.tlsSettings.MinVersion = v
+		return nil
+	}
+}
+
+// TLSCipherSuites sets the cipher suites enabled for TLS versions up to
+// TLS 1.2.
+func TLSCipherSuites(suites ...uint16) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.CipherSuites = suites
+		return nil
+	}
+}
+
+// TLSCurvePreferences sets the elliptic curves used in ECDHE handshakes, in
+// preference order.
+func TLSCurvePreferences(curves ...tls.CurveID) Option {
+	return func(opt *options) error {
+		opt.tlsSettings.CurvePreferences = curves
+		return nil
+	}
+}
+
+// SecureDefaults hardens the TLS configuration by requiring TLS 1.2 or newer
+// and restricting cipher suites and curves to modern, forward secret
+// algorithms. Options applied after SecureDefaults can further customize
+// these settings.
+func SecureDefaults() Option {
+	return func(opt *options) error {
+		opt.tlsSettings = internal.SecureTLSSettings()
+		return nil
+	}
+}
+
+// Authorize registers a callback for authorizing new connections after the
+// TLS handshake, e.g. based on the client certificate. The connection is
+// closed if the callback returns an error. The connection state is nil for
+// non-TLS connections.
+func Authorize(f func(*tls.ConnectionState) error) Option {
+	return func(opt *options) error {
+		opt.authorize = f
+		return nil
+	}
+}
+
+// ProxyProtocol requires every connection to start with a HAProxy PROXY
+// protocol (v1 or v2) header. The source address from the header is used as
+// the client's remote address. When enabled together with TLS, the server
+// runs the TLS handshake itself after reading the header.
+func ProxyProtocol(b bool) Option {
+	return func(opt *options) error {
+		opt.proxyProtocol = b
+		return nil
+	}
+}
+
+// ALPN enables negotiating the lumberjack protocol version via TLS ALPN.
+// Clients offering application protocols not supported by the server fail the
+// TLS handshake. Clients not using ALPN are not affected.
+func ALPN(b bool) Option {
+	return func(opt *options) error {
+		opt.alpn = b
+		return nil
+	}
+}
+
+// TokenAuth requires clients to authenticate by sending a token in field of
+// the first event on each connection. The event carrying the token is ACKed,
+// but not forwarded. Connections failing authentication are closed. Events
+// not being maps, e.g. with RawEvents, Events or Protobuf, are looked up in
+// their JSON representation.
+// Authentication is disabled if v is nil.
+func TokenAuth(field string, v TokenValidator) Option {
+	return func(opt *options) error {
+		if v != nil && field == "" {
+			return errors.New("token field must not be empty")
+		}
+		opt.tokenField = field
+		opt.tokenValidator = v
+		return nil
+	}
+}
+
+// Audit installs a hook receiving an audit record whenever a connection is
+// accepted, closed or rejected. See package audit.
+func Audit(hook audit.Hook) Option {
+	return func(opt *options) error {
+		opt.audit = hook
+		return nil
+	}
+}
+
+// RateLimit limits the number of events and bytes per second read from each
+// connection. Reads are delayed if a limit is exceeded, throttling the client
+// instead of dropping data. 0 disables the respective limit.
+func RateLimit(eventsPerSecond, bytesPerSecond int) Option {
+	return func(opt *options) error {
+		if eventsPerSecond < 0 || bytesPerSecond < 0 {
+			return errors.New("rate limits must not be negative")
+		}
+		opt.eventsPerSecond = eventsPerSecond
+		opt.bytesPerSecond = bytesPerSecond
+		return nil
+	}
+}
+
+// BandwidthLimit limits the total number of bytes per second read from all
+// connections. Reads are delayed if the limit is exceeded. 0 disables the
+// limit.
+func BandwidthLimit(bytesPerSecond int) Option {
+	return func(opt *options) error {
+		if bytesPerSecond < 0 {
+			return errors.New("bandwidth limit must not be negative")
+		}
+		opt.bandwidthLimit = bytesPerSecond
+		return nil
+	}
+}
+
+// MaxDecompressedBytes limits the number of bytes decompressed per batch.
+// Connections exceeding the limit are closed, protecting the server from
+// decompression bombs. 0 disables the limit.
+func MaxDecompressedBytes(n int64) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max decompressed bytes must not be negative")
+		}
+		opt.maxDecompressedBytes = n
+		return nil
+	}
+}
+
+// MaxBatchEvents limits the number of events per batch. Connections
+// announcing larger batches are closed. 0 disables the limit.
+func MaxBatchEvents(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max batch events must not be negative")
+		}
+		opt.maxBatchEvents = n
+		return nil
+	}
+}
+
+// MaxFrameBytes limits the size of a single data or compressed frame.
+// Connections sending larger frames are closed. 0 disables the limit.
+func MaxFrameBytes(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("max frame bytes must not be negative")
+		}
+		opt.maxFrameBytes = n
+		return nil
+	}
+}
+
+// ReadBufferSize sets the size of the buffer used for reading from client
+// connections. Larger buffers reduce the number of reads for large frames.
+// 0 uses the default size of 4KB.
+func ReadBufferSize(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("read buffer size must not be negative")
+		}
+		opt.readBufferSize = n
+		return nil
+	}
+}
+
+// NormalizeEvents converts all events to map[string]interface{}, such that
+// consumers can handle events independent of the protocol version. Events not
+// being JSON objects are stored in the "message" field. The protocol version
+// is available via lj.Batch.Version.
+func NormalizeEvents(b bool) Option {
+	return func(opt *options) error {
+		opt.normalize = b
+		return nil
+	}
+}
+
+// ReceivedAt stamps events with the time the batch has been received in field,
+// e.g. "@timestamp", if the event lacks the field. Only events being maps are
+// stamped. The time is formatted as RFC 3339 in UTC. An empty field disables
+// stamping.
+func ReceivedAt(field string) Option {
+	return func(opt *options) error {
+		opt.receivedAt = field
+		return nil
+	}
+}
+
+// Enrich adds the sender's address, TLS identity, connection ID and static
+// fields to the events of batches before delivery, as configured by e. Fields
+// are only added to events being maps and lacking the field.
+func Enrich(e Enrichment) Option {
+	return func(opt *options) error {
+		opt.enrich = &e
+		return nil
+	}
+}
+
+// Validate runs fn on each decoded event before delivery. Events failing
+// validation are handled according to policy: ValidationFail closes the
+// connection, ValidationDrop removes the event from the batch and
+// ValidationDeadLetter delivers the event as *lj.InvalidEvent. Events failing
+// validation are counted by Stats.InvalidEvents.
+func Validate(fn func(event interface{}) error, policy ValidationPolicy) Option {
+	return func(opt *options) error {
+		opt.validate = fn
+		opt.validatePolicy = policy
+		return nil
+	}
+}
+
+// DropEvents drops events matching fn before delivery, e.g. events matched by
+// lj.MatchFields. Dropped events are ACKed with the batch and counted by
+// Stats.FilteredEvents.
+func DropEvents(fn func(event interface{}) bool) Option {
+	return func(opt *options) error {
+		opt.drop = fn
+		return nil
+	}
+}
+
+// Sample keeps a random fraction rate of the events matching match, e.g.
+// events matched by lj.MatchFields, dropping the other matching events before
+// delivery. Events not matching are always kept. A nil match matches all
+// events. Dropped events are ACKed with the batch and counted by
+// Stats.SampledOutEvents. A rate of 1 disables sampling.
+func Sample(rate float64, match func(event interface{}) bool) Option {
+	return func(opt *options) error {
+		if rate < 0 || rate > 1 {
+			return errors.New("sample rate must be between 0 and 1")
+		}
+		opt.sampleRate = rate
+		opt.sampleMatch = match
+		return nil
+	}
+}
+
+// Deduplicate drops events with the event ID in field having been seen before
+// on any connection, e.g. events retransmitted by clients after a timeout. Up
+// to size IDs are remembered for window. IDs do not expire if window is 0.
+// Dropped events are ACKed with the batch and counted by
+// Stats.DuplicateEvents. An empty field disables deduplication.
+func Deduplicate(field string, size int, window time.Duration) Option {
+	return func(opt *options) error {
+		if field != "" && size <= 0 {
+			return errors.New("dedupe size must be positive")
+		}
+		if window < 0 {
+			return errors.New("dedupe window must not be negative")
+		}
+		opt.dedupeField = field
+		opt.dedupeSize = size
+		opt.dedupeWindow = window
+		return nil
+	}
+}
+
+// WireTap dumps the raw data read from connections with a remote address
+// matching match to w, e.g. a file, for analyzing interoperability problems
+// with clients. Data is dumped after TLS decryption. All connections are
+// tapped if match is nil. Each read is written as a record of the read time
+// in nanoseconds since the Unix epoch (8 bytes), the connection ID (8 bytes)
+// and the data length (4 bytes), followed by the data. Integers are big
+// endian. Records of different connections may interleave. Wire tapping is
+// disabled if w is nil.
+func WireTap(w io.Writer, match func(remoteAddr net.Addr) bool) Option {
+	return func(opt *options) error {
+		opt.wireTap = w
+		opt.wireTapMatch = match
+		return nil
+	}
+}
+
+// PoolEvents allocates the events slices of batches from a pool. Consumers
+// must call Batch.Release once done with a batch, returning the memory to the
+// pool. Events must not be accessed after Release. Batches not being released
+// are left to the garbage collector. Raw events are pooled as well.
+// Pooling is disabled for windows delivered in chunks by StreamChunks.
+func PoolEvents(b bool) Option {
+	return func(opt *options) error {
+		opt.poolEvents = b
+		return nil
+	}
+}
+
+// RetainCompressed keeps the compressed frames of batches on
+// lj.Batch.Compressed, such that relays can forward batches to another
+// lumberjack server without re-encoding the events. Frames are only retained
+// if all events of a batch have been received in compressed frames.
+// Windows delivered in chunks by StreamChunks are not retained.
+func RetainCompressed(b bool) Option {
+	return func(opt *options) error {
+		opt.retainCompressed = b
+		return nil
+	}
+}
+
+// Zstd enables accepting zstd compressed frames from v2 clients negotiating
+// zstd compression via the hello frame. zlib compression is always
+// supported.
+func Zstd(b bool) Option {
+	return func(opt *options) error {
+		opt.zstd = b
+		return nil
+	}
+}
+
+// Codecs enables accepting frames compressed with the given codecs from v2
+// clients negotiating compression via the hello frame. Codecs must be
+// registered with the codec package.
+func Codecs(names ...string) Option {
+	return func(opt *options) error {
+		for _, name := range names {
+			if _, ok := codec.ByName(name); !ok {
+				return fmt.Errorf("unknown codec: %v", name)
+			}
+		}
+		opt.codecs = append(opt.codecs, names...)
+		return nil
+	}
+}
+
+// EventCodecs enables accepting events encoded with the given event codecs,
+// e.g. CBOR or MessagePack, from v2 clients negotiating an event codec via the
+// hello frame. Event codecs must be registered with the codec package. Events
+// decoded by event codecs are not affected by JSONDecoder and RawEvents.
+func EventCodecs(names ...string) Option {
+	return func(opt *options) error {
+		for _, name := range names {
+			if _, ok := codec.EventByName(name); !ok {
+				return fmt.Errorf("unknown event codec: %v", name)
+			}
+		}
+		opt.eventCodecs = append(opt.eventCodecs, names...)
+		return nil
+	}
+}
+
+// Protobuf enables the protobuf extension, accepting protobuf data frames from
+// v2 clients negotiating the extension via the hello frame. decode converts
+// the protobuf payload of a frame into the event delivered, e.g. by calling
+// proto.Unmarshal on a new message. The payload must not be retained after
+// decode returns.
+func Protobuf(decode func(data []byte) (interface{}, error)) Option {
+	return func(opt *options) error {
+		opt.protobuf = decode
+		return nil
+	}
+}
+
+// StreamChunks delivers the events of windows larger than n events in batches
+// of n events while the window is still being read, such that consumers can
+// process events of large windows before the window has been read completely.
+// The batch holding the last events of the window completes the window. The
+// client receives partial ACKs for ACKed chunks, and the ACK of the window once
+// all batches of the window have been ACKed. 0 disables streaming.
+func StreamChunks(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("chunk size must not be negative")
+		}
+		opt.chunkSize = n
+		return nil
+	}
+}
+
+// DecodeWorkers decodes the events of compressed frames concurrently using a
+// pool of n long-lived workers shared by all connections, preserving the
+// order of events. Events are decoded by the connection if all workers are
+// busy. The decoder configured by JSONDecoder must be safe for concurrent use.
+// The workers are stopped by Close. 0 disables concurrent decoding.
+func DecodeWorkers(n int) Option {
+	return func(opt *options) error {
+		if n < 0 {
+			return errors.New("decode workers must not be negative")
+		}
+		opt.decodeWorkers = n
+		return nil
+	}
+}
+
+// CoalesceACKs buffers ACKs, writing all ACKs pending within window or once
+// maxACKs ACKs are pending in a single write. maxACKs 0 flushes on window
+// expiry only. Coalescing reduces writes on connections with many small
+// batches in flight, at the cost of delaying ACKs by up to window. A window of
+// 0 disables coalescing.
+func CoalesceACKs(window time.Duration, maxACKs int) Option {
+	return func(opt *options) error {
+		if window < 0 || maxACKs < 0 {
+			return errors.New("ACK flush window and max ACKs must not be negative")
+		}
+		opt.ackFlushWindow = window
+		opt.ackFlushMax = maxACKs
+		return nil
+	}
+}
+
+// IncrementalTimeout extends the read timeout configured by Timeout after each
+// frame read, such that batches only time out if no frame is received within
+// the timeout. If disabled, the timeout applies to reading the whole batch.
+// Enabled by default.
+func IncrementalTimeout(b bool) Option {
+	return func(opt *options) error {
+		opt.batchTimeout = !b
+		return nil
+	}
+}
+
+// IdleTimeout closes client connections if no data has been received and no
+// batch has been waiting for being ACKed within the given duration. Unlike
+// Timeout, IdleTimeout applies while waiting for the next batch. The default
+// of 0 disables the timeout.
+func IdleTimeout(to time.Duration) Option {
+	return func(opt *options) error {
+		if to < 0 {
+			return errors.New("idle timeout must not be negative")
+		}
+		opt.idleTimeout = to
+		return nil
+	}
+}
+
+// StrictSequence closes connections of v2 clients sending events out of
+// sequence. Clients must either restart the sequence at 1 with every batch, or
+// continue the sequence of the previous batch. Sequence errors are logged only
+// if StrictSequence is disabled.
+func StrictSequence(b bool) Option {
+	return func(opt *options) error {
+		opt.strictSeq = b
+		return nil
+	}
+}
+
+// ContinueOnDecodeError delivers events that can not be decoded as
+// *lj.InvalidEvent holding the raw event and the decode error, instead of
+// closing the connection. The remaining events of the batch are processed as
+// usual, and invalid events are ACKed with the batch. If deadLetter is not nil,
+// it is called with each invalid event before the batch is delivered.
+func ContinueOnDecodeError(deadLetter func(*lj.InvalidEvent)) Option {
+	return func(opt *options) error {
+		opt.decodeErrors = true
+		opt.deadLetter = deadLetter
+		return nil
+	}
+}
+
+// RawEvents delivers JSON encoded events as json.RawMessage without decoding
+// them, such that consumers forwarding events unchanged or decoding events
+// on their own skip decoding. The raw events are copies owned by the batch.
+// Raw events are not normalized by NormalizeEvents.
+func RawEvents(b bool) Option {
+	return func(opt *options) error {
+		opt.rawEvents = b
+		return nil
+	}
+}
+
+// Events configures the factory creating the values JSON encoded events are
+// decoded into, e.g. lj.EventFactoryFunc(func() interface{} { return
+// new(MyEvent) }). Events decoded via the factory are not normalized by
+// NormalizeEvents. RawEvents takes precedence over the factory.
+func Events(factory lj.EventFactory) Option {
+	return func(opt *options) error {
+		opt.factory = factory
+		return nil
+	}
+}
+
+func (o *options) acceptedCodecs() map[string]bool {
+	codecs := map[string]bool{}
+	if o.zstd {
+		codecs[protocol.CodecZstd] = true
+	}
+	for _, name := range o.codecs {
+		codecs[name] = true
+	}
+	return codecs
+}
+
+func (o *options) acceptedEventCodecs() map[string]bool {
+	codecs := map[string]bool{}
+	for _, name := range o.eventCodecs {
+		codecs[name] = true
+	}
+	return codecs
+}
+
+func (o *options) tokenAuth() *internal.TokenAuth {
+	if o.tokenValidator == nil {
+		return nil
+	}
+	return &internal.TokenAuth{Field: o.tokenField, Validator: o.tokenValidator}
+}
+
+func (o *options) validation() *internal.Validation {
+	if o.validate == nil {
+		return nil
+	}
+	return &internal.Validation{Validate: o.validate, Policy: o.validatePolicy}
+}
+
+func (o *options) sampling() *internal.Sampling {
+	if o.sampleRate >= 1 {
+		return nil
+	}
+	return &internal.Sampling{Rate: o.sampleRate, Match: o.sampleMatch}
+}
+
 func applyOptions(opts []Option) (options, error) {
 	o := options{
-		decoder:   json.Unmarshal,
-		timeout:   30 * time.Second,
-		keepalive: 3 * time.Second,
-		tls:       nil,
+		decoder:    json.Unmarshal,
+		timeout:    30 * time.Second,
+		keepalive:  3 * time.Second,
+		tls:        nil,
+		sampleRate: 1,
 	}
 
 	for _, opt := range opts {
@@ -107,5 +812,12 @@ func applyOptions(opts []Option) (options, error) {
 			return o, err
 		}
 	}
+	if o.alpn {
+		o.tlsSettings.NextProtos = []string{protocol.ALPN}
+	}
+	o.tls = o.tlsSettings.Apply(o.tls)
+	o.dedupe = internal.NewDeduplicator(o.dedupeField, o.dedupeSize, o.dedupeWindow)
+	o.tap = internal.NewWireTap(o.wireTap, o.wireTapMatch)
+	o.decodePool = internal.NewDecodePool(o.decodeWorkers)
 	return o, nil
 }
@@ -19,44 +19,98 @@ package v2
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 	"time"
 
-	"github.com/klauspost/compress/zlib"
-
+	"github.com/scippio/go-lumber/codec"
 	"github.com/scippio/go-lumber/lj"
 	"github.com/scippio/go-lumber/log"
 	protocol "github.com/scippio/go-lumber/protocol/v2"
+	"github.com/scippio/go-lumber/server/internal"
 )
 
 type reader struct {
-	conn       net.Conn
-	in         *bufio.Reader
-	tlsState   *tls.ConnectionState
-	decoder    jsonDecoder
-	remoteAddr string
-	buf        []byte
-	timeout    time.Duration
+	conn         net.Conn
+	in           *bufio.Reader
+	count        *internal.CountingReader
+	frameAt      int64 // offset of the frame being read, for error reporting
+	tlsState     *tls.ConnectionState
+	decoder      jsonDecoder
+	remoteAddr   string
+	logger       *log.Context    // logs with the connection context
+	logging      bool            // trace events failing to decode
+	buf          internal.Buffer // payload buffer, released after each batch
+	timeout      time.Duration
+	batchTimeout bool // timeout is not extended per frame
+	decompress   *internal.DecompressBudget
+	limits       internal.ReadLimits
+	normalize    bool
+	receivedAt   string // field stamped with the receive time, empty if disabled
+
+	codecs    map[string]bool // additional codecs accepted
+	keepalive time.Duration
+	started   bool             // hello frame is only accepted before the first batch
+	caps      *lj.Capabilities // nil if the client did not send a hello frame
+	seq       internal.SequenceTracker
+	seqErr    error // first sequence error in the current window
+	strictSeq bool  // close connection on sequence errors
+
+	decodeErrors bool // deliver undecodable events as *lj.InvalidEvent
+	deadLetter   func(*lj.InvalidEvent)
+	rawEvents    bool            // deliver JSON events as json.RawMessage
+	factory      lj.EventFactory // nil if events are decoded into interface{}
+
+	eventCodecs map[string]bool   // event codecs accepted
+	eventCodec  *codec.EventCodec // nil if no event codec has been negotiated
+
+	protobuf         func([]byte) (interface{}, error) // nil if protobuf extension is disabled
+	protobufAccepted bool                              // protobuf extension negotiated
+
+	chunkSize  int                   // events per chunk if windows are streamed, 0 if disabled
+	stream     func(*lj.Batch) error // receives chunks of the current window
+	chunkStart int                   // index of the first event of the next chunk
+
+	decodePool *internal.DecodePool // nil if events are decoded by the reader
+	decoding   sync.WaitGroup       // events being decoded by the pool
+
+	poolEvents bool   // events slices and raw events are pooled
+	pooled     bool   // window being read uses pooled memory
+	arena      []byte // raw events of the window being read, if pooled
+
+	retainCompressed bool
+	compressed       []lj.CompressedFrame // compressed frames of the window being read
+	compressedEvents int                  // events read from retained compressed frames
+
+	// size accounting of the window or chunk being read
+	wireStart  int64     // offset of the first frame
+	readStart  time.Time // time the first frame has been read
+	frameBytes int64     // size of the event frames read
+	sizes      []int     // payload sizes of the events of the window
+	eventSize  int       // payload size of the event read last
+	frameSize  int       // size of the event frame read last
 }
 
 type jsonDecoder func([]byte, interface{}) error
 
-func newReader(c net.Conn, to time.Duration, jsonDecoder jsonDecoder) *reader {
+func newReader(c net.Conn, to time.Duration, jsonDecoder jsonDecoder, bufSize int) *reader {
 	r := &reader{
 		conn:       c,
-		in:         bufio.NewReader(c),
+		count:      &internal.CountingReader{R: c},
 		decoder:    jsonDecoder,
 		remoteAddr: c.RemoteAddr().String(),
-		buf:        make([]byte, 0, 64),
 		timeout:    to,
 	}
-
-	if tlsConn, ok := c.(*tls.Conn); ok {
-		s := tlsConn.ConnectionState()
-		r.tlsState = &s
+	if bufSize > 0 {
+		r.in = bufio.NewReaderSize(r.count, bufSize)
+	} else {
+		r.in = bufio.NewReader(r.count)
 	}
 	return r
 }
@@ -65,103 +119,467 @@ func (r *reader) ReadBatch() (*lj.Batch, error) {
 	// 1. read window size
 	var win [6]byte
 	_ = r.conn.SetReadDeadline(time.Time{}) // wait for next batch without timeout
+	r.frameAt = r.offset()
 	if err := readFull(r.in, win[:]); err != nil {
 		return nil, err
 	}
 
-	if win[0] != protocol.CodeVersion && win[1] != protocol.CodeWindowSize {
-		log.Printf("Expected window from. Received %v", win[0:1])
-		return nil, ErrProtocolError
+	if win[0] == protocol.CodeVersion && win[1] == protocol.CodeHello {
+		return nil, r.readHello(win[:])
+	}
+	r.started = true
+
+	if win[0] != protocol.CodeVersion || win[1] != protocol.CodeWindowSize {
+		return nil, r.protocolError(r.in, win[:], "expected window frame")
+	}
+
+	// TLS handshake has been completed by first read
+	if r.tlsState == nil {
+		r.tlsState = internal.TLSConnectionState(r.conn)
 	}
 
 	count := int(binary.BigEndian.Uint32(win[2:]))
 	if count == 0 {
 		return nil, nil
 	}
+	if err := r.limits.CheckBatch(count); err != nil {
+		return nil, err
+	}
 
 	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
 		return nil, err
 	}
+	r.decompress.Reset()
+	defer r.buf.Release()
+	r.seq.StartWindow()
+	r.seqErr = nil
+	r.chunkStart = 0
+	r.compressed, r.compressedEvents = nil, 0
+	r.wireStart, r.frameBytes = r.frameAt, 0
+	r.readStart = time.Now()
+	r.sizes = make([]int, 0, count)
 
-	events, err := r.readEvents(r.in, make([]interface{}, 0, count))
+	// chunks of streamed windows share the events slice, so it can't be
+	// released by the consumer of a single chunk
+	r.pooled = r.poolEvents && (r.stream == nil || r.chunkSize <= 0)
+	var backing []interface{}
+	if r.pooled {
+		backing = internal.GetEvents(count)
+		r.arena = internal.GetBytes()
+	} else {
+		backing = make([]interface{}, 0, count)
+	}
+
+	events, err := r.readEvents(r.in, backing[:0:count])
+	if err == nil {
+		err = r.awaitDecoded(events)
+	}
 	if events == nil || err != nil {
-		log.Printf("readEvents failed with: %v", err)
+		r.decoding.Wait()
+		r.logger.Warnf("readEvents failed with: %v", log.PayloadError(err))
 		return nil, err
 	}
 
-	return lj.NewBatchWithSourceMetadata(events, r.remoteAddr, r.tlsState), nil
+	b := r.newBatch(events[r.chunkStart:])
+	r.sizes = nil
+	if r.chunkStart == 0 && r.compressedEvents == len(events) {
+		b.Compressed = r.compressed
+	}
+	r.compressed = nil
+	if r.pooled {
+		arena := r.arena
+		b.OnRelease(func() {
+			internal.PutEvents(backing)
+			internal.PutBytes(arena)
+		})
+		r.arena = nil
+	}
+	if r.seqErr != nil {
+		r.logger.Warnf("Events out of sequence: %v", r.seqErr)
+	}
+	return b, nil
+}
+
+// StreamChunks registers fn receiving chunks of windows larger than the chunk
+// size configured.
+func (r *reader) StreamChunks(fn func(*lj.Batch) error) {
+	r.stream = fn
+}
+
+func (r *reader) newBatch(events []interface{}) *lj.Batch {
+	if r.normalize && r.factory == nil {
+		internal.NormalizeEvents(events)
+	}
+	now := time.Now()
+	if r.receivedAt != "" {
+		internal.StampEvents(events, r.receivedAt, now)
+	}
+
+	b := lj.NewBatchWithSourceMetadata(events, r.remoteAddr, r.tlsState)
+	b.Version = protocol.Version
+	b.ReceivedAt = now
+	b.ReadStart = r.readStart
+	b.Capabilities = r.caps
+	b.LastSeq = r.seq.Last()
+	b.WireBytes = r.offset() - r.wireStart
+	b.UncompressedBytes = r.frameBytes
+	n := len(r.sizes)
+	b.EventSizes = r.sizes[n-len(events) : n : n]
+	r.wireStart, r.frameBytes = r.offset(), 0
+	r.readStart = now
+	return b
+}
+
+// appendEvent adds event to the window being read. Once chunkSize events have
+// been read, the events are passed to the stream callback, unless the window
+// is complete.
+func (r *reader) appendEvent(events []interface{}, event interface{}) ([]interface{}, error) {
+	events = append(events, event)
+	r.sizes = append(r.sizes, r.eventSize)
+	r.frameBytes += int64(r.frameSize)
+	if r.stream == nil || r.chunkSize <= 0 || len(events) == cap(events) || len(events)-r.chunkStart < r.chunkSize {
+		return events, nil
+	}
+
+	if err := r.awaitDecoded(events); err != nil {
+		return events, err
+	}
+	chunk := events[r.chunkStart:len(events):len(events)]
+	r.chunkStart = len(events)
+	return events, r.stream(r.newBatch(chunk))
 }
 
 func (r *reader) readEvents(in io.Reader, events []interface{}) ([]interface{}, error) {
 	for len(events) < cap(events) {
+		if in == r.in {
+			r.frameAt = r.offset()
+		}
+		if len(events) > 0 {
+			if err := r.extendDeadline(); err != nil {
+				return nil, err
+			}
+		}
+
 		var hdr [2]byte
 		if err := readFull(in, hdr[:]); err != nil {
 			return nil, err
 		}
 
 		if hdr[0] != protocol.CodeVersion {
-			log.Println("Event protocol version error")
-			return nil, ErrProtocolError
+			return nil, r.protocolError(in, hdr[:], "unexpected protocol version")
 		}
 
 		switch hdr[1] {
 		case protocol.CodeJSONDataFrame:
-			event, err := r.readJSONEvent(in)
+			seq, event, err := r.readJSONEvent(in)
 			if err != nil {
-				log.Printf("failed to read json event with: %v\n", err)
+				r.logger.Warnf("failed to read json event with: %v", log.PayloadError(err))
+				return nil, err
+			}
+			if err := r.trackSequence(seq); err != nil {
 				return nil, err
 			}
-			events = append(events, event)
-		case protocol.CodeCompressed:
-			readEvents, err := r.readCompressed(in, events)
+			if events, err = r.appendEvent(events, event); err != nil {
+				return nil, err
+			}
+		case protocol.CodeEncodedDataFrame:
+			if r.eventCodec == nil {
+				return nil, r.protocolError(in, hdr[:], "event codec not negotiated")
+			}
+			seq, event, err := r.readEncodedEvent(in, r.eventCodec.Unmarshal, false)
 			if err != nil {
+				r.logger.Warnf("failed to read encoded event with: %v", log.PayloadError(err))
+				return nil, err
+			}
+			if err := r.trackSequence(seq); err != nil {
+				return nil, err
+			}
+			if events, err = r.appendEvent(events, event); err != nil {
+				return nil, err
+			}
+		case protocol.CodeProtobufDataFrame:
+			if !r.protobufAccepted {
+				return nil, r.protocolError(in, hdr[:], "protobuf extension not negotiated")
+			}
+			seq, event, err := r.readProtobufEvent(in)
+			if err != nil {
+				r.logger.Warnf("failed to read protobuf event with: %v", log.PayloadError(err))
+				return nil, err
+			}
+			if err := r.trackSequence(seq); err != nil {
+				return nil, err
+			}
+			if events, err = r.appendEvent(events, event); err != nil {
+				return nil, err
+			}
+		case protocol.CodeDataFrame:
+			seq, event, err := r.readDataEvent(in)
+			if err != nil {
+				r.logger.Warnf("failed to read data event with: %v", err)
+				return nil, err
+			}
+			if err := r.trackSequence(seq); err != nil {
+				return nil, err
+			}
+			if events, err = r.appendEvent(events, event); err != nil {
 				return nil, err
 			}
-			events = readEvents
 		default:
-			log.Printf("Unknown frame type: %v", hdr[1])
-			return nil, ErrProtocolError
+			c, ok := codec.ByCode(hdr[1])
+			if !ok {
+				return nil, r.protocolError(in, hdr[:], "unknown frame type")
+			}
+			if !r.accepts(c.Name) {
+				return nil, r.protocolError(in, hdr[:], c.Name+" compression not enabled")
+			}
+			readEvents, err := r.readCompressed(in, hdr[1], events, c.NewReader)
+			if err != nil {
+				return nil, err
+			}
+			events = readEvents
 		}
 	}
 	return events, nil
 }
 
-func (r *reader) readJSONEvent(in io.Reader) (interface{}, error) {
+func (r *reader) readJSONEvent(in io.Reader) (uint32, interface{}, error) {
+	return r.readEncodedEvent(in, r.decoder, r.rawEvents)
+}
+
+// readEncodedEvent reads a JSON or encoded data frame, decoding the event
+// using decode. If raw is set, the event is returned as json.RawMessage.
+func (r *reader) readEncodedEvent(in io.Reader, decode func([]byte, interface{}) error, raw bool) (uint32, interface{}, error) {
+	seq, buf, err := r.readPayload(in)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if raw {
+		return seq, json.RawMessage(r.copyRaw(buf)), nil
+	}
+
+	var event, dst interface{}
+	if r.factory != nil {
+		event = r.factory.NewEvent()
+		dst = event
+	} else {
+		dst = &event
+	}
+	if r.decodePool != nil && in != r.in {
+		return seq, r.decodeAsync(append([]byte(nil), buf...), decode, event, dst), nil
+	}
+	if err := decode(buf, dst); err != nil {
+		invalid, err := r.invalidEvent(buf, err)
+		return seq, invalid, err
+	}
+	return seq, event, nil
+}
+
+// copyRaw copies buf, the payload of a raw event, into the arena of the
+// window being read if events are pooled.
+func (r *reader) copyRaw(buf []byte) []byte {
+	if !r.pooled {
+		return append([]byte(nil), buf...)
+	}
+
+	start := len(r.arena)
+	r.arena = append(r.arena, buf...)
+	return r.arena[start:len(r.arena):len(r.arena)]
+}
+
+// pendingEvent is a placeholder for an event being decoded by the pool.
+type pendingEvent struct {
+	payload []byte
+	event   interface{} // nil if decoded into dst
+	dst     interface{}
+	err     error
+}
+
+// decodeAsync decodes the payload of an event read from a compressed frame
+// using the decode pool. The event returned is a placeholder replaced by
+// awaitDecoded.
+func (r *reader) decodeAsync(payload []byte, decode func([]byte, interface{}) error, event, dst interface{}) *pendingEvent {
+	p := &pendingEvent{payload: payload, event: event, dst: dst}
+	r.decoding.Add(1)
+	r.decodePool.Go(func() {
+		defer r.decoding.Done()
+		defer func() {
+			if v := recover(); v != nil {
+				p.err = fmt.Errorf("panic decoding event: %v", v)
+			}
+		}()
+		p.err = decode(p.payload, p.dst)
+	})
+	return p
+}
+
+// awaitDecoded waits for the events of the current chunk being decoded by the
+// pool, replacing the placeholders with the decoded events.
+func (r *reader) awaitDecoded(events []interface{}) error {
+	if r.decodePool == nil {
+		return nil
+	}
+
+	r.decoding.Wait()
+	for i := r.chunkStart; i < len(events); i++ {
+		p, ok := events[i].(*pendingEvent)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case p.err != nil:
+			invalid, err := r.invalidEvent(p.payload, p.err)
+			if err != nil {
+				return err
+			}
+			events[i] = invalid
+		case p.event != nil:
+			events[i] = p.event
+		default:
+			events[i] = *p.dst.(*interface{})
+		}
+	}
+	return nil
+}
+
+// readProtobufEvent reads a protobuf data frame, decoding the event using the
+// protobuf decoder configured.
+func (r *reader) readProtobufEvent(in io.Reader) (uint32, interface{}, error) {
+	seq, buf, err := r.readPayload(in)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	event, err := r.protobuf(buf)
+	if err != nil {
+		invalid, err := r.invalidEvent(buf, err)
+		return seq, invalid, err
+	}
+	return seq, event, nil
+}
+
+// readPayload reads the sequence number and payload of JSON, encoded and
+// protobuf data frames. The payload is only valid until the next frame is
+// read.
+func (r *reader) readPayload(in io.Reader) (uint32, []byte, error) {
 	var hdr [8]byte
 	if err := readFull(in, hdr[:]); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
+	seq := binary.BigEndian.Uint32(hdr[:4])
 
 	payloadSz := int(binary.BigEndian.Uint32(hdr[4:]))
-	if payloadSz > len(r.buf) {
-		r.buf = make([]byte, payloadSz)
+	if err := r.limits.CheckFrame(payloadSz); err != nil {
+		return 0, nil, err
 	}
-
-	buf := r.buf[:payloadSz]
+	if d, ok := in.(*internal.DecompressReader); ok && !d.Fits(payloadSz) {
+		return 0, nil, ErrDecompressedTooLarge
+	}
+	buf := r.buf.Get(payloadSz)
 	if err := readFull(in, buf); err != nil {
+		return 0, nil, err
+	}
+	r.eventSize, r.frameSize = payloadSz, 10+payloadSz
+	return seq, buf, nil
+}
+
+// invalidEvent returns the event delivered in place of an event failing to
+// decode, or err if the connection is to be closed on decode errors.
+func (r *reader) invalidEvent(buf []byte, err error) (interface{}, error) {
+	if r.logging {
+		r.logger.Debugf("failed to decode event %v: %v", log.Payload(buf), log.PayloadError(err))
+	}
+	err = lj.WrapError(lj.ErrDecode, err)
+	if !r.decodeErrors {
 		return nil, err
 	}
+	invalid := &lj.InvalidEvent{Raw: append([]byte(nil), buf...), Err: err}
+	if r.deadLetter != nil {
+		r.deadLetter(invalid)
+	}
+	return invalid, nil
+}
+
+// readDataEvent reads a key/value data frame as sent by legacy clients. The
+// pairs are returned as map[string]interface{}, like JSON encoded events.
+func (r *reader) readDataEvent(in io.Reader) (uint32, interface{}, error) {
+	var hdr [8]byte
+	if err := readFull(in, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	seq := binary.BigEndian.Uint32(hdr[:4])
+	r.eventSize, r.frameSize = 0, 10
+
+	readString := func() (string, error) {
+		var bufBytes [4]byte
+		if err := readFull(in, bufBytes[:]); err != nil {
+			return "", err
+		}
+
+		bytes := int(binary.BigEndian.Uint32(bufBytes[:]))
+		if err := r.limits.CheckFrame(bytes); err != nil {
+			return "", err
+		}
+		if d, ok := in.(*internal.DecompressReader); ok && !d.Fits(bytes) {
+			return "", ErrDecompressedTooLarge
+		}
+		buf := r.buf.Get(bytes)
+		if err := readFull(in, buf); err != nil {
+			return "", err
+		}
+		r.eventSize += bytes
+		r.frameSize += 4 + bytes
+
+		return string(buf), nil
+	}
+
+	event := map[string]interface{}{}
+	pairs := int(binary.BigEndian.Uint32(hdr[4:]))
+	for i := 0; i < pairs; i++ {
+		k, err := readString()
+		if err != nil {
+			return 0, nil, err
+		}
 
-	var event interface{}
-	err := r.decoder(buf, &event)
-	return event, err
+		v, err := readString()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		event[k] = v
+	}
+	return seq, event, nil
 }
 
-func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface{}, error) {
+func (r *reader) readCompressed(in io.Reader, code byte, events []interface{}, decompressor codec.Decompressor) ([]interface{}, error) {
 	var hdr [4]byte
 	if err := readFull(in, hdr[:]); err != nil {
 		return nil, err
 	}
 
 	payloadSz := binary.BigEndian.Uint32(hdr[:])
+	if err := r.limits.CheckFrame(int(payloadSz)); err != nil {
+		return nil, err
+	}
 	limit := io.LimitReader(in, int64(payloadSz))
-	reader, err := zlib.NewReader(limit)
+	retain := r.retainCompressed && in == r.in
+	if retain {
+		payload, err := readPayload(in, payloadSz)
+		if err != nil {
+			return nil, err
+		}
+		r.compressed = append(r.compressed, lj.CompressedFrame{Type: code, Payload: payload})
+		limit = bytes.NewReader(payload)
+	}
+	start := len(events)
+	reader, err := decompressor(limit)
 	if err != nil {
-		log.Printf("Failed to initialized zlib reader %v\n", err)
+		r.logger.Warnf("Failed to initialized decompressor %v", err)
 		return nil, err
 	}
 
-	events, err = r.readEvents(reader, events)
+	events, err = r.readEvents(r.decompress.Reader(reader), events)
 	if err != nil {
 		_ = reader.Close()
 		return nil, err
@@ -170,6 +588,10 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 		return nil, err
 	}
 
+	if retain {
+		r.compressedEvents += len(events) - start
+	}
+
 	// consume final bytes from limit reader
 	for {
 		var tmp [16]byte
@@ -183,7 +605,170 @@ func (r *reader) readCompressed(in io.Reader, events []interface{}) ([]interface
 	return events, nil
 }
 
+// maxHelloSize bounds the size of hello frames, such that clients can not
+// force large allocations before sending any batch.
+const maxHelloSize = 64 << 10
+
+// readHello reads the hello frame and responds with the extensions accepted
+// for the connection.
+func (r *reader) readHello(hdr []byte) error {
+	if r.started {
+		return r.protocolError(r.in, hdr, "unexpected hello frame")
+	}
+	r.started = true
+
+	payloadSz := binary.BigEndian.Uint32(hdr[2:])
+	if payloadSz > maxHelloSize {
+		return internal.ErrFrameTooLarge
+	}
+	if err := r.limits.CheckFrame(int(payloadSz)); err != nil {
+		return err
+	}
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return err
+	}
+
+	buf, err := readPayload(r.in, payloadSz)
+	if err != nil {
+		return err
+	}
+
+	var hello protocol.Hello
+	if err := json.Unmarshal(buf, &hello); err != nil {
+		return r.protocolError(r.in, hdr, "invalid hello frame: "+err.Error())
+	}
+
+	accepted := protocol.Hello{
+		MaxBatchSize:    r.limits.MaxBatchEvents,
+		KeepaliveMillis: r.keepalive.Milliseconds(),
+	}
+	for _, name := range hello.Codecs {
+		if _, registered := codec.ByName(name); registered && r.accepts(name) {
+			accepted.Codecs = append(accepted.Codecs, name)
+		}
+	}
+	for _, name := range hello.EventCodecs {
+		if c, registered := codec.EventByName(name); registered && r.eventCodecs[name] {
+			accepted.EventCodecs = []string{name}
+			r.eventCodec = &c
+			break
+		}
+	}
+	for _, ext := range hello.Extensions {
+		if ext == protocol.ExtensionProtobuf && r.protobuf != nil {
+			accepted.Extensions = append(accepted.Extensions, ext)
+			r.protobufAccepted = true
+		}
+	}
+
+	r.caps = &lj.Capabilities{
+		Codecs:          accepted.Codecs,
+		MaxBatchSize:    minLimit(hello.MaxBatchSize, accepted.MaxBatchSize),
+		Keepalive:       r.keepalive,
+		ClientKeepalive: time.Duration(hello.KeepaliveMillis) * time.Millisecond,
+	}
+	if r.eventCodec != nil {
+		r.caps.EventCodec = r.eventCodec.Name
+	}
+	r.caps.Extensions = accepted.Extensions
+	if r.keepalive > 0 && r.caps.ClientKeepalive > 0 && r.keepalive > r.caps.ClientKeepalive {
+		r.logger.Warnf("Keepalive interval %v exceeds interval %v tolerated by client",
+			r.keepalive, r.caps.ClientKeepalive)
+	}
+
+	payload, err := json.Marshal(accepted)
+	if err != nil {
+		return err
+	}
+	resp := make([]byte, 6, 6+len(payload))
+	resp[0] = protocol.CodeVersion
+	resp[1] = protocol.CodeHello
+	binary.BigEndian.PutUint32(resp[2:], uint32(len(payload)))
+	resp = append(resp, payload...)
+
+	if err := r.conn.SetWriteDeadline(time.Now().Add(r.timeout)); err != nil {
+		return err
+	}
+	_, err = r.conn.Write(resp)
+	return err
+}
+
+// trackSequence validates the sequence number of the next event. Sequence
+// errors are reported with the batch, unless strict sequencing is required.
+func (r *reader) trackSequence(seq uint32) error {
+	err := r.seq.Next(seq)
+	if err == nil {
+		return nil
+	}
+	if r.strictSeq {
+		return err
+	}
+	if r.seqErr == nil {
+		r.seqErr = err
+	}
+	return nil
+}
+
+// accepts returns true if frames compressed with the named codec are
+// accepted. zlib is always accepted.
+func (r *reader) accepts(name string) bool {
+	return name == protocol.CodecZlib || r.codecs[name]
+}
+
+// minLimit returns the smaller of two limits, with 0 indicating no limit.
+func minLimit(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// extendDeadline extends the read deadline once a frame has been read, unless
+// the timeout applies to the whole batch.
+func (r *reader) extendDeadline() error {
+	if r.batchTimeout {
+		return nil
+	}
+	return r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+}
+
+// offset returns the number of bytes consumed from the connection.
+func (r *reader) offset() int64 {
+	return r.count.N - int64(r.in.Buffered())
+}
+
+// protocolError creates a protocol error for the frame header hdr read from
+// in. Frames read from compressed payloads are reported at the offset of the
+// compressed frame.
+func (r *reader) protocolError(in io.Reader, hdr []byte, msg string) error {
+	err := &lj.ProtocolError{
+		Msg:        msg,
+		RemoteAddr: r.remoteAddr,
+		Offset:     r.frameAt,
+		Compressed: in != r.in,
+		Header:     append([]byte(nil), hdr...),
+	}
+	if len(hdr) > 1 {
+		err.Frame = hdr[1]
+	}
+	return err
+}
+
 func readFull(in io.Reader, buf []byte) error {
 	_, err := io.ReadFull(in, buf)
 	return err
 }
+
+// readPayload reads a payload of size bytes. The buffer grows as the payload
+// is read, such that the size announced by a client can not force allocating
+// more memory than the client actually sends.
+func readPayload(in io.Reader, size uint32) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(io.LimitReader(in, int64(size))); err != nil {
+		return nil, err
+	}
+	if buf.Len() < int(size) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), nil
+}
@@ -18,21 +18,69 @@
 package v2
 
 import (
-	"errors"
+	"encoding/json"
 	"net"
 
 	"github.com/scippio/go-lumber/lj"
+	"github.com/scippio/go-lumber/log"
+	protocol "github.com/scippio/go-lumber/protocol/v2"
 	"github.com/scippio/go-lumber/server/internal"
 )
 
 // Server serves multiple lumberjack clients supporting protocol version 2.
 type Server struct {
-	s *internal.Server
+	s          *internal.Server
+	decodePool *internal.DecodePool // nil if events are decoded by the connections
 }
 
+// Stats provides a snapshot of server metrics.
+type Stats = internal.Stats
+
+// ConnStats provides a snapshot of the metrics of a client connection.
+type ConnStats = internal.ConnStats
+
+// Histogram provides a snapshot of a distribution of durations.
+type Histogram = internal.Histogram
+
+// TokenValidator validates authentication tokens presented by clients.
+type TokenValidator = internal.TokenValidator
+
+// TokenValidatorFunc adapts a function to the TokenValidator interface.
+type TokenValidatorFunc = internal.TokenValidatorFunc
+
+// Enrichment configures the fields added to events by Enrich.
+type Enrichment = internal.Enrichment
+
+// ValidationPolicy determines how events failing validation are handled.
+type ValidationPolicy = internal.ValidationPolicy
+
+// Policies handling events failing validation, see Validate.
+const (
+	ValidationFail       = internal.ValidationFail
+	ValidationDrop       = internal.ValidationDrop
+	ValidationDeadLetter = internal.ValidationDeadLetter
+)
+
 // ErrProtocolError is returned if a protocol error was detected in the
-// conversation with lumberjack server.
-var ErrProtocolError = errors.New("lumberjack protocol error")
+// conversation with lumberjack server. Protocol errors are reported as
+// *lj.ProtocolError, matching ErrProtocolError via errors.Is.
+var ErrProtocolError = lj.ErrProtocol
+
+// ErrDecompressedTooLarge is returned if a batch exceeds the size limit
+// configured by MaxDecompressedBytes once decompressed.
+var ErrDecompressedTooLarge = internal.ErrDecompressedTooLarge
+
+// ErrInvalidSequence is returned if events are received out of sequence and
+// StrictSequence is enabled.
+var ErrInvalidSequence = internal.ErrInvalidSequence
+
+// ErrBatchTooLarge is returned if a client announces a batch with more events
+// than configured by MaxBatchEvents.
+var ErrBatchTooLarge = internal.ErrBatchTooLarge
+
+// ErrFrameTooLarge is returned if a client sends a frame larger than
+// configured by MaxFrameBytes.
+var ErrFrameTooLarge = internal.ErrFrameTooLarge
 
 // NewWithListener creates a new Server using an existing net.Listener.
 func NewWithListener(l net.Listener, opts ...Option) (*Server, error) {
@@ -76,7 +124,31 @@ func (s *Server) Receive() *lj.Batch {
 // Close stops the listener, closes all active connections and closes the
 // receiver channel returned from ReceiveChan().
 func (s *Server) Close() error {
-	return s.s.Close()
+	err := s.s.Close()
+	s.decodePool.Close()
+	return err
+}
+
+// ActiveConnections returns the number of client connections currently being
+// served.
+func (s *Server) ActiveConnections() int {
+	return s.s.ActiveConnections()
+}
+
+// Stats returns a snapshot of the server metrics.
+func (s *Server) Stats() Stats {
+	return s.s.Stats()
+}
+
+// StatsJSON returns a snapshot of the server metrics as JSON document.
+func (s *Server) StatsJSON() ([]byte, error) {
+	return json.Marshal(s.Stats())
+}
+
+// Connections returns a snapshot of the metrics of all connections being
+// served, ordered by connection ID.
+func (s *Server) Connections() []ConnStats {
+	return s.s.Connections()
 }
 
 func (s *Server) Handle(c net.Conn) {
@@ -98,18 +170,85 @@ func newServer(
 		return nil, err
 	}
 
-	mkRW := func(client net.Conn) (internal.BatchReader, internal.ACKWriter, error) {
-		r := newReader(client, o.timeout, o.decoder)
-		w := newWriter(client, o.timeout)
+	mkRW := func(client net.Conn, logger *log.Context) (internal.BatchReader, internal.ACKWriter, error) {
+		r, w := newReaderWriter(o, client, logger)
 		return r, w, nil
 	}
 
+	handler := internal.DefaultHandler(internal.HandlerConfig{
+		Keepalive:           o.keepalive,
+		Logging:             o.logging,
+		MaxInFlightBatches:  o.maxInFlightBatches,
+		SlowConsumerTimeout: o.slowConsumerTimeout,
+		AutoACK:             o.autoACK,
+		AutoACKDelay:        o.autoACKDelay,
+		IdleTimeout:         o.idleTimeout,
+		Enrich:              o.enrich,
+		Validate:            o.validation(),
+		Drop:                o.drop,
+		Dedupe:              o.dedupe,
+		Sample:              o.sampling(),
+		WireTap:             o.tap,
+		OnPanic:             o.onPanic,
+		OnError:             o.onError,
+		TokenAuth:           o.tokenAuth(),
+		Version:             protocol.Version,
+		SequenceACKs:        true,
+		EventsPerSecond:     o.eventsPerSecond,
+		BytesPerSecond:      o.bytesPerSecond,
+	}, mkRW)
+
 	cfg := internal.Config{
 		TLS:     o.tls,
-		Handler: internal.DefaultHandler(o.keepalive, mkRW, o.logging),
+		Handler: handler,
 		Channel: o.ch,
+		Version: protocol.Version,
+
+		MaxConnections:        o.maxConns,
+		BlockOnMaxConnections: o.blockOnMaxConns,
+		MaxInFlightEvents:     o.maxInFlight,
+		HandshakeTimeout:      o.handshakeTimeout,
+		Authorize:             o.authorize,
+		ProxyProtocol:         o.proxyProtocol,
+		Audit:                 o.audit,
+		BandwidthLimit:        o.bandwidthLimit,
 	}
 
 	s, err := mk(cfg)
-	return &Server{s}, err
+	if err != nil {
+		o.decodePool.Close()
+	}
+	return &Server{s: s, decodePool: o.decodePool}, err
+}
+
+func newReaderWriter(o options, client net.Conn, logger *log.Context) (*reader, *writer) {
+	r := newReader(client, o.timeout, o.decoder, o.readBufferSize)
+	r.logger = logger
+	r.logging = o.logging
+	r.decompress = internal.NewDecompressBudget(o.maxDecompressedBytes)
+	r.limits = internal.ReadLimits{
+		MaxBatchEvents: o.maxBatchEvents,
+		MaxFrameBytes:  o.maxFrameBytes,
+	}
+	r.normalize = o.normalize
+	r.batchTimeout = o.batchTimeout
+	r.codecs = o.acceptedCodecs()
+	r.keepalive = o.keepalive
+	r.strictSeq = o.strictSeq
+	r.decodeErrors = o.decodeErrors
+	r.deadLetter = o.deadLetter
+	r.rawEvents = o.rawEvents
+	r.factory = o.factory
+	r.eventCodecs = o.acceptedEventCodecs()
+	r.protobuf = o.protobuf
+	r.chunkSize = o.chunkSize
+	r.decodePool = o.decodePool
+	r.poolEvents = o.poolEvents
+	r.retainCompressed = o.retainCompressed
+	r.receivedAt = o.receivedAt
+	w := newWriter(client, o.timeout)
+	if o.ackFlushWindow > 0 {
+		w.buf = internal.NewACKBuffer(client, o.timeout, o.ackFlushWindow, o.ackFlushMax)
+	}
+	return r, w
 }